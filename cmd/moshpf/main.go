@@ -1,25 +1,37 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	"net"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/liyu1981/moshpf/pkg/agent"
 	"github.com/liyu1981/moshpf/pkg/bootstrap"
+	"github.com/liyu1981/moshpf/pkg/config"
 	"github.com/liyu1981/moshpf/pkg/constant"
+	"github.com/liyu1981/moshpf/pkg/forward"
 	"github.com/liyu1981/moshpf/pkg/logger"
 	"github.com/liyu1981/moshpf/pkg/protocol"
+	"github.com/liyu1981/moshpf/pkg/state"
 	"github.com/liyu1981/moshpf/pkg/util"
 )
 
+// jsonOutput makes commands talking to the agent print its raw response.
+var jsonOutput bool
+
+// controlSocket is where runControl sends requests: the agent's socket on
+// the remote, or a master's socket with --session or `mpf local`.
+var controlSocket = protocol.GetUnixSocketPath()
+
 func main() {
 	logger.Init()
 
-	mode := bootstrap.TransportModeFallback
-	autoForward := true
-	noRestore := false
-	localOnly := false
+	// Flags override the config file, so they are applied to its settings
+	// once the remote is known
+	var flags []func(*config.Settings)
+	var remap *forward.RemapPolicy
 	var cmd string
 	var cmdArgs []string
 
@@ -27,23 +39,44 @@ func main() {
 	for i < len(os.Args) {
 		arg := os.Args[i]
 		if arg == "--quic" {
-			mode = bootstrap.TransportModeQUIC
+			flags = append(flags, func(s *config.Settings) { s.Transport = config.TransportQUIC })
 			i++
 			continue
 		} else if arg == "--tcp" {
-			mode = bootstrap.TransportModeTCP
+			flags = append(flags, func(s *config.Settings) { s.Transport = config.TransportTCP })
 			i++
 			continue
 		} else if arg == "--no-auto-forward" {
-			autoForward = false
+			flags = append(flags, func(s *config.Settings) { s.AutoForward = false })
 			i++
 			continue
 		} else if arg == "--no-restore" {
-			noRestore = true
+			flags = append(flags, func(s *config.Settings) { s.Restore = false })
 			i++
 			continue
 		} else if arg == "--local" {
-			localOnly = true
+			flags = append(flags, func(s *config.Settings) { s.LocalOnly = true })
+			i++
+			continue
+		} else if arg == "--json" {
+			jsonOutput = true
+			i++
+			continue
+		} else if arg == "--session" {
+			if i+1 >= len(os.Args) {
+				printUsage()
+				os.Exit(1)
+			}
+			controlSocket = protocol.GetMasterSocketPath(os.Args[i+1])
+			i += 2
+			continue
+		} else if arg == "--remap-busy" || strings.HasPrefix(arg, "--remap-busy=") {
+			p, err := forward.ParseRemapPolicy(strings.TrimPrefix(strings.TrimPrefix(arg, "--remap-busy"), "="))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			remap = p
 			i++
 			continue
 		}
@@ -62,22 +95,60 @@ func main() {
 	isDev := util.IsDev()
 
 	handlers := map[string]func([]string) error{
-		"version": handleVersion,
-		"agent":   handleAgent,
-		"forward": handleForward,
-		"close":   handleClose,
-		"list":    handleList,
-		"stop":    handleStop,
+		"version":    handleVersion,
+		"agent":      handleAgent,
+		"forward":    handleForward,
+		"reverse":    handleReverse,
+		"close":      handleClose,
+		"list":       handleList,
+		"status":     handleStatus,
+		"watch":      handleWatch,
+		"top":        handleTop,
+		"pin":        handlePin,
+		"approve":    handleApprove,
+		"auto":       handleSwitch(protocol.CommandAutoForward),
+		"local-only": handleSwitch(protocol.CommandLocalOnly),
+		"stop":       handleStop,
 		"mosh": func(args []string) error {
+			var dynamic []string
+			var vhostAddr string
+			for len(args) > 0 && (args[0] == "--dynamic" || args[0] == "--vhost") {
+				if len(args) < 2 {
+					printMoshUsage()
+					os.Exit(1)
+				}
+				addr := args[1]
+				if !strings.Contains(addr, ":") {
+					addr = ":" + addr
+				}
+				if args[0] == "--vhost" {
+					vhostAddr = addr
+				} else {
+					dynamic = append(dynamic, addr)
+				}
+				args = args[2:]
+			}
 			if len(args) < 1 {
 				printMoshUsage()
 				os.Exit(1)
 			}
-			remotePath := "~/.local/bin/mpf"
-			return bootstrap.Run(args, remotePath, isDev, mode, autoForward, noRestore, localOnly)
+			cfg, err := config.Load()
+			if err != nil {
+				return err
+			}
+			s := cfg.For(args[0])
+			for _, apply := range flags {
+				apply(&s)
+			}
+			return bootstrap.Run(args, s, isDev, dynamic, vhostAddr, remap)
 		},
 	}
 
+	// local dispatches to the other handlers
+	handlers["local"] = func(args []string) error {
+		return handleLocal(handlers, args)
+	}
+
 	if handler, ok := handlers[cmd]; ok {
 		if err := handler(cmdArgs); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -97,63 +168,154 @@ func handleVersion(args []string) error {
 }
 
 func handleAgent(args []string) error {
-	return agent.Run()
+	s := config.Default()
+	if err := config.ParseAgentArgs(args, &s); err != nil {
+		return err
+	}
+	return agent.Run(s)
 }
 
 func handleForward(args []string) error {
 	if len(args) < 1 {
-		return fmt.Errorf("Usage: mpf forward <port>")
+		return fmt.Errorf("Usage: mpf forward [--host <name>] [--name <label>] <spec>... where <spec> is [udp:][<host>:]<port>[-<port>][:[<bind>:]<localPort>[-<localPort>]] | unix:<path>:<port> | unix:<path>:unix:<path>")
 	}
-	resp, err := sendToAgent("FORWARD:" + args[0])
-	if err != nil {
-		return err
+	return runControl(protocol.CommandForward, args...)
+}
+
+func handleReverse(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Usage: mpf reverse <masterPort>[:<remotePort>]")
 	}
-	fmt.Println(resp)
-	return nil
+	return runControl(protocol.CommandReverse, args[0])
 }
 
 func handleClose(args []string) error {
 	if len(args) < 1 {
-		return fmt.Errorf("Usage: mpf close <port>")
+		return fmt.Errorf("Usage: mpf close [--reverse] <[udp:]<port>[-<port>]|unix:<path>|<label>>... | --host <name>")
 	}
-	resp, err := sendToAgent("CLOSE:" + args[0])
-	if err != nil {
-		return err
+	if args[0] == "--reverse" || args[0] == "-R" {
+		if len(args) != 2 {
+			return fmt.Errorf("Usage: mpf close --reverse <remotePort>")
+		}
 	}
-	fmt.Println(resp)
-	return nil
+	return runControl(protocol.CommandClose, args...)
 }
 
 func handleList(args []string) error {
-	resp, err := sendToAgent("LIST")
-	if err != nil {
+	if err := parseJSONFlag("list", args); err != nil {
 		return err
 	}
-	if resp != "" {
-		fmt.Println(resp)
+	return runControl(protocol.CommandList)
+}
+
+func handleTop(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("Usage: mpf top")
 	}
-	return nil
+	return agent.Top(controlSocket)
 }
 
-func handleStop(args []string) error {
-	resp, err := sendToAgent("STOP")
-	if err != nil {
+func handlePin(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: mpf pin <port>")
+	}
+	return runControl(protocol.CommandPin, args[0])
+}
+
+func handleApprove(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: mpf approve <port>")
+	}
+	return runControl(protocol.CommandApprove, args[0])
+}
+
+// handleSwitch runs `mpf auto` and `mpf local-only`, which take on or off.
+func handleSwitch(command string) func([]string) error {
+	return func(args []string) error {
+		if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+			return fmt.Errorf("Usage: mpf %s <on|off>", command)
+		}
+		return runControl(command, args[0])
+	}
+}
+
+func handleWatch(args []string) error {
+	if err := parseJSONFlag("watch", args); err != nil {
 		return err
 	}
-	if resp != "" {
-		fmt.Println(resp)
+	enc := json.NewEncoder(os.Stdout)
+	return protocol.Watch(protocol.GetUnixSocketPath(), func(ev protocol.Event) {
+		if jsonOutput {
+			_ = enc.Encode(ev)
+			return
+		}
+		fmt.Printf("%s  %-22s %s\n", ev.Time.Local().Format("15:04:05"), ev.Type, ev.Message)
+	})
+}
+
+// handleLocal runs a command against the master process on this machine,
+// which must be unique unless --session picks one.
+func handleLocal(handlers map[string]func([]string) error, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Usage: mpf [--session <[user@]host>] local <forward|reverse|close|pin|list|status|top|auto|local-only> [args]")
+	}
+	switch args[0] {
+	case "forward", "reverse", "close", "pin", "list", "status", "top", "auto", "local-only":
+	default:
+		return fmt.Errorf("%s is not available on the local master", args[0])
+	}
+
+	if controlSocket == protocol.GetUnixSocketPath() {
+		all, err := state.Sessions()
+		if err != nil {
+			return err
+		}
+		// Sessions without a socket cannot be managed
+		var sessions []state.Session
+		for _, s := range all {
+			if s.Socket != "" {
+				sessions = append(sessions, s)
+			}
+		}
+		switch len(sessions) {
+		case 0:
+			return fmt.Errorf("no mpf mosh session is running on this machine")
+		case 1:
+			controlSocket = sessions[0].Socket
+		default:
+			var targets []string
+			for _, s := range sessions {
+				targets = append(targets, s.Target)
+			}
+			return fmt.Errorf("several mpf mosh sessions are running, pick one with --session: %s", strings.Join(targets, ", "))
+		}
+	}
+	return handlers[args[0]](args[1:])
+}
+
+// parseJSONFlag accepts `--json` after commands that take no other arguments.
+func parseJSONFlag(cmd string, args []string) error {
+	for _, arg := range args {
+		if arg != "--json" {
+			return fmt.Errorf("Usage: mpf %s [--json]", cmd)
+		}
+		jsonOutput = true
 	}
 	return nil
 }
 
+func handleStop(args []string) error {
+	return runControl(protocol.CommandStop)
+}
+
 func printMoshUsage() {
-	fmt.Println("Usage: mpf [flags] mosh [user@]host [more mosh args]")
+	fmt.Println("Usage: mpf [flags] mosh [--dynamic [bind:]port]... [--vhost [bind:]port] [user@]host [more mosh args]")
 }
 
 func printUsage() {
 	fmt.Printf("%s\n", constant.GetAppLine())
 	fmt.Println("\nUsage: mpf [flags] <command> [args]")
-	fmt.Println("\nFlags:")
+	fmt.Println("\nFlags (override the defaults in ~/.mpf/config):")
 	fmt.Println("  --quic          Use QUIC transport only")
 	fmt.Println("                  (Default: try QUIC, fallback to TCP)")
 	fmt.Println("  --tcp           Use TCP transport only")
@@ -161,37 +323,85 @@ func printUsage() {
 	fmt.Println("  --no-auto-forward  Disable auto port forwarding from slave side")
 	fmt.Println("  --no-restore       Disable auto restoring forwards from saved state(~/.mpf/forwards.json)")
 	fmt.Println("  --local            Bind port forwarding to local loopback only (127.0.0.1)")
+	fmt.Println("  --remap-busy[=+N|=A-B]")
+	fmt.Println("                     Move forwards whose local port is busy to the next free port,")
+	fmt.Println("                     the port plus N, or a free port in the range A-B")
+	fmt.Println("  --session <[user@]host>")
+	fmt.Println("                     Send forward, reverse, close, list and status to the local")
+	fmt.Println("                     master process of that mosh session instead of the agent")
+	fmt.Println("  --json             Print the agent's response to forward, reverse, close, list and status as JSON")
 	fmt.Println("\nCommands:")
 	fmt.Println("  mosh <args>     Start a mosh session with port forwarding")
-	fmt.Println("  forward <port>  Request port forward from an active session")
-	fmt.Println("  close <port>    Close an active port forward")
-	fmt.Println("  list            List active port forwards")
+	fmt.Println("                  --dynamic <port> starts a SOCKS5/HTTP CONNECT proxy through the remote")
+	fmt.Println("                  --vhost <port> routes <name>.<host>.localhost by HTTP Host/TLS SNI (default 8443)")
+	fmt.Println("  forward [udp:][<host>:]<port>[-<port>][:[<bind>:]<localPort>[-<localPort>]]...")
+	fmt.Println("                  Request port forwards from an active session, optionally to a")
+	fmt.Println("                  host reachable from the remote")
+	fmt.Println("  forward --name <label> <spec>")
+	fmt.Println("                  Label a forward, so that list shows it and close takes the label")
+	fmt.Println("  forward --host <name> <port>")
+	fmt.Println("                  Route <name>.<host>.localhost on the host routing port to <port>")
+	fmt.Println("  forward unix:<path>:<port>|unix:<path>")
+	fmt.Println("                  Forward a remote unix socket to a local port or socket")
+	fmt.Println("  reverse <masterPort>[:<remotePort>]")
+	fmt.Println("                  Expose a master-side port on the remote side")
+	fmt.Println("  close [--reverse] [udp:]<port>[-<port>]|unix:<path>|<label>... | --host <name>")
+	fmt.Println("                  Close active (reverse) port forwards")
+	fmt.Println("  list [--json]   List active port forwards")
+	fmt.Println("  status [--json] Show the agent, and on this machine every running mpf mosh")
+	fmt.Println("                  session with its forwards")
+	fmt.Println("  watch [--json]  Print forward and session events as they happen")
+	fmt.Println("  top             Full-screen dashboard of the forwards with live throughput")
+	fmt.Println("  pin <port>      Keep an auto forward after its remote port closes")
+	fmt.Println("  approve <port>  Forward a port an AutoForwardRule holds back for approval")
+	fmt.Println("  auto on|off     Switch auto forwarding of the remote's listening ports")
+	fmt.Println("  local-only on|off")
+	fmt.Println("                  Switch between binding forwards to 127.0.0.1 and all interfaces")
+	fmt.Println("  local <command> Run forward, reverse, close, list or status on the local master")
+	fmt.Println("                  process (on the machine running `mpf mosh`)")
 	// fmt.Println("  stop            Stop the active agent")
 	fmt.Println("  version         Show version")
 	// fmt.Println("  agent           Run in agent mode (internal use)")
 }
 
-func sendToAgent(cmd string) (string, error) {
-	sockPath := protocol.GetUnixSocketPath()
-
-	conn, err := net.Dial("unix", sockPath)
+// runControl sends command to the agent and prints its response, as JSON
+// with --json. It fails when the agent reports any error.
+func runControl(command string, args ...string) error {
+	resp, err := protocol.SendControl(controlSocket, command, args...)
 	if err != nil {
-		return "", fmt.Errorf("could not connect to agent at %s: %v", sockPath, err)
+		return err
 	}
-	defer conn.Close()
 
-	_, err = conn.Write([]byte(cmd))
-	if err != nil {
-		return "", err
+	if jsonOutput {
+		_ = json.NewEncoder(os.Stdout).Encode(resp)
+		if !resp.Success {
+			os.Exit(1)
+		}
+		return nil
 	}
 
-	// Read response
-	buf := make([]byte, 4096)
-	n, err := conn.Read(buf)
-	if err != nil {
-		// It's okay if there's no response for some commands
-		return "", nil
+	if resp.Error != nil {
+		return resp.Error
 	}
-
-	return string(buf[:n]), nil
+	if resp.Message != "" {
+		fmt.Println(resp.Message)
+	}
+	if resp.List != nil {
+		fmt.Println(agent.FormatList(resp.List, resp.Status, time.Now()))
+	} else if resp.Status != nil {
+		fmt.Println(agent.FormatStatus(resp.Status))
+	}
+	failed := 0
+	for _, r := range resp.Results {
+		if r.Success {
+			fmt.Println(r.Message)
+		} else {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", r.Message)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d requests failed", failed, len(resp.Results))
+	}
+	return nil
 }
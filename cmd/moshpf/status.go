@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/liyu1981/moshpf/pkg/agent"
+	"github.com/liyu1981/moshpf/pkg/protocol"
+	"github.com/liyu1981/moshpf/pkg/state"
+)
+
+// statusOutput is what `mpf status --json` prints.
+type statusOutput struct {
+	Agent     *protocol.AgentStatus `json:"agent,omitempty"`
+	Sessions  []sessionStatus       `json:"sessions"`
+	Conflicts []string              `json:"conflicts,omitempty"`
+}
+
+// sessionStatus is a registered `mpf mosh` process and what it reported.
+type sessionStatus struct {
+	state.Session
+	Status *protocol.AgentStatus  `json:"status,omitempty"`
+	List   *protocol.ListResponse `json:"list,omitempty"`
+	Error  string                 `json:"error,omitempty"`
+}
+
+func handleStatus(args []string) error {
+	if err := parseJSONFlag("status", args); err != nil {
+		return err
+	}
+	// --session and `mpf local status` ask a single master
+	if controlSocket != protocol.GetUnixSocketPath() {
+		return runControl(protocol.CommandStatus)
+	}
+
+	var out statusOutput
+	if resp, err := protocol.SendControl(protocol.GetUnixSocketPath(), protocol.CommandStatus); err == nil && resp.Status != nil {
+		out.Agent = resp.Status
+	}
+
+	sessions, err := state.Sessions()
+	if err != nil {
+		return err
+	}
+	entries := make(map[string][]protocol.ForwardEntry)
+	for _, s := range sessions {
+		ss := sessionStatus{Session: s}
+		if s.Socket == "" {
+			ss.Error = "no control socket, another mpf mosh session for this host holds it"
+			out.Sessions = append(out.Sessions, ss)
+			continue
+		}
+		resp, err := protocol.SendControl(s.Socket, protocol.CommandList)
+		switch {
+		case err != nil:
+			ss.Error = err.Error()
+		case resp.Error != nil:
+			ss.Error = resp.Error.Message
+		default:
+			ss.Status, ss.List = resp.Status, resp.List
+			entries[s.Target] = resp.List.Entries
+		}
+		out.Sessions = append(out.Sessions, ss)
+	}
+	out.Conflicts = agent.FindPortConflicts(entries)
+
+	if out.Agent == nil && len(out.Sessions) == 0 {
+		return fmt.Errorf("no mpf agent or mpf mosh session is running")
+	}
+
+	if jsonOutput {
+		return json.NewEncoder(os.Stdout).Encode(out)
+	}
+
+	if out.Agent != nil {
+		fmt.Println(agent.FormatStatus(out.Agent))
+	}
+	now := time.Now()
+	for i, ss := range out.Sessions {
+		if i > 0 || out.Agent != nil {
+			fmt.Println()
+		}
+		if ss.Error != "" {
+			fmt.Printf("%s (pid %d): ERROR: %s\n", ss.Target, ss.PID, ss.Error)
+			continue
+		}
+		fmt.Println(agent.FormatMaster(ss.Status, ss.List, now))
+	}
+	if len(out.Conflicts) > 0 {
+		fmt.Println()
+		for _, c := range out.Conflicts {
+			fmt.Printf("WARNING: %s\n", c)
+		}
+	}
+	return nil
+}
@@ -9,10 +9,10 @@ import (
 	"net"
 	"os"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
+	"github.com/liyu1981/moshpf/pkg/config"
 	"github.com/liyu1981/moshpf/pkg/constant"
 	"github.com/liyu1981/moshpf/pkg/logger"
 	"github.com/liyu1981/moshpf/pkg/protocol"
@@ -26,10 +26,13 @@ type Agent struct {
 	sessions      *tunnel.SessionManager
 	mu            sync.Mutex
 	listChan      chan protocol.ListResponse
-	closeChan     chan protocol.CloseResponse
-	listenChan    chan protocol.ListenResponse
+	replies       replies
 	shutdownTimer *time.Timer
 	autoForwarder *AutoForwarder
+	events        *eventHub
+	settings      config.Settings
+
+	reverseListeners map[uint16]*reverseListener
 }
 
 func (a *Agent) addSession(s *tunnel.Session) {
@@ -41,7 +44,16 @@ func (a *Agent) addSession(s *tunnel.Session) {
 	}
 	a.mu.Unlock()
 
+	transport := s.Mux.Type()
+	ev := protocol.NewEvent(protocol.EventSessionConnected, "Session connected over %s", transport)
+	ev.Transport = transport
+	a.events.publish(ev)
+
 	a.sessions.Add(s, func() {
+		ev := protocol.NewEvent(protocol.EventSessionDropped, "Session over %s dropped", transport)
+		ev.Transport = transport
+		a.events.publish(ev)
+
 		var maxWait = 10 * time.Minute
 		if util.IsDev() {
 			maxWait = 5 * time.Second
@@ -52,6 +64,7 @@ func (a *Agent) addSession(s *tunnel.Session) {
 				a.shutdownTimer.Stop()
 			}
 			log.Info().Msg("No active sessions left, starting 10-minute shutdown timer")
+			a.events.publish(protocol.NewEvent(protocol.EventShutdownTimer, "No active sessions left, agent exits in %s unless one reconnects", maxWait))
 			a.shutdownTimer = time.AfterFunc(maxWait, func() {
 				log.Info().Msg("Shutdown timer expired, agent exiting")
 				os.Exit(0)
@@ -95,9 +108,12 @@ func (a *Agent) handleMessage(s *tunnel.Session, msg protocol.Message) {
 		// Master requesting list from agent (slave)
 		// For now, slave doesn't track its own forwards as all listening is on master.
 		_ = s.Send(protocol.ListResponse{
-			Entries:  []protocol.ForwardEntry{},
-			MasterIP: protocol.GetLocalIP(),
+			Entries:   []protocol.ForwardEntry{},
+			MasterIP:  protocol.GetLocalIP(),
+			MasterIPs: protocol.GetLocalIPs(),
 		})
+	case protocol.Event:
+		a.events.publish(m)
 	case protocol.ListResponse:
 		log.Debug().Int("count", len(m.Entries)).Msg("Agent received ListResponse")
 		select {
@@ -107,40 +123,58 @@ func (a *Agent) handleMessage(s *tunnel.Session, msg protocol.Message) {
 		}
 	case protocol.ListenResponse:
 		if m.Success {
-			log.Info().Uint16("port", m.RemotePort).Msg("Forwarding confirmed by daemon")
+			log.Info().Uint16("port", m.RemotePort).Uint16("local", m.LocalPort).Msg("Forwarding confirmed by daemon")
 		} else {
 			log.Error().Uint16("port", m.RemotePort).Str("reason", m.Reason).Msg("Forwarding failed in daemon")
 		}
-		select {
-		case a.listenChan <- m:
-		default:
-			log.Warn().Msg("ListenResponse dropped - no receiver")
-		}
 	case protocol.CloseResponse:
-		select {
-		case a.closeChan <- m:
-		default:
-			log.Warn().Msg("CloseResponse dropped - no receiver")
-		}
+		a.deliverReply(m.ID, m)
+	case protocol.ListenBatchResponse:
+		a.deliverReply(m.ID, m)
+	case protocol.CloseBatchResponse:
+		a.deliverReply(m.ID, m)
+	case protocol.ReverseResponse:
+		a.deliverReply(m.ID, m)
+	case protocol.PinResponse:
+		a.deliverReply(m.ID, m)
+	case protocol.AutoForwardState:
+		a.setAutoForward(m.Enabled)
 	case protocol.ListenRequest:
-		// For future support of reverse port forwarding
-		log.Warn().Msg("ListenRequest received from master, not implemented yet")
+		// Master asking us to listen for a reverse forward
+		_ = s.Send(a.listenReverse(m))
+	case protocol.ProbeRequest:
+		go a.handleProbe(s, m)
+	case protocol.CloseRequest:
+		// Master closing a reverse forward
+		_ = s.Send(protocol.CloseResponse{
+			ID:      m.ID,
+			Port:    m.Port,
+			Success: a.closeReverse(m.Port),
+		})
 	default:
 		log.Debug().Type("type", msg).Msg("Unknown message type received")
 	}
 }
 
+// deliverReply passes an answer of the master to the CLI command waiting for
+// it.
+func (a *Agent) deliverReply(id uint64, msg protocol.Message) {
+	if !a.replies.deliver(id, msg) {
+		log.Warn().Uint64("id", id).Type("type", msg).Msg("Reply dropped - no receiver")
+	}
+}
+
 func (a *Agent) startStreamAcceptor(s *tunnel.Session) {
 	for {
 		stream, err := s.Mux.AcceptStream()
 		if err != nil {
 			return
 		}
-		go a.handleAcceptedStream(stream)
+		go a.handleAcceptedStream(s, stream)
 	}
 }
 
-func (a *Agent) handleAcceptedStream(stream io.ReadWriteCloser) {
+func (a *Agent) handleAcceptedStream(s *tunnel.Session, stream io.ReadWriteCloser) {
 	defer stream.Close()
 
 	decoder := gob.NewDecoder(stream)
@@ -150,8 +184,20 @@ func (a *Agent) handleAcceptedStream(stream io.ReadWriteCloser) {
 		return
 	}
 
-	target := fmt.Sprintf("%s:%d", header.Host, header.Port)
-	remoteConn, err := net.Dial("tcp", target)
+	if header.Network == protocol.ProtocolUDP {
+		a.handleUDPStream(s, stream, header)
+		return
+	}
+
+	var remoteConn net.Conn
+	var err error
+	target := net.JoinHostPort(header.Host, strconv.Itoa(int(header.Port)))
+	if header.Network == protocol.ProtocolUnix {
+		target = header.Path
+		remoteConn, err = net.Dial("unix", target)
+	} else {
+		remoteConn, err = util.DialTCP(header.Host, header.Port)
+	}
 	if err != nil {
 		log.Error().Err(err).Str("target", target).Msg("Failed to dial target")
 		_, _ = stream.Write([]byte{0}) // NAK
@@ -164,7 +210,9 @@ func (a *Agent) handleAcceptedStream(stream io.ReadWriteCloser) {
 	util.Proxy(remoteConn, stream)
 }
 
-func Run() error {
+// Run serves a master over stdio. settings carries the QUIC port range and
+// the auto forwarding scan interval and exclusions.
+func Run(settings config.Settings) error {
 	logger.Init()
 	log.Info().Msg("Agent starting")
 
@@ -178,11 +226,12 @@ func Run() error {
 	var qListener *quic.Listener
 	var qPort uint16
 	quicConfig := &quic.Config{
-		Tracer: logger.GetQuicTracer(),
+		Tracer:          logger.GetQuicTracer(),
+		EnableDatagrams: true,
 	}
 
 	for {
-		port := uint16(constant.QUIC_PORT_START + rand.Intn(constant.QUIC_PORT_END-constant.QUIC_PORT_START+1))
+		port := settings.QUICPortStart + uint16(rand.Intn(int(settings.QUICPortEnd-settings.QUICPortStart)+1))
 		l, err := quic.ListenAddr(fmt.Sprintf(":%d", port), tunnel.GetTLSConfigServer(cert), quicConfig)
 		if err == nil {
 			qListener = l
@@ -206,10 +255,12 @@ func Run() error {
 
 	a := &Agent{
 		sessions:      tunnel.NewSessionManager(),
+		events:        newEventHub(),
 		listChan:      make(chan protocol.ListResponse, 10),
-		closeChan:     make(chan protocol.CloseResponse, 10),
-		listenChan:    make(chan protocol.ListenResponse, 10),
 		shutdownTimer: nil,
+		settings:      settings,
+
+		reverseListeners: make(map[uint16]*reverseListener),
 	}
 
 	msg, err := session.Receive()
@@ -226,6 +277,7 @@ func Run() error {
 		return fmt.Errorf("version mismatch: %s != %s", hello.Version, constant.Version)
 	}
 
+	a.settings.Rules = hello.Rules
 	if hello.AutoForward {
 		log.Info().Msg("Auto port forwarding enabled")
 		a.autoForwarder = NewAutoForwarder(a)
@@ -298,148 +350,26 @@ func (a *Agent) startUnixSocketServer() {
 
 func (a *Agent) handleUnixConn(conn net.Conn) {
 	defer conn.Close()
-	buf := make([]byte, 1024)
-	n, err := conn.Read(buf)
+
+	req, err := protocol.ReadControlRequest(conn)
 	if err != nil {
+		_ = protocol.WriteControlResponse(conn, protocol.NewControlError(protocol.CodeBadRequest, "malformed request: %v", err))
 		return
 	}
 
-	cmd := strings.TrimSpace(string(buf[:n]))
-	if cmd == "STOP" {
-		log.Info().Msg("Stop command received, shutting down")
-		_, _ = conn.Write([]byte("Stopping agent..."))
-		os.Exit(0)
-	}
-
-	if cmd == "SESSIONS" {
-		_, _ = conn.Write([]byte(strconv.Itoa(a.sessions.Count())))
+	if req.Command == protocol.CommandWatch && req.Version == protocol.ControlVersion {
+		if err := protocol.WriteControlResponse(conn, protocol.ControlResponse{Success: true}); err == nil {
+			a.serveWatch(conn)
+		}
 		return
 	}
 
-	if cmd == "LIST" {
-		if a.sessions.Count() == 0 {
-			_, _ = conn.Write([]byte("ERROR: No active session"))
-			return
-		}
-
-		s := a.getBestSession()
-		if s == nil {
-			_, _ = conn.Write([]byte("ERROR: No active session"))
-			return
-		}
-
-		err = s.Send(protocol.ListRequest{})
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to send ListRequest")
-			return
-		}
-
-		select {
-		case resp := <-a.listChan:
-			res := fmt.Sprintf("Session: %s -> %s\n", resp.MasterIP, protocol.GetLocalIP())
-			for _, e := range resp.Entries {
-				status := "OK"
-				if e.Error != "" {
-					status = "ERROR: " + e.Error
-				}
-
-				localAddr := e.LocalAddr
-				if strings.HasPrefix(localAddr, ":") {
-					localAddr = resp.MasterIP + localAddr
-				}
+	resp := a.handleControl(req)
+	_ = protocol.WriteControlResponse(conn, resp)
 
-				autoStr := "MANUAL"
-				if e.IsAuto {
-					autoStr = "AUTO"
-				}
-
-				res += fmt.Sprintf("  %d -> %s [%s] (%s) %s\n", e.RemotePort, localAddr, e.Transport, status, autoStr)
-			}
-			_, _ = conn.Write([]byte(res))
-		case <-time.After(5 * time.Second):
-			_, _ = conn.Write([]byte("ERROR: Timeout waiting for list response"))
-		}
-	} else if strings.HasPrefix(cmd, "CLOSE:") {
-		portStr := strings.TrimPrefix(cmd, "CLOSE:")
-		port, err := strconv.ParseUint(portStr, 10, 16)
-		if err != nil {
-			_, _ = conn.Write([]byte("ERROR: Invalid port"))
-			return
-		}
-
-		s := a.getBestSession()
-		if s == nil {
-			_, _ = conn.Write([]byte("ERROR: No active session"))
-			return
-		}
-
-		err = s.Send(protocol.CloseRequest{Port: uint16(port)})
-		if err != nil {
-			_, _ = conn.Write([]byte("ERROR: Failed to send CloseRequest"))
-			return
-		}
-
-		select {
-		case resp := <-a.closeChan:
-			if resp.Success {
-				_, _ = conn.Write([]byte(fmt.Sprintf("Closed port %d", resp.Port)))
-			} else {
-				_, _ = conn.Write([]byte(fmt.Sprintf("ERROR: Failed to close port %d: %s", resp.Port, resp.Reason)))
-			}
-		case <-time.After(5 * time.Second):
-			_, _ = conn.Write([]byte("ERROR: Timeout waiting for close response"))
-		}
-	} else if strings.HasPrefix(cmd, "FORWARD:") {
-		arg := strings.TrimPrefix(cmd, "FORWARD:")
-		var slavePort, masterPort uint16
-		if strings.Contains(arg, ":") {
-			parts := strings.Split(arg, ":")
-			s_port, _ := strconv.ParseUint(parts[0], 10, 16)
-			m_port, _ := strconv.ParseUint(parts[1], 10, 16)
-			slavePort = uint16(s_port)
-			masterPort = uint16(m_port)
-		} else {
-			p, _ := strconv.ParseUint(arg, 10, 16)
-			slavePort = uint16(p)
-			masterPort = uint16(p)
-		}
-
-		if slavePort == 0 || masterPort == 0 {
-			_, _ = conn.Write([]byte("ERROR: Invalid port mapping"))
-			return
-		}
-
-		s := a.getBestSession()
-		if s == nil {
-			_, _ = conn.Write([]byte("ERROR: No active session"))
-			return
-		}
-
-		localAddr := fmt.Sprintf(":%d", masterPort)
-		remoteHost := "localhost"
-
-		log.Info().Uint16("slave", slavePort).Uint16("master", masterPort).Msg("Requesting listen from daemon")
-		err = s.Send(protocol.ListenRequest{
-			LocalAddr:  localAddr,
-			RemoteHost: remoteHost,
-			RemotePort: slavePort,
-		})
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to send ListenRequest")
-			_, _ = conn.Write([]byte("ERROR: Failed to send ListenRequest"))
-			return
-		}
-
-		select {
-		case resp := <-a.listenChan:
-			if resp.Success {
-				_, _ = conn.Write([]byte(fmt.Sprintf("Forwarding started: slave %d -> master %d", slavePort, masterPort)))
-			} else {
-				_, _ = conn.Write([]byte(fmt.Sprintf("ERROR: Failed to start forwarding: %s", resp.Reason)))
-			}
-		case <-time.After(5 * time.Second):
-			_, _ = conn.Write([]byte("ERROR: Timeout waiting for listen response"))
-		}
+	if req.Command == protocol.CommandStop && resp.Success {
+		log.Info().Msg("Stop command received, shutting down")
+		os.Exit(0)
 	}
 }
 
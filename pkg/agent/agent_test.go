@@ -1,17 +1,19 @@
 package agent
 
 import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/liyu1981/moshpf/pkg/protocol"
+	"github.com/liyu1981/moshpf/pkg/tunnel"
 )
 
 func TestAgentHandleMessage(t *testing.T) {
-	a := &Agent{
-		listChan:   make(chan protocol.ListResponse, 1),
-		listenChan: make(chan protocol.ListenResponse, 1),
-		closeChan:  make(chan protocol.CloseResponse, 1),
-	}
+	a := &Agent{listChan: make(chan protocol.ListResponse, 1)}
 
 	// Test ListResponse
 	listResp := protocol.ListResponse{
@@ -29,27 +31,224 @@ func TestAgentHandleMessage(t *testing.T) {
 		t.Error("ListResponse not received on channel")
 	}
 
-	// Test ListenResponse
-	listenResp := protocol.ListenResponse{Success: true, RemotePort: 1234}
-	a.handleMessage(nil, listenResp)
-	select {
-	case resp := <-a.listenChan:
-		if resp.RemotePort != 1234 {
-			t.Errorf("Expected port 1234, got %d", resp.RemotePort)
+	// Replies reach the command waiting for their ID
+	replies := []protocol.Message{
+		protocol.CloseResponse{Success: true, Port: 5678},
+		protocol.ListenBatchResponse{Responses: []protocol.ListenResponse{{Success: true, RemotePort: 3000}}},
+		protocol.CloseBatchResponse{Responses: []protocol.CloseResponse{{Success: true, Port: 3000}}},
+		protocol.ReverseResponse{Success: true, RemotePort: 6000},
+		protocol.PinResponse{Success: true, Port: 3000},
+	}
+	for _, reply := range replies {
+		id, ch := a.replies.wait()
+		// An answer nobody waits for is dropped
+		a.handleMessage(nil, withID(reply, id+100))
+		a.handleMessage(nil, withID(reply, id))
+		select {
+		case got := <-ch:
+			if !reflect.DeepEqual(got, withID(reply, id)) {
+				t.Errorf("Expected %+v, got %+v", withID(reply, id), got)
+			}
+		default:
+			t.Errorf("%T not received", reply)
 		}
-	default:
-		t.Error("ListenResponse not received on channel")
+		a.replies.done(id)
+	}
+	if len(a.replies.waiting) != 0 {
+		t.Errorf("Expected no waiting commands, got %d", len(a.replies.waiting))
+	}
+}
+
+// withID sets the ID of a reply of the master.
+func withID(msg protocol.Message, id uint64) protocol.Message {
+	switch m := msg.(type) {
+	case protocol.CloseResponse:
+		m.ID = id
+		return m
+	case protocol.ListenBatchResponse:
+		m.ID = id
+		return m
+	case protocol.CloseBatchResponse:
+		m.ID = id
+		return m
+	case protocol.ReverseResponse:
+		m.ID = id
+		return m
+	case protocol.PinResponse:
+		m.ID = id
+		return m
+	}
+	return msg
+}
+
+func TestAgentHandleControl(t *testing.T) {
+	a := &Agent{sessions: tunnel.NewSessionManager()}
+
+	resp := a.handleControl(protocol.ControlRequest{Version: protocol.ControlVersion + 1, Command: protocol.CommandList})
+	if resp.Success || resp.Error == nil || resp.Error.Code != protocol.CodeUnsupportedVersion {
+		t.Errorf("Expected unsupported version, got %+v", resp)
+	}
+
+	resp = a.handleControl(protocol.ControlRequest{Version: protocol.ControlVersion, Command: "bogus"})
+	if resp.Error == nil || resp.Error.Code != protocol.CodeUnknownCommand {
+		t.Errorf("Expected unknown command, got %+v", resp)
+	}
+
+	resp = a.handleControl(protocol.ControlRequest{Version: protocol.ControlVersion, Command: protocol.CommandList})
+	if resp.Error == nil || resp.Error.Code != protocol.CodeNoSession {
+		t.Errorf("Expected no session, got %+v", resp)
+	}
+
+	resp = a.handleControl(protocol.ControlRequest{Version: protocol.ControlVersion, Command: protocol.CommandForward, Args: []string{"notaport"}})
+	if resp.Error == nil || resp.Error.Code != protocol.CodeInvalidArgument {
+		t.Errorf("Expected invalid argument, got %+v", resp)
+	}
+
+	resp = a.handleControl(protocol.ControlRequest{Version: protocol.ControlVersion, Command: protocol.CommandSessions})
+	if !resp.Success || resp.Sessions != 0 {
+		t.Errorf("Expected 0 sessions, got %+v", resp)
+	}
+
+	resp = a.handleControl(protocol.ControlRequest{Version: protocol.ControlVersion, Command: protocol.CommandStatus})
+	if !resp.Success || resp.Status == nil || resp.Status.Sessions != 0 || resp.Status.PID == 0 || resp.Status.Version == "" {
+		t.Errorf("Expected status without sessions, got %+v", resp)
+	}
+}
+
+func TestAgentWatch(t *testing.T) {
+	a := &Agent{events: newEventHub()}
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		a.serveWatch(server)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		a.events.mu.Lock()
+		n := len(a.events.subs)
+		a.events.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Watcher never subscribed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	a.handleMessage(nil, protocol.NewEvent(protocol.EventForwardStarted, "Auto forward started: 3000/tcp -> :3000"))
+
+	var ev protocol.Event
+	if err := json.NewDecoder(client).Decode(&ev); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if ev.Type != protocol.EventForwardStarted || ev.Message != "Auto forward started: 3000/tcp -> :3000" {
+		t.Errorf("Unexpected event %+v", ev)
 	}
 
-	// Test CloseResponse
-	closeResp := protocol.CloseResponse{Success: true, Port: 5678}
-	a.handleMessage(nil, closeResp)
+	client.Close()
 	select {
-	case resp := <-a.closeChan:
-		if resp.Port != 5678 {
-			t.Errorf("Expected port 5678, got %d", resp.Port)
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("serveWatch did not return after the client left")
+	}
+	if len(a.events.subs) != 0 {
+		t.Errorf("Expected watcher to unsubscribe")
+	}
+}
+
+// newSessionPair connects an agent and a master session over a pipe.
+func newSessionPair(t *testing.T) (*tunnel.Session, *tunnel.Session) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	var agentSide, masterSide *tunnel.Session
+	errChan := make(chan error, 2)
+	go func() {
+		var err error
+		agentSide, err = tunnel.NewSession(c1, true)
+		errChan <- err
+	}()
+	go func() {
+		var err error
+		masterSide, err = tunnel.NewSession(c2, false)
+		errChan <- err
+	}()
+	for i := 0; i < 2; i++ {
+		if err := <-errChan; err != nil {
+			t.Fatalf("NewSession failed: %v", err)
 		}
-	default:
-		t.Error("CloseResponse not received on channel")
+	}
+	t.Cleanup(func() {
+		agentSide.Mux.Close()
+		masterSide.Mux.Close()
+	})
+	return agentSide, masterSide
+}
+
+func TestControlRepliesByID(t *testing.T) {
+	agentSide, masterSide := newSessionPair(t)
+
+	a := &Agent{sessions: tunnel.NewSessionManager()}
+	a.sessions.Add(agentSide, nil)
+	defer a.sessions.Remove(agentSide)
+	go func() {
+		for {
+			msg, err := agentSide.Receive()
+			if err != nil {
+				return
+			}
+			a.handleMessage(agentSide, msg)
+		}
+	}()
+
+	// Play the master: wait for both forwards, send a stale failure first,
+	// then answer the requests in reverse order
+	go func() {
+		var reqs []protocol.ListenBatchRequest
+		for len(reqs) < 2 {
+			msg, err := masterSide.Receive()
+			if err != nil {
+				return
+			}
+			if m, ok := msg.(protocol.ListenBatchRequest); ok {
+				reqs = append(reqs, m)
+			}
+		}
+		_ = masterSide.Send(protocol.ListenBatchResponse{
+			ID:        reqs[0].ID + reqs[1].ID,
+			Responses: []protocol.ListenResponse{{RemotePort: 1, Reason: "stale"}},
+		})
+		for i := len(reqs) - 1; i >= 0; i-- {
+			r := reqs[i].Requests[0]
+			_ = masterSide.Send(protocol.ListenBatchResponse{
+				ID:        reqs[i].ID,
+				Responses: []protocol.ListenResponse{{RemotePort: r.RemotePort, LocalPort: r.RemotePort, Success: true}},
+			})
+		}
+	}()
+
+	results := make(chan protocol.ControlResponse, 2)
+	for _, port := range []string{"3000", "4000"} {
+		go func() {
+			results <- a.controlForward([]string{port})
+		}()
+	}
+	got := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		resp := <-results
+		if !resp.Success || len(resp.Results) != 1 {
+			t.Fatalf("Expected a single success, got %+v", resp)
+		}
+		msg := resp.Results[0].Message
+		for _, port := range []string{"3000", "4000"} {
+			if strings.Contains(msg, "slave "+port) && strings.Contains(msg, "master "+port) {
+				got[port] = true
+			}
+		}
+	}
+	if !got["3000"] || !got["4000"] {
+		t.Errorf("Expected each forward to get its own answer, got %v", got)
 	}
 }
@@ -2,38 +2,84 @@ package agent
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/liyu1981/moshpf/pkg/constant"
 	"github.com/liyu1981/moshpf/pkg/protocol"
 	"github.com/rs/zerolog/log"
-	"github.com/shirou/gopsutil/v3/net"
-	"github.com/shirou/gopsutil/v3/process"
 )
 
 type AutoForwarder struct {
 	agent          *Agent
 	activeForwards map[uint32]bool
-	mu             sync.Mutex
-	stopChan       chan struct{}
-	excludedSubs   []string
-	currentExe     string
+	// detected holds the ports of notify-only and require-approval rules,
+	// approved those of the latter the user approved.
+	detected     map[uint32]listeningPort
+	approved     map[uint32]bool
+	mu           sync.Mutex
+	stopChan     chan struct{}
+	stopped      bool
+	rules        *protocol.RuleMatcher
+	excludedSubs []string
+	source       portSource
+	procs        *procCache
+	// containers is nil when container ports are not auto forwarded.
+	containers *containerSource
+	currentExe string
+	// uid is the agent's user; the ports of other users are left alone
+	// unless otherUsers is set.
+	uid        int64
+	otherUsers bool
+}
+
+// listeningPort is a port found by a scan and what to do with it. user is
+// set when another user owns it. host is the address the forward dials and
+// bind lists the addresses the port listens on. silent forwards are not
+// notified on the master.
+type listeningPort struct {
+	action    string
+	label     string
+	localPort uint16
+	user      string
+	host      string
+	bind      string
+	silent    bool
 }
 
 func NewAutoForwarder(agent *Agent) *AutoForwarder {
 	exe, _ := os.Executable()
 	exe, _ = filepath.EvalSymlinks(exe)
 
+	rules, err := protocol.CompileRules(agent.settings.Rules)
+	if err != nil {
+		log.Error().Err(err).Msg("Ignoring invalid auto forward rules")
+	}
+
+	var containers *containerSource
+	if agent.settings.Containers {
+		containers = newContainerSource(agent.settings.ScanInterval)
+	}
+
 	return &AutoForwarder{
 		agent:          agent,
 		activeForwards: make(map[uint32]bool),
+		detected:       make(map[uint32]listeningPort),
+		approved:       make(map[uint32]bool),
 		stopChan:       make(chan struct{}),
 		currentExe:     exe,
-		excludedSubs:   constant.AutoForwardExcludedSubstrings,
+		rules:          rules,
+		excludedSubs:   agent.settings.Exclude,
+		source:         newPortSource(agent.settings.ScanInterval, agent.settings.WatchInterval),
+		procs:          newProcCache(),
+		uid:            int64(os.Getuid()),
+		otherUsers:     agent.settings.OtherUsers,
+		containers:     containers,
 	}
 }
 
@@ -45,8 +91,21 @@ func (af *AutoForwarder) Stop() {
 	close(af.stopChan)
 }
 
+// StopAndClose stops scanning and closes every forward it started, except
+// those pinned on the master meanwhile.
+func (af *AutoForwarder) StopAndClose() {
+	af.Stop()
+
+	af.mu.Lock()
+	defer af.mu.Unlock()
+	af.stopped = true
+	for p := range af.activeForwards {
+		af.stopForward(p)
+	}
+}
+
 func (af *AutoForwarder) run() {
-	ticker := time.NewTicker(constant.AutoForwardScanInterval)
+	ticker := time.NewTicker(af.source.interval())
 	defer ticker.Stop()
 
 	for {
@@ -67,39 +126,65 @@ func (af *AutoForwarder) scan() {
 	}
 
 	af.mu.Lock()
-	foundPorts := make(map[uint32]bool)
-	for _, p := range ports {
-		foundPorts[p] = true
-		if !af.activeForwards[p] {
-			af.startForward(p)
+	if af.stopped {
+		af.mu.Unlock()
+		return
+	}
+	for p, lp := range ports {
+		switch {
+		case af.activeForwards[p]:
+		case lp.action == protocol.ActionForward || af.approved[p]:
+			af.startForward(p, lp)
+		default:
+			af.detect(p, lp)
 		}
 	}
 
 	// Detect closed ports
 	for p := range af.activeForwards {
-		if !foundPorts[p] {
+		if _, found := ports[p]; !found {
 			af.stopForward(p)
 		}
 	}
+	for p := range af.detected {
+		if _, found := ports[p]; !found {
+			delete(af.detected, p)
+		}
+	}
+	for p := range af.approved {
+		if _, found := ports[p]; !found {
+			delete(af.approved, p)
+		}
+	}
 	af.mu.Unlock()
 }
 
-func (af *AutoForwarder) startForward(port uint32) {
+func (af *AutoForwarder) startForward(port uint32, lp listeningPort) {
 	s := af.agent.getBestSession()
 	if s == nil {
 		return
 	}
 
+	localPort := uint16(port)
+	if lp.localPort != 0 {
+		localPort = lp.localPort
+	}
+
 	log.Info().Uint32("port", port).Msg("Auto-forwarding new port")
 	err := s.Send(protocol.ListenRequest{
-		LocalAddr:  fmt.Sprintf(":%d", port),
-		RemoteHost: "localhost",
+		LocalAddr:  fmt.Sprintf(":%d", localPort),
+		RemoteHost: lp.host,
 		RemotePort: uint16(port),
 		IsAuto:     true,
+		Name:       lp.label,
+		User:       lp.user,
+		RemoteBind: lp.bind,
+		Silent:     lp.silent,
 	})
 
 	if err == nil {
 		af.activeForwards[port] = true
+		delete(af.detected, port)
 	} else {
 		log.Error().Err(err).Uint32("port", port).Msg("Failed to send ListenRequest for auto-forward")
 	}
@@ -113,7 +198,8 @@ func (af *AutoForwarder) stopForward(port uint32) {
 
 	log.Info().Uint32("port", port).Msg("Stopping auto-forward for closed port")
 	err := s.Send(protocol.CloseRequest{
-		Port: uint16(port),
+		Port:   uint16(port),
+		IsAuto: true,
 	})
 
 	if err == nil {
@@ -123,57 +209,301 @@ func (af *AutoForwarder) stopForward(port uint32) {
 	}
 }
 
-func (af *AutoForwarder) listListeningPorts() ([]uint32, error) {
-	conns, err := net.Connections("tcp")
+// detect reports a port held back by a notify-only or require-approval rule
+// the first time it is seen.
+func (af *AutoForwarder) detect(port uint32, lp listeningPort) {
+	if _, seen := af.detected[port]; seen {
+		return
+	}
+	af.detected[port] = lp
+
+	d := protocol.DetectedPort{Port: uint16(port), Label: lp.label, Action: lp.action}
+	var ev protocol.Event
+	if lp.action == protocol.ActionRequireApproval {
+		ev = protocol.NewEvent(protocol.EventApprovalRequired, "Port %d%s waits for approval: mpf approve %d", port, labelSuffix(lp.label), port)
+	} else {
+		ev = protocol.NewEvent(protocol.EventPortDetected, "Port %d%s is listening", port, labelSuffix(lp.label))
+	}
+	ev.Detected = &d
+	af.agent.events.publish(ev)
+	log.Info().Uint32("port", port).Str("action", lp.action).Msg("Auto-forward held back by rule")
+}
+
+func labelSuffix(label string) string {
+	if label == "" {
+		return ""
+	}
+	return " (" + label + ")"
+}
+
+// Approve forwards a port held back by a require-approval rule, and again
+// whenever it reopens until it is closed.
+func (af *AutoForwarder) Approve(port uint16) error {
+	af.mu.Lock()
+	defer af.mu.Unlock()
+
+	lp, ok := af.detected[uint32(port)]
+	if !ok || lp.action != protocol.ActionRequireApproval {
+		return fmt.Errorf("port %d is not waiting for approval", port)
+	}
+	af.approved[uint32(port)] = true
+	af.startForward(uint32(port), lp)
+	return nil
+}
+
+// Detected returns the ports held back by rules, by port.
+func (af *AutoForwarder) Detected() []protocol.DetectedPort {
+	af.mu.Lock()
+	defer af.mu.Unlock()
+
+	res := make([]protocol.DetectedPort, 0, len(af.detected))
+	for p, lp := range af.detected {
+		res = append(res, protocol.DetectedPort{Port: uint16(p), Label: lp.label, Action: lp.action})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Port < res[j].Port })
+	return res
+}
+
+// listListeningPorts returns the ports the rules do not ignore, each with
+// its action, the address to reach it on and a label named after the
+// process listening on it, or the container publishing it, unless a rule
+// names it.
+func (af *AutoForwarder) listListeningPorts() (map[uint32]listeningPort, error) {
+	sockets, err := af.source.listening()
 	if err != nil {
 		return nil, err
 	}
+	af.procs.keep(sockets)
 
-	var results []uint32
-	for _, c := range conns {
-		if c.Status != "LISTEN" {
+	var published []containerPort
+	if af.containers != nil {
+		published = af.containers.published()
+	}
+	containerBinds := make(map[uint32][]string, len(published))
+	for _, c := range published {
+		containerBinds[c.port] = append(containerBinds[c.port], c.ip)
+	}
+
+	results := make(map[uint32]listeningPort)
+	seen := make(map[uint32]bool)
+	binds := make(map[uint32][]string)
+	for _, s := range sockets {
+		// The sockets of published ports belong to docker-proxy or the
+		// like, the container decides below.
+		if slices.Contains(containerBinds[s.port], s.ip) {
 			continue
 		}
 
-		port := c.Laddr.Port
-		if port < 1024 {
+		var info procInfo
+		ok := false
+		if s.pid != 0 {
+			info, ok = af.procs.get(s.pid)
+		} else if s.uid >= 0 && s.uid != af.uid {
+			// Without root the processes of other users are hidden, their
+			// sockets come with a uid only.
+			info, ok = af.procs.owner(s.uid), true
+		}
+		if !ok || af.isOwnExe(info.exe) || (containerBinds[s.port] != nil && isContainerProxy(info.name)) {
 			continue
 		}
-
-		if c.Pid == 0 {
+		other := af.isOtherUser(s, info)
+		if other && !af.otherUsers {
 			continue
 		}
 
-		p, err := process.NewProcess(c.Pid)
-		if err != nil {
+		// A port may listen on several addresses, and forked workers share
+		// a socket. The first listener decides.
+		if !slices.Contains(binds[s.port], s.ip) {
+			binds[s.port] = append(binds[s.port], s.ip)
+		}
+		if seen[s.port] {
 			continue
 		}
+		seen[s.port] = true
 
-		cmdline, _ := p.Cmdline()
-		exe, _ := p.Exe()
+		lp, ok := af.classify(protocol.PortListener{
+			Port:    uint16(s.port),
+			Bind:    s.ip,
+			Process: info.name,
+			Exe:     info.exe,
+			Cmdline: info.cmdline,
+			User:    info.user,
+		})
+		if ok {
+			if other {
+				lp.user = userLabel(info)
+			}
+			results[s.port] = lp
+		}
+	}
 
-		if af.shouldExclude(cmdline, exe) {
+	// Containers listed through a socket the agent can open are its own,
+	// even when a rootful engine runs them
+	for _, c := range published {
+		if !slices.Contains(binds[c.port], c.ip) {
+			binds[c.port] = append(binds[c.port], c.ip)
+		}
+		if seen[c.port] {
 			continue
 		}
+		seen[c.port] = true
 
-		results = append(results, port)
+		lp, ok := af.classify(protocol.PortListener{
+			Port:      uint16(c.port),
+			Bind:      c.ip,
+			Container: c.name,
+		})
+		if ok {
+			results[c.port] = lp
+		}
 	}
 
+	for port, lp := range results {
+		lp.host = remoteHost(binds[port])
+		lp.bind = strings.Join(binds[port], ", ")
+		results[port] = lp
+	}
 	return results, nil
 }
 
-func (af *AutoForwarder) shouldExclude(cmdline, exe string) bool {
+// remoteHost picks the address to reach a port listening on binds: localhost
+// when it listens on every address or on both loopbacks, else its loopback
+// address, else its first address, such as a docker bridge.
+func remoteHost(binds []string) string {
+	var loopbacks []string
+	for _, b := range binds {
+		ip := net.ParseIP(b)
+		switch {
+		case ip == nil:
+		case ip.IsUnspecified():
+			return "localhost"
+		case ip.IsLoopback():
+			loopbacks = append(loopbacks, b)
+		}
+	}
+	switch {
+	case len(loopbacks) > 1:
+		return "localhost"
+	case len(loopbacks) == 1:
+		return loopbacks[0]
+	case len(binds) > 0:
+		return binds[0]
+	}
+	return "localhost"
+}
+
+// classify applies the first matching rule to l, or else forwards it unless
+// its port is below 1024 or its command line is excluded.
+func (af *AutoForwarder) classify(l protocol.PortListener) (listeningPort, bool) {
+	name := l.Process
+	if l.Container != "" {
+		name = l.Container
+	}
+
+	if rule := af.rules.Match(l); rule != nil {
+		if rule.Action == protocol.ActionIgnore {
+			return listeningPort{}, false
+		}
+		label := rule.Label
+		if label == "" {
+			label = processLabel(name)
+		}
+		return listeningPort{action: rule.Action, label: label, localPort: rule.LocalPort, silent: rule.Silent}, true
+	}
+
+	if l.Port < 1024 || af.shouldExclude(l.Cmdline) {
+		return listeningPort{}, false
+	}
+	return listeningPort{action: protocol.ActionForward, label: processLabel(name)}, true
+}
+
+// maxProcessLabel leaves room for the "-<port>" suffix the master adds when
+// several ports of a process are forwarded.
+const maxProcessLabel = 32
+
+// processLabel turns a process name into a forward label, see
+// protocol.IsValidName. It returns "" when nothing usable is left.
+func processLabel(name string) string {
+	name = strings.TrimLeftFunc(name, func(c rune) bool {
+		return (c < 'a' || c > 'z') && (c < 'A' || c > 'Z')
+	})
+	label := []rune(name)
+	for i, c := range label {
+		if !protocol.IsValidName("a" + string(c)) {
+			label[i] = '-'
+		}
+	}
+	if len(label) > maxProcessLabel {
+		label = label[:maxProcessLabel]
+	}
+	return strings.TrimRight(string(label), "-")
+}
+
+func (af *AutoForwarder) shouldExclude(cmdline string) bool {
 	lc := strings.ToLower(cmdline)
 	for _, s := range af.excludedSubs {
 		if strings.Contains(lc, s) {
 			return true
 		}
 	}
+	return false
+}
+
+// isOtherUser reports whether the socket or the process listening on it
+// belongs to another user than the agent's.
+func (af *AutoForwarder) isOtherUser(s listenSocket, info procInfo) bool {
+	return (s.uid >= 0 && s.uid != af.uid) || (info.uid >= 0 && info.uid != af.uid)
+}
 
-	exeResolved, _ := filepath.EvalSymlinks(exe)
-	if exeResolved == af.currentExe {
-		return true
+// userLabel names the user of info for the list.
+func userLabel(info procInfo) string {
+	if info.user != "" {
+		return info.user
 	}
+	return fmt.Sprintf("uid %d", info.uid)
+}
 
-	return false
+// isOwnExe reports whether the resolved path exe is mpf itself, which is
+// never forwarded.
+func (af *AutoForwarder) isOwnExe(exe string) bool {
+	return exe != "" && exe == af.currentExe
+}
+
+// detectedPorts returns the ports held back by auto forward rules.
+func (a *Agent) detectedPorts() []protocol.DetectedPort {
+	a.mu.Lock()
+	af := a.autoForwarder
+	a.mu.Unlock()
+	if af == nil {
+		return nil
+	}
+	return af.Detected()
+}
+
+// autoForwardEnabled reports whether the agent auto forwards its ports.
+func (a *Agent) autoForwardEnabled() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.autoForwarder != nil
+}
+
+// setAutoForward starts or stops auto forwarding and tells the master, which
+// reports it in the list and in the Hello of later sessions.
+func (a *Agent) setAutoForward(enabled bool) {
+	a.mu.Lock()
+	if enabled != (a.autoForwarder != nil) {
+		if enabled {
+			a.autoForwarder = NewAutoForwarder(a)
+			a.autoForwarder.Start()
+		} else {
+			a.autoForwarder.StopAndClose()
+			a.autoForwarder = nil
+		}
+		log.Info().Bool("enabled", enabled).Msg("Auto port forwarding switched")
+	}
+	a.mu.Unlock()
+
+	if s := a.getBestSession(); s != nil {
+		_ = s.Send(protocol.AutoForwardState{Enabled: enabled})
+	}
 }
@@ -0,0 +1,195 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/liyu1981/moshpf/pkg/config"
+	"github.com/liyu1981/moshpf/pkg/protocol"
+	"github.com/liyu1981/moshpf/pkg/tunnel"
+)
+
+func TestProcessLabel(t *testing.T) {
+	tests := map[string]string{
+		"postgres":                              "postgres",
+		"node":                                  "node",
+		"python3.11":                            "python3.11",
+		"[kworker/0:1]":                         "kworker-0-1",
+		"0day server":                           "day-server",
+		"123":                                   "",
+		"":                                      "",
+		"a-very-long-process-name-that-goes-on": "a-very-long-process-name-that-go",
+	}
+	for name, want := range tests {
+		if got := processLabel(name); got != want {
+			t.Errorf("processLabel(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	a := &Agent{settings: config.Default()}
+	a.settings.Rules = []protocol.AutoForwardRule{
+		{Ports: "80", Action: protocol.ActionForward, LocalPort: 8080},
+		{Process: "^node$", Action: protocol.ActionRequireApproval, Label: "web"},
+		{Ports: "5432", Action: protocol.ActionIgnore},
+		{Ports: "6006", Action: protocol.ActionForward, Silent: true},
+	}
+	af := NewAutoForwarder(a)
+
+	tests := []struct {
+		l    protocol.PortListener
+		want listeningPort
+		ok   bool
+	}{
+		{protocol.PortListener{Port: 80, Process: "nginx"}, listeningPort{action: protocol.ActionForward, label: "nginx", localPort: 8080}, true},
+		{protocol.PortListener{Port: 3000, Process: "node"}, listeningPort{action: protocol.ActionRequireApproval, label: "web"}, true},
+		{protocol.PortListener{Port: 5432, Process: "postgres"}, listeningPort{}, false},
+		{protocol.PortListener{Port: 8000, Process: "python3"}, listeningPort{action: protocol.ActionForward, label: "python3"}, true},
+		{protocol.PortListener{Port: 443, Process: "caddy"}, listeningPort{}, false},
+		{protocol.PortListener{Port: 6006, Process: "tensorboard"}, listeningPort{action: protocol.ActionForward, label: "tensorboard", silent: true}, true},
+		{protocol.PortListener{Port: 9000, Process: "code", Cmdline: "/opt/vscode/code --port 9000"}, listeningPort{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := af.classify(tt.l)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("classify(%+v) = %+v, %v, want %+v, %v", tt.l, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestDetectAndApprove(t *testing.T) {
+	a := &Agent{settings: config.Default(), events: newEventHub(), sessions: tunnel.NewSessionManager()}
+	af := NewAutoForwarder(a)
+	events := a.events.subscribe()
+
+	af.mu.Lock()
+	af.detect(3000, listeningPort{action: protocol.ActionRequireApproval, label: "web"})
+	af.detect(3000, listeningPort{action: protocol.ActionRequireApproval, label: "web"})
+	af.detect(4000, listeningPort{action: protocol.ActionNotifyOnly})
+	af.mu.Unlock()
+
+	ev := <-events
+	if ev.Type != protocol.EventApprovalRequired || ev.Detected == nil || ev.Detected.Port != 3000 {
+		t.Errorf("Unexpected event: %+v", ev)
+	}
+	if ev = <-events; ev.Type != protocol.EventPortDetected {
+		t.Errorf("Expected a single approval event, then port_detected: %+v", ev)
+	}
+
+	want := []protocol.DetectedPort{
+		{Port: 3000, Label: "web", Action: protocol.ActionRequireApproval},
+		{Port: 4000, Action: protocol.ActionNotifyOnly},
+	}
+	if got := af.Detected(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Detected() = %+v, want %+v", got, want)
+	}
+
+	if err := af.Approve(4000); err == nil {
+		t.Errorf("Expected a notify-only port not to be approvable")
+	}
+	if err := af.Approve(3000); err != nil {
+		t.Fatalf("Approve failed: %v", err)
+	}
+	// Without a session the forward starts on the next scan
+	if !af.approved[3000] {
+		t.Errorf("Expected port 3000 to be approved")
+	}
+}
+
+// fakeSource serves fixed sockets to the auto forwarder.
+type fakeSource []listenSocket
+
+func (s fakeSource) listening() ([]listenSocket, error) { return s, nil }
+func (s fakeSource) interval() time.Duration            { return time.Second }
+
+func TestListListeningPortsOtherUsers(t *testing.T) {
+	a := &Agent{settings: config.Default()}
+	af := NewAutoForwarder(a)
+	af.uid = 1000
+	af.containers = nil
+	af.source = fakeSource{
+		{port: 3000, ip: "127.0.0.1", pid: 10, uid: 1000},
+		{port: 8888, ip: "0.0.0.0", pid: 11, uid: 1001},
+		{port: 5432, ip: "0.0.0.0", pid: 12, uid: -1},
+	}
+	af.procs.procs = map[int32]procInfo{
+		10: {name: "node", uid: 1000},
+		11: {name: "jupyter", user: "alice", uid: 1001},
+		12: {name: "postgres", user: "postgres", uid: 999},
+	}
+
+	ports, err := af.listListeningPorts()
+	if err != nil {
+		t.Fatalf("listListeningPorts failed: %v", err)
+	}
+	want := map[uint32]listeningPort{
+		3000: {action: protocol.ActionForward, label: "node", host: "127.0.0.1", bind: "127.0.0.1"},
+	}
+	if !reflect.DeepEqual(ports, want) {
+		t.Errorf("listListeningPorts() = %+v, want %+v", ports, want)
+	}
+
+	af.otherUsers = true
+	ports, _ = af.listListeningPorts()
+	want[8888] = listeningPort{action: protocol.ActionForward, label: "jupyter", user: "alice", host: "localhost", bind: "0.0.0.0"}
+	want[5432] = listeningPort{action: protocol.ActionForward, label: "postgres", user: "postgres", host: "localhost", bind: "0.0.0.0"}
+	if !reflect.DeepEqual(ports, want) {
+		t.Errorf("listListeningPorts() with other users = %+v, want %+v", ports, want)
+	}
+}
+
+func TestListListeningPortsBinds(t *testing.T) {
+	a := &Agent{settings: config.Default()}
+	af := NewAutoForwarder(a)
+	af.uid = 1000
+	af.containers = nil
+	af.source = fakeSource{
+		{port: 3000, ip: "127.0.0.1", pid: 10, uid: 1000},
+		{port: 3000, ip: "::1", pid: 10, uid: 1000},
+		{port: 8080, ip: "172.17.0.1", pid: 11, uid: 1000},
+		{port: 8080, ip: "172.17.0.1", pid: 12, uid: 1000},
+		{port: 9000, ip: "10.0.0.5", pid: 13, uid: 1000},
+		{port: 9000, ip: "127.0.0.1", pid: 13, uid: 1000},
+	}
+	af.procs.procs = map[int32]procInfo{
+		10: {name: "node", uid: 1000},
+		11: {name: "gunicorn", uid: 1000},
+		12: {name: "gunicorn", uid: 1000},
+		13: {name: "api", uid: 1000},
+	}
+
+	ports, err := af.listListeningPorts()
+	if err != nil {
+		t.Fatalf("listListeningPorts failed: %v", err)
+	}
+	want := map[uint32]listeningPort{
+		3000: {action: protocol.ActionForward, label: "node", host: "localhost", bind: "127.0.0.1, ::1"},
+		8080: {action: protocol.ActionForward, label: "gunicorn", host: "172.17.0.1", bind: "172.17.0.1"},
+		9000: {action: protocol.ActionForward, label: "api", host: "127.0.0.1", bind: "10.0.0.5, 127.0.0.1"},
+	}
+	if !reflect.DeepEqual(ports, want) {
+		t.Errorf("listListeningPorts() = %+v, want %+v", ports, want)
+	}
+}
+
+func TestRemoteHost(t *testing.T) {
+	tests := []struct {
+		binds []string
+		want  string
+	}{
+		{nil, "localhost"},
+		{[]string{"0.0.0.0"}, "localhost"},
+		{[]string{"127.0.0.1", "::"}, "localhost"},
+		{[]string{"127.0.0.1", "::1"}, "localhost"},
+		{[]string{"::1"}, "::1"},
+		{[]string{"192.168.1.10", "127.0.0.1"}, "127.0.0.1"},
+		{[]string{"172.17.0.1"}, "172.17.0.1"},
+	}
+	for _, tt := range tests {
+		if got := remoteHost(tt.binds); got != tt.want {
+			t.Errorf("remoteHost(%v) = %q, want %q", tt.binds, got, tt.want)
+		}
+	}
+}
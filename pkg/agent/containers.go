@@ -0,0 +1,184 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/liyu1981/moshpf/pkg/constant"
+	"github.com/rs/zerolog/log"
+)
+
+// composeServiceLabel names the service of a docker compose container.
+const composeServiceLabel = "com.docker.compose.service"
+
+// containerPort is a TCP port a container publishes on the host.
+type containerPort struct {
+	port uint32
+	ip   string
+	name string
+}
+
+// containerSource lists the ports published by Docker and Podman containers
+// through their API sockets. A published port is often no socket of a
+// process the agent can use: docker-proxy is excluded and sockets inside a
+// container's network namespace are not seen at all. The API is asked at
+// the scan interval, not on every read of /proc/net/tcp.
+type containerSource struct {
+	every time.Duration
+	// sockets finds the API sockets, see containerSockets.
+	sockets func() []string
+	last    time.Time
+	// ports holds the last answer of each socket, kept when a request fails.
+	ports map[string][]containerPort
+}
+
+func newContainerSource(every time.Duration) *containerSource {
+	return &containerSource{
+		every:   every,
+		sockets: containerSockets,
+		ports:   make(map[string][]containerPort),
+	}
+}
+
+// published returns the ports published by the containers of every API
+// socket found.
+func (c *containerSource) published() []containerPort {
+	if time.Since(c.last) >= c.every {
+		c.last = time.Now()
+		found := make(map[string]bool)
+		for _, sock := range c.sockets() {
+			found[sock] = true
+			ports, err := listContainerPorts(sock)
+			if err != nil {
+				log.Debug().Err(err).Str("socket", sock).Msg("Failed to list container ports")
+				continue
+			}
+			c.ports[sock] = ports
+		}
+		for sock := range c.ports {
+			if !found[sock] {
+				delete(c.ports, sock)
+			}
+		}
+	}
+
+	var res []containerPort
+	for _, ports := range c.ports {
+		res = append(res, ports...)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].port != res[j].port {
+			return res[i].port < res[j].port
+		}
+		return res[i].ip < res[j].ip
+	})
+	return res
+}
+
+// containerSockets returns the Docker and Podman API sockets present on the
+// host, the rootless ones of the agent's user first.
+func containerSockets() []string {
+	var candidates []string
+	for _, env := range []string{"DOCKER_HOST", "CONTAINER_HOST"} {
+		if p, found := strings.CutPrefix(os.Getenv(env), "unix://"); found {
+			candidates = append(candidates, p)
+		}
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		candidates = append(candidates, filepath.Join(dir, "docker.sock"), filepath.Join(dir, "podman", "podman.sock"))
+	}
+	candidates = append(candidates, constant.ContainerAPISockets...)
+
+	var res []string
+	seen := make(map[string]bool)
+	for _, p := range candidates {
+		if real, err := filepath.EvalSymlinks(p); err == nil {
+			p = real
+		}
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		if fi, err := os.Stat(p); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// isContainerProxy reports whether the process name is one that passes
+// published ports on to containers.
+func isContainerProxy(name string) bool {
+	return slices.Contains(constant.ContainerProxies, name)
+}
+
+// apiContainer is the part of a /containers/json entry the agent uses. The
+// Docker compatible API of Podman answers the same.
+type apiContainer struct {
+	Names  []string
+	Labels map[string]string
+	Ports  []struct {
+		IP          string
+		PrivatePort uint16
+		PublicPort  uint16
+		Type        string
+	}
+}
+
+// listContainerPorts asks the API on sock for the running containers and
+// returns their published TCP ports, named after the compose service or else
+// the container.
+func listContainerPorts(sock string) ([]containerPort, error) {
+	client := &http.Client{
+		Timeout: constant.ContainerAPITimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sock)
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get("http://localhost/containers/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("container API returned %s", resp.Status)
+	}
+
+	var containers []apiContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, fmt.Errorf("invalid container list: %v", err)
+	}
+
+	var res []containerPort
+	for _, ct := range containers {
+		name := ct.Labels[composeServiceLabel]
+		if name == "" && len(ct.Names) > 0 {
+			name = strings.TrimPrefix(ct.Names[0], "/")
+		}
+		for _, p := range ct.Ports {
+			if p.PublicPort == 0 || (p.Type != "" && p.Type != "tcp") {
+				continue
+			}
+			ip := p.IP
+			if ip == "" {
+				ip = "0.0.0.0"
+			}
+			res = append(res, containerPort{port: uint32(p.PublicPort), ip: ip, name: name})
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,171 @@
+package agent
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/liyu1981/moshpf/pkg/config"
+	"github.com/liyu1981/moshpf/pkg/protocol"
+)
+
+const containersJSON = `[
+  {"Names": ["/shop-web-1"], "Labels": {"com.docker.compose.service": "web"},
+   "Ports": [{"IP": "0.0.0.0", "PrivatePort": 80, "PublicPort": 8080, "Type": "tcp"},
+             {"IP": "::", "PrivatePort": 80, "PublicPort": 8080, "Type": "tcp"}]},
+  {"Names": ["/pg"], "Labels": {},
+   "Ports": [{"IP": "127.0.0.1", "PrivatePort": 5432, "PublicPort": 15432, "Type": "tcp"},
+             {"PrivatePort": 6000, "Type": "tcp"}]},
+  {"Names": ["/dns"],
+   "Ports": [{"IP": "0.0.0.0", "PrivatePort": 53, "PublicPort": 5353, "Type": "udp"}]}
+]`
+
+// serveContainerAPI answers /containers/json with body on a unix socket,
+// standing in for Docker or Podman.
+func serveContainerAPI(t *testing.T, body string) string {
+	t.Helper()
+	sock := filepath.Join(t.TempDir(), "docker.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/containers/json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	srv.Listener = ln
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return sock
+}
+
+func TestListContainerPorts(t *testing.T) {
+	sock := serveContainerAPI(t, containersJSON)
+
+	got, err := listContainerPorts(sock)
+	if err != nil {
+		t.Fatalf("listContainerPorts failed: %v", err)
+	}
+	want := []containerPort{
+		{port: 8080, ip: "0.0.0.0", name: "web"},
+		{port: 8080, ip: "::", name: "web"},
+		{port: 15432, ip: "127.0.0.1", name: "pg"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listContainerPorts() = %+v, want %+v", got, want)
+	}
+
+	if _, err := listContainerPorts(filepath.Join(t.TempDir(), "missing.sock")); err == nil {
+		t.Errorf("Expected a missing socket to fail")
+	}
+}
+
+func TestContainerSockets(t *testing.T) {
+	sock := serveContainerAPI(t, "[]")
+	t.Setenv("DOCKER_HOST", "unix://"+sock)
+	t.Setenv("XDG_RUNTIME_DIR", filepath.Dir(sock))
+
+	socks := containerSockets()
+	if len(socks) == 0 || socks[0] != sock {
+		t.Fatalf("Expected %s first, got %v", sock, socks)
+	}
+	for _, s := range socks[1:] {
+		if s == sock {
+			t.Errorf("Expected %s once, got %v", sock, socks)
+		}
+	}
+
+	t.Setenv("DOCKER_HOST", "tcp://10.0.0.1:2375")
+	if err := os.Remove(sock); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range containerSockets() {
+		if s == sock {
+			t.Errorf("Expected the removed socket to be gone, got %v", s)
+		}
+	}
+}
+
+func TestListListeningPortsContainers(t *testing.T) {
+	sock := serveContainerAPI(t, containersJSON)
+	uid := int64(os.Getuid())
+
+	a := &Agent{settings: config.Default()}
+	a.settings.Rules = []protocol.AutoForwardRule{{Container: "^pg$", Action: protocol.ActionNotifyOnly}}
+	af := NewAutoForwarder(a)
+	af.uid = uid
+	af.containers.sockets = func() []string { return []string{sock} }
+	af.source = fakeSource{
+		{port: 8080, ip: "0.0.0.0", pid: 20, uid: 0},
+		{port: 8080, ip: "127.0.0.2", pid: 21, uid: uid},
+		{port: 3000, ip: "127.0.0.1", pid: 10, uid: uid},
+		// A host process on another address of a published port
+		{port: 15432, ip: "192.168.1.5", pid: 11, uid: uid},
+	}
+	af.procs.procs = map[int32]procInfo{
+		10: {name: "node", uid: uid},
+		11: {name: "postgres", uid: uid},
+		20: {name: "docker-proxy", cmdline: "/usr/bin/docker-proxy -host-port 8080", uid: 0},
+		21: {name: "rootlessport", uid: uid},
+	}
+
+	ports, err := af.listListeningPorts()
+	if err != nil {
+		t.Fatalf("listListeningPorts failed: %v", err)
+	}
+	want := map[uint32]listeningPort{
+		3000:  {action: protocol.ActionForward, label: "node", host: "127.0.0.1", bind: "127.0.0.1"},
+		8080:  {action: protocol.ActionForward, label: "web", host: "localhost", bind: "0.0.0.0, ::"},
+		15432: {action: protocol.ActionForward, label: "postgres", host: "127.0.0.1", bind: "192.168.1.5, 127.0.0.1"},
+	}
+	if !reflect.DeepEqual(ports, want) {
+		t.Errorf("listListeningPorts() = %+v, want %+v", ports, want)
+	}
+
+	// The last answer stands until the scan interval passed
+	af.containers.sockets = func() []string { return nil }
+	if ports, _ := af.listListeningPorts(); len(ports) != 3 {
+		t.Errorf("Expected the cached container ports, got %+v", ports)
+	}
+	af.containers.last = time.Time{}
+	ports, _ = af.listListeningPorts()
+	if _, ok := ports[8080]; ok || len(ports) != 2 {
+		t.Errorf("Expected no container ports once the socket is gone, got %+v", ports)
+	}
+}
+
+func TestListListeningPortsRootfulContainers(t *testing.T) {
+	sock := serveContainerAPI(t, containersJSON)
+	// Stands in for /var/run/docker.sock, which root owns
+	if os.Getuid() != 0 {
+		_ = os.Chown(sock, 0, 0)
+	}
+	owner := int64(os.Getuid())
+
+	a := &Agent{settings: config.Default()}
+	af := NewAutoForwarder(a)
+	af.uid = owner + 1000
+	af.containers.sockets = func() []string { return []string{sock} }
+	af.source = fakeSource{}
+
+	ports, err := af.listListeningPorts()
+	if err != nil {
+		t.Fatalf("listListeningPorts failed: %v", err)
+	}
+	want := map[uint32]listeningPort{
+		8080:  {action: protocol.ActionForward, label: "web", host: "localhost", bind: "0.0.0.0, ::"},
+		15432: {action: protocol.ActionForward, label: "pg", host: "127.0.0.1", bind: "127.0.0.1"},
+	}
+	if !reflect.DeepEqual(ports, want) {
+		t.Errorf("listListeningPorts() = %+v, want %+v", ports, want)
+	}
+}
@@ -0,0 +1,337 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/liyu1981/moshpf/pkg/constant"
+	"github.com/liyu1981/moshpf/pkg/protocol"
+	"github.com/liyu1981/moshpf/pkg/tunnel"
+	"github.com/rs/zerolog/log"
+)
+
+// handleControl runs one CLI request and returns the response to send back.
+func (a *Agent) handleControl(req protocol.ControlRequest) protocol.ControlResponse {
+	if req.Version != protocol.ControlVersion {
+		return protocol.NewControlError(protocol.CodeUnsupportedVersion,
+			"unsupported control protocol version %d, agent speaks %d", req.Version, protocol.ControlVersion)
+	}
+
+	switch req.Command {
+	case protocol.CommandSessions:
+		return protocol.ControlResponse{Success: true, Sessions: a.sessions.Count()}
+	case protocol.CommandStop:
+		return protocol.ControlResponse{Success: true, Message: "Stopping agent..."}
+	case protocol.CommandList:
+		return a.controlList()
+	case protocol.CommandStatus:
+		return a.controlStatus()
+	case protocol.CommandForward:
+		return a.controlForward(req.Args)
+	case protocol.CommandReverse:
+		return a.controlReverse(req.Args)
+	case protocol.CommandClose:
+		if len(req.Args) > 0 && (req.Args[0] == "--reverse" || req.Args[0] == "-R") {
+			return a.controlCloseReverse(req.Args[1:])
+		}
+		return a.controlClose(req.Args)
+	case protocol.CommandPin:
+		return a.controlPin(req.Args)
+	case protocol.CommandAutoForward:
+		enabled, err := protocol.ParseSwitchArg(req.Args)
+		if err != nil {
+			return protocol.NewControlError(protocol.CodeInvalidArgument, "auto: %v", err)
+		}
+		a.setAutoForward(enabled)
+		return protocol.NewSwitchResponse("Auto forwarding", enabled)
+	case protocol.CommandLocalOnly:
+		return a.controlLocalOnly(req.Args)
+	case protocol.CommandApprove:
+		return a.controlApprove(req.Args)
+	default:
+		return protocol.NewControlError(protocol.CodeUnknownCommand, "unknown command: %s", req.Command)
+	}
+}
+
+func errNoSession() protocol.ControlResponse {
+	return protocol.NewControlError(protocol.CodeNoSession, "No active session")
+}
+
+// status describes the agent without asking the master.
+func (a *Agent) status() *protocol.AgentStatus {
+	st := &protocol.AgentStatus{
+		Version:  constant.Version,
+		PID:      os.Getpid(),
+		Sessions: a.sessions.Count(),
+		SlaveIPs: protocol.GetLocalIPs(),
+	}
+	if s := a.getBestSession(); s != nil {
+		st.Transport = s.Mux.Type()
+	}
+	return st
+}
+
+// requestList asks the master for its forwards. On failure the returned
+// response carries the error for the CLI.
+func (a *Agent) requestList() (protocol.ListResponse, *protocol.ControlResponse) {
+	s := a.getBestSession()
+	if s == nil {
+		resp := errNoSession()
+		return protocol.ListResponse{}, &resp
+	}
+
+	if err := s.Send(protocol.ListRequest{}); err != nil {
+		log.Error().Err(err).Msg("Failed to send ListRequest")
+		resp := protocol.NewControlError(protocol.CodeSendFailed, "Failed to send ListRequest")
+		return protocol.ListResponse{}, &resp
+	}
+
+	select {
+	case list := <-a.listChan:
+		return list, nil
+	case <-time.After(5 * time.Second):
+		resp := protocol.NewControlError(protocol.CodeTimeout, "Timeout waiting for list response")
+		return protocol.ListResponse{}, &resp
+	}
+}
+
+// roundTrip sends the request newReq builds for a new ID and waits up to
+// timeout for the answer carrying that ID. what names the request in errors.
+func (a *Agent) roundTrip(s *tunnel.Session, what string, timeout time.Duration, newReq func(id uint64) protocol.Message) (protocol.Message, *protocol.ControlResponse) {
+	id, ch := a.replies.wait()
+	defer a.replies.done(id)
+
+	if err := s.Send(newReq(id)); err != nil {
+		log.Error().Err(err).Msgf("Failed to send %s request", what)
+		resp := protocol.NewControlError(protocol.CodeSendFailed, "Failed to send %s request", what)
+		return nil, &resp
+	}
+
+	select {
+	case msg := <-ch:
+		return msg, nil
+	case <-time.After(timeout):
+		resp := protocol.NewControlError(protocol.CodeTimeout, "Timeout waiting for %s response", what)
+		return nil, &resp
+	}
+}
+
+func (a *Agent) controlList() protocol.ControlResponse {
+	list, errResp := a.requestList()
+	if errResp != nil {
+		return *errResp
+	}
+
+	// The agent knows best whether it auto forwards
+	list.AutoForward = a.autoForwardEnabled()
+	list.Detected = a.detectedPorts()
+
+	st := a.status()
+	st.MasterIPs = masterIPs(list)
+	st.Forwards = len(list.Entries)
+	return protocol.ControlResponse{Success: true, List: &list, Status: st}
+}
+
+// controlStatus reports the agent even without a session; the master side
+// is filled in when one is up.
+func (a *Agent) controlStatus() protocol.ControlResponse {
+	st := a.status()
+	if st.Sessions > 0 {
+		if list, errResp := a.requestList(); errResp == nil {
+			st.MasterIPs = masterIPs(list)
+			st.Forwards = len(list.Entries)
+		}
+	}
+	return protocol.ControlResponse{Success: true, Status: st}
+}
+
+func masterIPs(list protocol.ListResponse) []string {
+	if len(list.MasterIPs) > 0 {
+		return list.MasterIPs
+	}
+	if list.MasterIP != "" {
+		return []string{list.MasterIP}
+	}
+	return nil
+}
+
+func (a *Agent) controlReverse(args []string) protocol.ControlResponse {
+	if len(args) != 1 {
+		return protocol.NewControlError(protocol.CodeInvalidArgument, "reverse takes a single <masterPort>[:<remotePort>]")
+	}
+
+	var masterPort, slavePort uint16
+	if strings.Contains(args[0], ":") {
+		parts := strings.Split(args[0], ":")
+		m_port, _ := strconv.ParseUint(parts[0], 10, 16)
+		s_port, _ := strconv.ParseUint(parts[1], 10, 16)
+		masterPort = uint16(m_port)
+		slavePort = uint16(s_port)
+	} else {
+		p, _ := strconv.ParseUint(args[0], 10, 16)
+		masterPort = uint16(p)
+		slavePort = uint16(p)
+	}
+
+	if slavePort == 0 || masterPort == 0 {
+		return protocol.NewControlError(protocol.CodeInvalidArgument, "Invalid port mapping")
+	}
+
+	s := a.getBestSession()
+	if s == nil {
+		return errNoSession()
+	}
+
+	log.Info().Uint16("master", masterPort).Uint16("slave", slavePort).Msg("Requesting reverse forward from daemon")
+	msg, errResp := a.roundTrip(s, "reverse", 10*time.Second, func(id uint64) protocol.Message {
+		return protocol.ReverseRequest{ID: id, MasterPort: masterPort, RemotePort: slavePort}
+	})
+	if errResp != nil {
+		return *errResp
+	}
+	resp := msg.(protocol.ReverseResponse)
+	if !resp.Success {
+		return protocol.NewControlError(protocol.CodeRejected, "Failed to start reverse forwarding: %s", resp.Reason)
+	}
+	return protocol.ControlResponse{
+		Success: true,
+		Message: fmt.Sprintf("Reverse forwarding started: slave %d -> master %d", slavePort, masterPort),
+	}
+}
+
+func (a *Agent) controlCloseReverse(args []string) protocol.ControlResponse {
+	if len(args) != 1 {
+		return protocol.NewControlError(protocol.CodeInvalidArgument, "close --reverse takes a single port")
+	}
+	port, err := strconv.ParseUint(args[0], 10, 16)
+	if err != nil {
+		return protocol.NewControlError(protocol.CodeInvalidArgument, "Invalid port")
+	}
+
+	s := a.getBestSession()
+	if s == nil {
+		return errNoSession()
+	}
+
+	msg, errResp := a.roundTrip(s, "close", 5*time.Second, func(id uint64) protocol.Message {
+		return protocol.CloseRequest{ID: id, Port: uint16(port), Reverse: true}
+	})
+	if errResp != nil {
+		return *errResp
+	}
+	resp := msg.(protocol.CloseResponse)
+	if !resp.Success {
+		return protocol.NewControlError(protocol.CodeRejected, "Failed to close reverse port %d: %s", resp.Port, resp.Reason)
+	}
+	return protocol.ControlResponse{
+		Success: true,
+		Message: fmt.Sprintf("Closed reverse port %d", resp.Port),
+	}
+}
+
+func (a *Agent) controlClose(args []string) protocol.ControlResponse {
+	reqs, err := protocol.ParseCloseArgs(args)
+	if err != nil {
+		return protocol.NewControlError(protocol.CodeInvalidArgument, "%v", err)
+	}
+
+	s := a.getBestSession()
+	if s == nil {
+		return errNoSession()
+	}
+
+	msg, errResp := a.roundTrip(s, "close", 5*time.Second, func(id uint64) protocol.Message {
+		return protocol.CloseBatchRequest{ID: id, Requests: reqs}
+	})
+	if errResp != nil {
+		return *errResp
+	}
+	return protocol.NewCloseResponse(reqs, msg.(protocol.CloseBatchResponse).Responses)
+}
+
+func (a *Agent) controlForward(args []string) protocol.ControlResponse {
+	reqs, err := protocol.ParseForwardArgs(args)
+	if err != nil {
+		return protocol.NewControlError(protocol.CodeInvalidArgument, "%v", err)
+	}
+
+	s := a.getBestSession()
+	if s == nil {
+		return errNoSession()
+	}
+
+	log.Info().Int("count", len(reqs)).Msg("Requesting listen from daemon")
+	msg, errResp := a.roundTrip(s, "listen", 10*time.Second, func(id uint64) protocol.Message {
+		return protocol.ListenBatchRequest{ID: id, Requests: reqs}
+	})
+	if errResp != nil {
+		return *errResp
+	}
+	return protocol.NewForwardResponse(reqs, msg.(protocol.ListenBatchResponse).Responses)
+}
+
+func (a *Agent) controlPin(args []string) protocol.ControlResponse {
+	if len(args) != 1 {
+		return protocol.NewControlError(protocol.CodeInvalidArgument, "pin takes a single port")
+	}
+	port, err := strconv.ParseUint(args[0], 10, 16)
+	if err != nil || port == 0 {
+		return protocol.NewControlError(protocol.CodeInvalidArgument, "Invalid port")
+	}
+
+	s := a.getBestSession()
+	if s == nil {
+		return errNoSession()
+	}
+
+	msg, errResp := a.roundTrip(s, "pin", 5*time.Second, func(id uint64) protocol.Message {
+		return protocol.PinRequest{ID: id, Port: uint16(port)}
+	})
+	if errResp != nil {
+		return *errResp
+	}
+	return protocol.NewPinResponse(msg.(protocol.PinResponse))
+}
+
+func (a *Agent) controlApprove(args []string) protocol.ControlResponse {
+	if len(args) != 1 {
+		return protocol.NewControlError(protocol.CodeInvalidArgument, "approve takes a single port")
+	}
+	port, err := strconv.ParseUint(args[0], 10, 16)
+	if err != nil || port == 0 {
+		return protocol.NewControlError(protocol.CodeInvalidArgument, "Invalid port")
+	}
+
+	a.mu.Lock()
+	af := a.autoForwarder
+	a.mu.Unlock()
+	if af == nil {
+		return protocol.NewControlError(protocol.CodeRejected, "Auto forwarding is off")
+	}
+	if err := af.Approve(uint16(port)); err != nil {
+		return protocol.NewControlError(protocol.CodeRejected, "Failed to approve port %d: %v", port, err)
+	}
+	return protocol.ControlResponse{Success: true, Message: fmt.Sprintf("Approved port %d", port)}
+}
+
+// controlLocalOnly asks the master to switch its bind address. The master
+// does not answer; the list shows the outcome.
+func (a *Agent) controlLocalOnly(args []string) protocol.ControlResponse {
+	enabled, err := protocol.ParseSwitchArg(args)
+	if err != nil {
+		return protocol.NewControlError(protocol.CodeInvalidArgument, "local-only: %v", err)
+	}
+
+	s := a.getBestSession()
+	if s == nil {
+		return errNoSession()
+	}
+
+	if err := s.Send(protocol.LocalOnlyRequest{Enabled: enabled}); err != nil {
+		return protocol.NewControlError(protocol.CodeSendFailed, "Failed to send LocalOnlyRequest")
+	}
+	return protocol.NewSwitchResponse("Local-only binding", enabled)
+}
@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"net"
+	"sync"
+
+	"github.com/liyu1981/moshpf/pkg/protocol"
+	"github.com/rs/zerolog/log"
+)
+
+// eventBuffer is how many events a slow `mpf watch` client may lag behind
+// before events are dropped for it.
+const eventBuffer = 64
+
+// eventHub fans events out to the unix socket clients running `mpf watch`.
+// A nil *eventHub drops everything.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan protocol.Event]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan protocol.Event]struct{})}
+}
+
+func (h *eventHub) subscribe() chan protocol.Event {
+	ch := make(chan protocol.Event, eventBuffer)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan protocol.Event) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+func (h *eventHub) publish(ev protocol.Event) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+			log.Warn().Str("type", ev.Type).Msg("Event dropped - watcher too slow")
+		}
+	}
+}
+
+// serveWatch streams events to conn until the client goes away.
+func (a *Agent) serveWatch(conn net.Conn) {
+	ch := a.events.subscribe()
+	defer a.events.unsubscribe(ch)
+
+	// The client sends nothing more; a read returning means it hung up.
+	gone := make(chan struct{})
+	go func() {
+		buf := make([]byte, 1)
+		_, _ = conn.Read(buf)
+		close(gone)
+	}()
+
+	for {
+		select {
+		case ev := <-ch:
+			if err := protocol.WriteEvent(conn, ev); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/liyu1981/moshpf/pkg/protocol"
+)
+
+// FormatList renders the response to protocol.CommandList the way `mpf list`
+// prints it: a session line with the master and slave addresses, then one
+// entry per forward.
+func FormatList(list *protocol.ListResponse, status *protocol.AgentStatus, now time.Time) string {
+	slave := ""
+	if status != nil {
+		slave = strings.Join(status.SlaveIPs, ", ")
+		if slave == "" {
+			slave = status.Target
+		}
+	}
+	res := fmt.Sprintf("Session: %s -> %s\n", strings.Join(masterIPs(*list), ", "), slave)
+	for _, e := range list.Entries {
+		res += formatEntry(e, list.MasterIP, now)
+	}
+	for _, d := range list.Detected {
+		res += formatDetected(d)
+	}
+	return strings.TrimSuffix(res, "\n")
+}
+
+// formatDetected renders a port held back by an auto forward rule.
+func formatDetected(d protocol.DetectedPort) string {
+	line := fmt.Sprintf("  %d/tcp (not forwarded) DETECTED\n", d.Port)
+	if d.Action == protocol.ActionRequireApproval {
+		line = fmt.Sprintf("  %d/tcp (not forwarded) AWAITING APPROVAL, run mpf approve %d\n", d.Port, d.Port)
+	}
+	if d.Label != "" {
+		line = "  " + d.Label + ": " + strings.TrimPrefix(line, "  ")
+	}
+	return line
+}
+
+// FormatStatus renders the response to protocol.CommandStatus for `mpf status`.
+func FormatStatus(st *protocol.AgentStatus) string {
+	sessions := strconv.Itoa(st.Sessions)
+	if st.Transport != "" {
+		sessions += " (" + st.Transport + ")"
+	}
+	role := "Agent:"
+	if st.Target != "" {
+		role = "Master:"
+	}
+	res := fmt.Sprintf("%-11s mpf %s (pid %d)\n", role, st.Version, st.PID)
+	if st.Target != "" {
+		res += fmt.Sprintf("Target:     %s\n", st.Target)
+	}
+	res += fmt.Sprintf("Sessions:   %s\n", sessions)
+	if len(st.SlaveIPs) > 0 {
+		res += fmt.Sprintf("Slave IPs:  %s\n", strings.Join(st.SlaveIPs, ", "))
+	}
+	if st.Sessions > 0 || st.Target != "" {
+		res += fmt.Sprintf("Master IPs: %s\n", strings.Join(st.MasterIPs, ", "))
+		res += fmt.Sprintf("Forwards:   %d\n", st.Forwards)
+	}
+	return strings.TrimSuffix(res, "\n")
+}
+
+// FormatMaster renders one master process in the `mpf status` overview of
+// the machine running `mpf mosh`: a line describing the session, then its
+// forwards as in `mpf list`.
+func FormatMaster(st *protocol.AgentStatus, list *protocol.ListResponse, now time.Time) string {
+	sessions := "no session"
+	if st.Sessions > 0 {
+		sessions = fmt.Sprintf("%d session(s) over %s", st.Sessions, st.Transport)
+	}
+	res := fmt.Sprintf("%s (pid %d): %s, %d forward(s)\n", st.Target, st.PID, sessions, len(list.Entries))
+	for _, e := range list.Entries {
+		res += formatEntry(e, list.MasterIP, now)
+	}
+	return strings.TrimSuffix(res, "\n")
+}
+
+// formatEntry renders one forward of `mpf list`: the forward itself, then an
+// indented line with its connection and traffic counters.
+func formatEntry(e protocol.ForwardEntry, masterIP string, now time.Time) string {
+	status := "OK"
+	if e.Error != "" {
+		status = "ERROR: " + e.Error
+	}
+
+	localAddr := e.LocalAddr
+	if strings.HasPrefix(localAddr, ":") {
+		localAddr = masterIP + localAddr
+	}
+
+	autoStr := "MANUAL"
+	if e.IsAuto {
+		autoStr = "AUTO"
+	}
+	if e.RemappedFrom != 0 {
+		autoStr += fmt.Sprintf(" (remapped, %d was busy)", e.RemappedFrom)
+	}
+	if e.User != "" {
+		autoStr += fmt.Sprintf(" (user %s)", e.User)
+	}
+	if e.Service != "" {
+		autoStr += " " + e.Service
+		if e.Title != "" {
+			autoStr += fmt.Sprintf(" %q", e.Title)
+		}
+	}
+
+	proto := e.Protocol
+	if proto == "" {
+		proto = protocol.ProtocolTCP
+	}
+
+	var line string
+	switch {
+	case e.Dynamic:
+		line = fmt.Sprintf("  * -> %s [%s] (%s) DYNAMIC\n", localAddr, e.Transport, status)
+	case e.Reverse:
+		line = fmt.Sprintf("  %d/%s <- %s [%s] (%s) REVERSE\n", e.RemotePort, proto, localAddr, e.Transport, status)
+	case proto == protocol.ProtocolUnix:
+		line = fmt.Sprintf("  unix:%s -> %s [%s] (%s) %s\n", e.RemotePath, localAddr, e.Transport, status, autoStr)
+	default:
+		remote := strconv.Itoa(int(e.RemotePort))
+		if e.RemoteHost != "" && e.RemoteHost != "localhost" {
+			remote = net.JoinHostPort(e.RemoteHost, remote)
+		}
+		remote += "/" + proto
+		if e.RemoteBind != "" && e.RemoteBind != e.RemoteHost {
+			remote += " (bound " + e.RemoteBind + ")"
+		}
+		line = fmt.Sprintf("  %s -> %s [%s] (%s) %s\n", remote, localAddr, e.Transport, status, autoStr)
+	}
+	if e.Name != "" {
+		line = "  " + e.Name + ": " + strings.TrimPrefix(line, "  ")
+	}
+
+	if e.Error != "" {
+		return line
+	}
+	return line + "      " + formatStats(e.Stats, now) + "\n"
+}
+
+// formatStats renders counters like
+// "1/4 conns, 1.2 MiB in, 340.0 KiB out, 0 failed, active 5s ago".
+func formatStats(s protocol.ForwardStats, now time.Time) string {
+	last := "never active"
+	if !s.LastActive.IsZero() {
+		last = "active " + now.Sub(s.LastActive).Truncate(time.Second).String() + " ago"
+	}
+	return fmt.Sprintf("%d/%d conns, %s in, %s out, %d failed, %s",
+		s.ActiveConns, s.TotalConns, formatBytes(s.BytesIn), formatBytes(s.BytesOut), s.FailedDials, last)
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// FindPortConflicts reports the local ports that forwards of more than one
+// session, by target, listen on; only one of them can have bound the port.
+func FindPortConflicts(entries map[string][]protocol.ForwardEntry) []string {
+	owners := make(map[string][]string)
+	for target, list := range entries {
+		seen := make(map[string]bool)
+		for _, e := range list {
+			if e.Reverse || strings.HasPrefix(e.LocalAddr, "unix:") {
+				continue
+			}
+			_, port, err := net.SplitHostPort(e.LocalAddr)
+			if err != nil || port == "0" {
+				continue
+			}
+			proto := e.Protocol
+			if proto != protocol.ProtocolUDP {
+				proto = protocol.ProtocolTCP
+			}
+			key := port + "/" + proto
+			if !seen[key] {
+				seen[key] = true
+				owners[key] = append(owners[key], target)
+			}
+		}
+	}
+
+	var res []string
+	for key, targets := range owners {
+		if len(targets) > 1 {
+			sort.Strings(targets)
+			res = append(res, fmt.Sprintf("port %s is forwarded by %s", key, strings.Join(targets, ", ")))
+		}
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,173 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liyu1981/moshpf/pkg/protocol"
+)
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[uint64]string{
+		0:               "0 B",
+		1023:            "1023 B",
+		1024:            "1.0 KiB",
+		1536:            "1.5 KiB",
+		5 * 1024 * 1024: "5.0 MiB",
+		3 << 30:         "3.0 GiB",
+	}
+	for n, want := range tests {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestFormatEntry(t *testing.T) {
+	now := time.Now()
+	e := protocol.ForwardEntry{
+		LocalAddr:  ":8080",
+		RemotePort: 8080,
+		Transport:  "quic",
+		Stats: protocol.ForwardStats{
+			ActiveConns: 1,
+			TotalConns:  3,
+			BytesIn:     2048,
+			BytesOut:    100,
+			FailedDials: 2,
+			LastActive:  now.Add(-5 * time.Second),
+		},
+	}
+
+	got := formatEntry(e, "10.0.0.1", now)
+	want := "  8080/tcp -> 10.0.0.1:8080 [quic] (OK) MANUAL\n" +
+		"      1/3 conns, 2.0 KiB in, 100 B out, 2 failed, active 5s ago\n"
+	if got != want {
+		t.Errorf("formatEntry() = %q, want %q", got, want)
+	}
+
+	e.Stats = protocol.ForwardStats{}
+	if got := formatEntry(e, "10.0.0.1", now); !strings.Contains(got, "never active") {
+		t.Errorf("Expected idle forward to be never active, got %q", got)
+	}
+
+	e.Name = "web"
+	if got := formatEntry(e, "10.0.0.1", now); !strings.HasPrefix(got, "  web: 8080/tcp -> ") {
+		t.Errorf("Expected the label in front of the forward, got %q", got)
+	}
+
+	e.IsAuto, e.User = true, "alice"
+	if got := formatEntry(e, "10.0.0.1", now); !strings.Contains(got, "(OK) AUTO (user alice)\n") {
+		t.Errorf("Expected the owner of another user's forward, got %q", got)
+	}
+
+	e.RemoteHost, e.RemoteBind = "localhost", "0.0.0.0, ::"
+	if got := formatEntry(e, "10.0.0.1", now); !strings.HasPrefix(got, "  web: 8080/tcp (bound 0.0.0.0, ::) -> ") {
+		t.Errorf("Expected the remote bind addresses, got %q", got)
+	}
+	e.RemoteHost, e.RemoteBind = "172.17.0.1", "172.17.0.1"
+	if got := formatEntry(e, "10.0.0.1", now); !strings.HasPrefix(got, "  web: 172.17.0.1:8080/tcp -> ") {
+		t.Errorf("Expected the remote bind address once, got %q", got)
+	}
+
+	e.Service, e.Title = "http", "Vite App"
+	if got := formatEntry(e, "10.0.0.1", now); !strings.Contains(got, "(OK) AUTO (user alice) http \"Vite App\"\n") {
+		t.Errorf("Expected the service and page title, got %q", got)
+	}
+
+	e.Error = "address already in use"
+	if got := formatEntry(e, "10.0.0.1", now); strings.Contains(got, "conns") {
+		t.Errorf("Expected no stats line for a failed forward, got %q", got)
+	}
+}
+
+func TestFormatList(t *testing.T) {
+	list := &protocol.ListResponse{
+		MasterIP:  "10.0.0.1",
+		MasterIPs: []string{"10.0.0.1", "fd00::1"},
+		Entries: []protocol.ForwardEntry{
+			{LocalAddr: ":3000", RemotePort: 3000, Transport: "quic", IsAuto: true},
+		},
+	}
+	status := &protocol.AgentStatus{SlaveIPs: []string{"10.0.0.2"}}
+
+	got := FormatList(list, status, time.Now())
+	want := "Session: 10.0.0.1, fd00::1 -> 10.0.0.2\n" +
+		"  3000/tcp -> 10.0.0.1:3000 [quic] (OK) AUTO\n" +
+		"      0/0 conns, 0 B in, 0 B out, 0 failed, never active"
+	if got != want {
+		t.Errorf("FormatList() = %q, want %q", got, want)
+	}
+	list.Detected = []protocol.DetectedPort{
+		{Port: 8888, Label: "jupyter", Action: protocol.ActionRequireApproval},
+		{Port: 9000, Action: protocol.ActionNotifyOnly},
+	}
+	got = FormatList(list, status, time.Now())
+	want += "\n  jupyter: 8888/tcp (not forwarded) AWAITING APPROVAL, run mpf approve 8888\n" +
+		"  9000/tcp (not forwarded) DETECTED"
+	if got != want {
+		t.Errorf("FormatList() = %q, want %q", got, want)
+	}
+}
+
+func TestFormatStatus(t *testing.T) {
+	st := &protocol.AgentStatus{Version: "1.2.3", PID: 42, SlaveIPs: []string{"10.0.0.2"}}
+	if got := FormatStatus(st); strings.Contains(got, "Master IPs:") || !strings.Contains(got, "Agent:      mpf 1.2.3 (pid 42)") {
+		t.Errorf("Unexpected status without session: %q", got)
+	}
+
+	st.Sessions, st.Transport, st.MasterIPs, st.Forwards = 1, "quic", []string{"10.0.0.1"}, 3
+	got := FormatStatus(st)
+	for _, want := range []string{"Sessions:   1 (quic)", "Master IPs: 10.0.0.1", "Forwards:   3"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected %q in %q", want, got)
+		}
+	}
+}
+
+func TestFormatStatusMaster(t *testing.T) {
+	st := &protocol.AgentStatus{Target: "user@box", Version: "1.2.3", PID: 7, MasterIPs: []string{"10.0.0.1"}, Forwards: 2}
+	got := FormatStatus(st)
+	for _, want := range []string{"Master:     mpf 1.2.3 (pid 7)", "Target:     user@box", "Sessions:   0", "Forwards:   2"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected %q in %q", want, got)
+		}
+	}
+}
+
+func TestFindPortConflicts(t *testing.T) {
+	got := FindPortConflicts(map[string][]protocol.ForwardEntry{
+		"a@one": {
+			{LocalAddr: ":3000", RemotePort: 3000, IsAuto: true},
+			{LocalAddr: "127.0.0.1:5353", Protocol: protocol.ProtocolUDP},
+			{LocalAddr: "localhost:8000", Reverse: true},
+		},
+		"b@two": {
+			{LocalAddr: "0.0.0.0:3000", RemotePort: 3000, IsAuto: true, Error: "address already in use"},
+			{LocalAddr: ":5353", RemotePort: 5353},
+			{LocalAddr: ":8000", RemotePort: 8000},
+		},
+	})
+	want := []string{"port 3000/tcp is forwarded by a@one, b@two"}
+	if len(got) != len(want) || got[0] != want[0] {
+		t.Errorf("FindPortConflicts() = %v, want %v", got, want)
+	}
+}
+
+func TestFormatMaster(t *testing.T) {
+	st := &protocol.AgentStatus{Target: "user@box", PID: 7, Sessions: 1, Transport: "QUIC"}
+	list := &protocol.ListResponse{
+		MasterIP: "10.0.0.1",
+		Entries: []protocol.ForwardEntry{
+			{LocalAddr: ":3000", RemotePort: 3000, Transport: "QUIC", IsAuto: true, Error: "address already in use"},
+		},
+	}
+
+	got := FormatMaster(st, list, time.Now())
+	want := "user@box (pid 7): 1 session(s) over QUIC, 1 forward(s)\n" +
+		"  3000/tcp -> 10.0.0.1:3000 [QUIC] (ERROR: address already in use) AUTO"
+	if got != want {
+		t.Errorf("FormatMaster() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/net"
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// listenSocket is a TCP socket in the LISTEN state. uid is -1 when the
+// source does not know the owner.
+type listenSocket struct {
+	port uint32
+	ip   string
+	pid  int32
+	uid  int64
+}
+
+// portSource lists the listening TCP sockets for the auto forwarder.
+// newPortSource picks the fastest one for the platform.
+type portSource interface {
+	listening() ([]listenSocket, error)
+	// interval is how often the auto forwarder asks.
+	interval() time.Duration
+}
+
+// psutilSource asks gopsutil for every connection of the host, which is
+// slow with many sockets, so it is asked at the configured scan interval.
+type psutilSource struct {
+	every time.Duration
+}
+
+func (s *psutilSource) listening() ([]listenSocket, error) {
+	conns, err := net.Connections("tcp")
+	if err != nil {
+		return nil, err
+	}
+
+	var res []listenSocket
+	for _, c := range conns {
+		if c.Status == "LISTEN" {
+			uid := int64(-1)
+			if len(c.Uids) > 0 {
+				uid = int64(c.Uids[0])
+			}
+			res = append(res, listenSocket{port: c.Laddr.Port, ip: c.Laddr.IP, pid: c.Pid, uid: uid})
+		}
+	}
+	return res, nil
+}
+
+func (s *psutilSource) interval() time.Duration {
+	return s.every
+}
+
+// procInfo is what the rules match a listening process on. exe has its
+// symlinks resolved, and uid is the real user id or -1.
+type procInfo struct {
+	name    string
+	exe     string
+	cmdline string
+	user    string
+	uid     int64
+}
+
+// procCache keeps the process details of listening sockets across scans, so
+// that a process is looked up once and not on every scan.
+type procCache struct {
+	procs map[int32]procInfo
+	// users caches the user names of owner.
+	users map[int64]string
+}
+
+func newProcCache() *procCache {
+	return &procCache{procs: make(map[int32]procInfo), users: make(map[int64]string)}
+}
+
+func (c *procCache) get(pid int32) (procInfo, bool) {
+	if info, ok := c.procs[pid]; ok {
+		return info, true
+	}
+
+	p, err := process.NewProcess(pid)
+	if err != nil {
+		return procInfo{}, false
+	}
+	var info procInfo
+	info.name, _ = p.Name()
+	info.exe, _ = p.Exe()
+	if exe, err := filepath.EvalSymlinks(info.exe); err == nil {
+		info.exe = exe
+	}
+	info.cmdline, _ = p.Cmdline()
+	info.user, _ = p.Username()
+	info.uid = -1
+	if uids, err := p.Uids(); err == nil && len(uids) > 0 {
+		info.uid = int64(uids[0])
+	}
+	c.procs[pid] = info
+	return info, true
+}
+
+// owner returns what is known of a socket whose process cannot be seen,
+// such as one of another user when not running as root: its user.
+func (c *procCache) owner(uid int64) procInfo {
+	name, ok := c.users[uid]
+	if !ok {
+		if u, err := user.LookupId(strconv.FormatInt(uid, 10)); err == nil {
+			name = u.Username
+		}
+		c.users[uid] = name
+	}
+	return procInfo{user: name, uid: uid}
+}
+
+// keep forgets the processes no longer listening, whose pids may be reused.
+func (c *procCache) keep(sockets []listenSocket) {
+	alive := make(map[int32]bool, len(sockets))
+	for _, s := range sockets {
+		alive[s.pid] = true
+	}
+	for pid := range c.procs {
+		if !alive[pid] {
+			delete(c.procs, pid)
+		}
+	}
+}
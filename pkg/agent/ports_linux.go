@@ -0,0 +1,192 @@
+//go:build linux
+
+package agent
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tcpListen is the LISTEN state in /proc/net/tcp.
+const tcpListen = "0A"
+
+// newPortSource reads /proc/net/tcp every watchInterval where it can and
+// falls back to gopsutil every scanInterval.
+func newPortSource(scanInterval, watchInterval time.Duration) portSource {
+	if _, err := os.Stat("/proc/net/tcp"); err != nil {
+		return &psutilSource{every: scanInterval}
+	}
+	return newProcNetSource("/proc", watchInterval)
+}
+
+// procNetSource reads the listening sockets from /proc/net/tcp and tcp6,
+// which is cheap enough to do several times a second. The pid owning a
+// socket is found through the socket inode in /proc/<pid>/fd, once per
+// socket.
+type procNetSource struct {
+	root  string
+	every time.Duration
+	uid   uint32
+	// pids maps the inode of each listening socket to its pid, 0 when it
+	// belongs to another user or was not found.
+	pids map[uint64]int32
+}
+
+func newProcNetSource(root string, every time.Duration) *procNetSource {
+	return &procNetSource{
+		root:  root,
+		every: every,
+		uid:   uint32(os.Getuid()),
+		pids:  make(map[uint64]int32),
+	}
+}
+
+func (s *procNetSource) interval() time.Duration {
+	return s.every
+}
+
+// procSocket is a line of /proc/net/tcp in the LISTEN state.
+type procSocket struct {
+	port  uint32
+	ip    string
+	uid   uint32
+	inode uint64
+}
+
+func (s *procNetSource) listening() ([]listenSocket, error) {
+	var socks []procSocket
+	for _, name := range []string{"tcp", "tcp6"} {
+		data, err := os.ReadFile(filepath.Join(s.root, "net", name))
+		if err != nil {
+			if name == "tcp6" && os.IsNotExist(err) {
+				// No IPv6 on this host
+				continue
+			}
+			return nil, err
+		}
+		socks = append(socks, parseProcNet(string(data))...)
+	}
+
+	unknown := make(map[uint64]bool)
+	seen := make(map[uint64]bool, len(socks))
+	for _, ps := range socks {
+		seen[ps.inode] = true
+		if _, ok := s.pids[ps.inode]; ok {
+			continue
+		}
+		// The fds of other users cannot be read, unless running as root
+		if s.uid == 0 || ps.uid == s.uid {
+			unknown[ps.inode] = true
+		} else {
+			s.pids[ps.inode] = 0
+		}
+	}
+	if len(unknown) > 0 {
+		s.resolve(unknown)
+	}
+	for inode := range s.pids {
+		if !seen[inode] {
+			delete(s.pids, inode)
+		}
+	}
+
+	res := make([]listenSocket, 0, len(socks))
+	for _, ps := range socks {
+		res = append(res, listenSocket{port: ps.port, ip: ps.ip, pid: s.pids[ps.inode], uid: int64(ps.uid)})
+	}
+	return res, nil
+}
+
+// resolve finds the pids holding the socket inodes in unknown by looking
+// through the fds of every process.
+func (s *procNetSource) resolve(unknown map[uint64]bool) {
+	for inode := range unknown {
+		s.pids[inode] = 0
+	}
+
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return
+	}
+	left := len(unknown)
+	for _, e := range entries {
+		pid, err := strconv.ParseInt(e.Name(), 10, 32)
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join(s.root, e.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]"), 10, 64)
+			if err != nil || !unknown[inode] {
+				continue
+			}
+			s.pids[inode] = int32(pid)
+			delete(unknown, inode)
+			if left--; left == 0 {
+				return
+			}
+		}
+	}
+}
+
+// parseProcNet returns the listening sockets of /proc/net/tcp or tcp6:
+//
+//	sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+//	 0: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 12345 ...
+func parseProcNet(data string) []procSocket {
+	var res []procSocket
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 10 || fields[3] != tcpListen {
+			continue
+		}
+		ip, port, err := parseProcAddr(fields[1])
+		if err != nil {
+			continue
+		}
+		uid, err1 := strconv.ParseUint(fields[7], 10, 32)
+		inode, err2 := strconv.ParseUint(fields[9], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		res = append(res, procSocket{port: port, ip: ip, uid: uint32(uid), inode: inode})
+	}
+	return res
+}
+
+// parseProcAddr decodes "0100007F:1F90". The address is printed as 32-bit
+// words in host byte order.
+func parseProcAddr(s string) (string, uint32, error) {
+	hexIP, hexPort, found := strings.Cut(s, ":")
+	if !found {
+		return "", 0, fmt.Errorf("invalid address %s", s)
+	}
+	port, err := strconv.ParseUint(hexPort, 16, 16)
+	if err != nil {
+		return "", 0, err
+	}
+	raw, err := hex.DecodeString(hexIP)
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return "", 0, fmt.Errorf("invalid address %s", s)
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		binary.NativeEndian.PutUint32(ip[i:], binary.BigEndian.Uint32(raw[i:]))
+	}
+	return ip.String(), uint32(port), nil
+}
@@ -0,0 +1,157 @@
+//go:build linux
+
+package agent
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/liyu1981/moshpf/pkg/config"
+	"github.com/liyu1981/moshpf/pkg/constant"
+	"github.com/liyu1981/moshpf/pkg/protocol"
+)
+
+const procNetTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 111 1 0000000000000000 100 0 0 10 0
+   1: 00000000:0BB8 00000000:0000 0A 00000000:00000000 00:00000000 00000000  2000        0 222 1 0000000000000000 100 0 0 10 0
+   2: 0100007F:1F90 0100007F:C350 01 00000000:00000000 00:00000000 00000000  1000        0 333 1 0000000000000000 20 4 30 10 -1
+`
+
+const procNetTCP6 = `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000001000000:1388 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 444 1 0000000000000000 100 0 0 10 0
+`
+
+func TestParseProcNet(t *testing.T) {
+	got := parseProcNet(procNetTCP)
+	want := []procSocket{
+		{port: 8080, ip: "127.0.0.1", uid: 1000, inode: 111},
+		{port: 3000, ip: "0.0.0.0", uid: 2000, inode: 222},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseProcNet(tcp) = %+v, want %+v", got, want)
+	}
+
+	got = parseProcNet(procNetTCP6)
+	want = []procSocket{{port: 5000, ip: "::1", uid: 1000, inode: 444}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseProcNet(tcp6) = %+v, want %+v", got, want)
+	}
+}
+
+func TestProcNetSource(t *testing.T) {
+	root := t.TempDir()
+	mustWrite := func(name, data string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustLink := func(target, name string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustWrite("net/tcp", procNetTCP)
+	mustWrite("net/tcp6", procNetTCP6)
+	mustLink("/dev/null", "42/fd/0")
+	mustLink("socket:[111]", "42/fd/3")
+	mustLink("socket:[444]", "77/fd/5")
+	// Sockets of other users are not looked up
+	mustLink("socket:[222]", "99/fd/3")
+
+	s := newProcNetSource(root, constant.AutoForwardWatchInterval)
+	s.uid = 1000
+	got, err := s.listening()
+	if err != nil {
+		t.Fatalf("listening failed: %v", err)
+	}
+	want := []listenSocket{
+		{port: 8080, ip: "127.0.0.1", pid: 42, uid: 1000},
+		{port: 3000, ip: "0.0.0.0", pid: 0, uid: 2000},
+		{port: 5000, ip: "::1", pid: 77, uid: 1000},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listening() = %+v, want %+v", got, want)
+	}
+
+	// Closed sockets are forgotten
+	mustWrite("net/tcp6", "")
+	if _, err := s.listening(); err != nil {
+		t.Fatalf("listening failed: %v", err)
+	}
+	if _, ok := s.pids[444]; ok {
+		t.Errorf("Expected the closed socket to be forgotten")
+	}
+}
+
+func TestProcNetSourceOtherUsers(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "net"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// No process holds the inode of uid 2000, as when its fds cannot be read
+	if err := os.WriteFile(filepath.Join(root, "net", "tcp"), []byte(procNetTCP), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a := &Agent{settings: config.Default()}
+	af := NewAutoForwarder(a)
+	af.uid = 1000
+	af.containers = nil
+	af.source = newProcNetSource(root, constant.AutoForwardWatchInterval)
+	af.source.(*procNetSource).uid = 1000
+	af.procs.users[2000] = ""
+
+	ports, err := af.listListeningPorts()
+	if err != nil {
+		t.Fatalf("listListeningPorts failed: %v", err)
+	}
+	if len(ports) != 0 {
+		t.Errorf("Expected no ports of other users, got %+v", ports)
+	}
+
+	af.otherUsers = true
+	ports, _ = af.listListeningPorts()
+	want := map[uint32]listeningPort{
+		3000: {action: protocol.ActionForward, user: "uid 2000", host: "localhost", bind: "0.0.0.0"},
+	}
+	if !reflect.DeepEqual(ports, want) {
+		t.Errorf("listListeningPorts() = %+v, want %+v", ports, want)
+	}
+}
+
+func TestProcNetSourceLive(t *testing.T) {
+	if _, err := os.Stat("/proc/net/tcp"); err != nil {
+		t.Skip("no /proc/net/tcp")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	port := uint32(ln.Addr().(*net.TCPAddr).Port)
+
+	sockets, err := newProcNetSource("/proc", constant.AutoForwardWatchInterval).listening()
+	if err != nil {
+		t.Fatalf("listening failed: %v", err)
+	}
+	for _, s := range sockets {
+		if s.port == port {
+			if s.ip != "127.0.0.1" || s.pid != int32(os.Getpid()) || s.uid != int64(os.Getuid()) {
+				t.Errorf("Unexpected socket: %+v", s)
+			}
+			return
+		}
+	}
+	t.Errorf("Port %d not found in %+v", port, sockets)
+}
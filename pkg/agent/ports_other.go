@@ -0,0 +1,9 @@
+//go:build !linux
+
+package agent
+
+import "time"
+
+func newPortSource(scanInterval, watchInterval time.Duration) portSource {
+	return &psutilSource{every: scanInterval}
+}
@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/tls"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/liyu1981/moshpf/pkg/constant"
+	"github.com/liyu1981/moshpf/pkg/protocol"
+	"github.com/liyu1981/moshpf/pkg/tunnel"
+	"github.com/rs/zerolog/log"
+)
+
+// probeTimeout bounds each attempt of probeService.
+var probeTimeout = constant.ProbeTimeout
+
+// maxTitle caps the page title shown in the list.
+const maxTitle = 80
+
+var titleRe = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// postgresSSLRequest asks a Postgres server whether it speaks TLS, which it
+// answers with a single S or N.
+var postgresSSLRequest = []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}
+
+// probeService finds out what listens on host:port. Each attempt uses a new
+// connection: a banner sent by the server first (SSH, MySQL), the Postgres
+// SSLRequest, a Redis PING, a TLS handshake, an HTTP request and a
+// cleartext HTTP/2 request for gRPC. Binary probes come before text ones
+// so that servers log as little garbage as possible. It returns the service,
+// or "" when none answered, and the page title of an HTTP service.
+func probeService(host string, port uint16) (string, string) {
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+
+	banner, err := exchange(addr, nil)
+	if err != nil && len(banner) == 0 && !isTimeout(err) {
+		return "", ""
+	}
+	switch {
+	case bytes.HasPrefix(banner, []byte("SSH-")):
+		return protocol.ServiceSSH, ""
+	case len(banner) > 4 && banner[3] == 0 && (banner[4] == 10 || banner[4] == 0xff):
+		// Protocol version 10 handshake or an error packet
+		return protocol.ServiceMySQL, ""
+	case len(banner) > 0:
+		return "", ""
+	}
+
+	if reply, _ := exchange(addr, postgresSSLRequest); len(reply) == 1 && (reply[0] == 'S' || reply[0] == 'N') {
+		return protocol.ServicePostgres, ""
+	}
+	if reply, _ := exchange(addr, []byte("PING\r\n")); bytes.HasPrefix(reply, []byte("+PONG")) || bytes.HasPrefix(reply, []byte("-NOAUTH")) {
+		return protocol.ServiceRedis, ""
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}}
+	dialer := &net.Dialer{Timeout: probeTimeout}
+	if conn, err := tls.DialWithDialer(dialer, "tcp", addr, tlsConfig); err == nil {
+		conn.Close()
+		tr := &http.Transport{TLSClientConfig: tlsConfig, ForceAttemptHTTP2: true}
+		if service, title, ok := probeHTTP(tr, "https://"+addr); ok {
+			if service == protocol.ServiceHTTP {
+				service = protocol.ServiceHTTPS
+			}
+			return service, title
+		}
+		return protocol.ServiceTLS, ""
+	}
+
+	if service, title, ok := probeHTTP(&http.Transport{}, "http://"+addr); ok {
+		return service, title
+	}
+	var h2c http.Protocols
+	h2c.SetUnencryptedHTTP2(true)
+	if service, title, ok := probeHTTP(&http.Transport{Protocols: &h2c}, "http://"+addr); ok {
+		return service, title
+	}
+	return "", ""
+}
+
+// exchange connects to addr, sends req unless nil and returns what the
+// server answers within probeTimeout.
+func exchange(addr string, req []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", addr, probeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(probeTimeout))
+
+	if req != nil {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+	}
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	return buf[:n], err
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// probeHTTP sends GET / through tr and reports whether an HTTP or gRPC
+// server answered, with the page title of an HTML answer.
+func probeHTTP(tr *http.Transport, url string) (string, string, bool) {
+	client := &http.Client{
+		Transport: tr,
+		Timeout:   2 * probeTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", "", false
+	}
+	defer resp.Body.Close()
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/grpc") || resp.Header.Get("Grpc-Status") != "" {
+		return protocol.ServiceGRPC, "", true
+	}
+	if !strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return protocol.ServiceHTTP, "", true
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	return protocol.ServiceHTTP, pageTitle(body), true
+}
+
+// pageTitle returns the <title> of an HTML page, on one line.
+func pageTitle(body []byte) string {
+	m := titleRe.FindSubmatch(body)
+	if m == nil {
+		return ""
+	}
+	title := []rune(strings.Join(strings.Fields(html.UnescapeString(string(m[1]))), " "))
+	if len(title) > maxTitle {
+		title = append(title[:maxTitle-1], '…')
+	}
+	return string(title)
+}
+
+// handleProbe answers a ProbeRequest of the master.
+func (a *Agent) handleProbe(s *tunnel.Session, m protocol.ProbeRequest) {
+	service, title := probeService(m.Host, m.Port)
+	log.Debug().Str("host", m.Host).Uint16("port", m.Port).Str("service", service).Msg("Probed forwarded port")
+	_ = s.Send(protocol.ProbeResult{Host: m.Host, Port: m.Port, Service: service, Title: title})
+}
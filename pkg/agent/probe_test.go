@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liyu1981/moshpf/pkg/protocol"
+)
+
+// serveTCP runs handle for each connection to a new local port.
+func serveTCP(t *testing.T, handle func(net.Conn)) uint16 {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func serverPort(srv *httptest.Server) uint16 {
+	return uint16(srv.Listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestProbeService(t *testing.T) {
+	old := probeTimeout
+	probeTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { probeTimeout = old })
+
+	page := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = io.WriteString(w, "<html><head><TITLE>\n  Vite &amp; React\n</TITLE></head></html>")
+	})
+	web := httptest.NewServer(page)
+	defer web.Close()
+	secure := httptest.NewUnstartedServer(page)
+	secure.Config.ErrorLog = log.New(io.Discard, "", 0)
+	secure.StartTLS()
+	defer secure.Close()
+
+	grpc := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "12")
+	}))
+	var h2c http.Protocols
+	h2c.SetUnencryptedHTTP2(true)
+	grpc.Config.Protocols = &h2c
+	grpc.Start()
+	defer grpc.Close()
+
+	ssh := serveTCP(t, func(c net.Conn) {
+		_, _ = io.WriteString(c, "SSH-2.0-OpenSSH_9.6\r\n")
+		_, _ = io.Copy(io.Discard, c)
+	})
+	postgres := serveTCP(t, func(c net.Conn) {
+		buf := make([]byte, 8)
+		if _, err := io.ReadFull(c, buf); err == nil && string(buf) == string(postgresSSLRequest) {
+			_, _ = c.Write([]byte("N"))
+		}
+	})
+	redis := serveTCP(t, func(c net.Conn) {
+		line, _ := bufio.NewReader(c).ReadString('\n')
+		if strings.TrimSpace(line) == "PING" {
+			_, _ = io.WriteString(c, "+PONG\r\n")
+		}
+	})
+	silent := serveTCP(t, func(c net.Conn) {
+		_, _ = io.Copy(io.Discard, c)
+	})
+	hangup := serveTCP(t, func(net.Conn) {})
+
+	tests := []struct {
+		name    string
+		port    uint16
+		service string
+		title   string
+	}{
+		{"http", serverPort(web), protocol.ServiceHTTP, "Vite & React"},
+		{"https", serverPort(secure), protocol.ServiceHTTPS, "Vite & React"},
+		{"grpc", serverPort(grpc), protocol.ServiceGRPC, ""},
+		{"ssh", ssh, protocol.ServiceSSH, ""},
+		{"postgres", postgres, protocol.ServicePostgres, ""},
+		{"redis", redis, protocol.ServiceRedis, ""},
+		{"silent", silent, "", ""},
+		{"hangup", hangup, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, title := probeService("127.0.0.1", tt.port)
+			if service != tt.service || title != tt.title {
+				t.Errorf("probeService = %q, %q, want %q, %q", service, title, tt.service, tt.title)
+			}
+		})
+	}
+}
+
+func TestPageTitle(t *testing.T) {
+	if got := pageTitle([]byte("<p>no title</p>")); got != "" {
+		t.Errorf("Expected no title, got %q", got)
+	}
+	long := "<title>" + strings.Repeat("a", 100) + "</title>"
+	if got := []rune(pageTitle([]byte(long))); len(got) != maxTitle || got[maxTitle-1] != '…' {
+		t.Errorf("Expected the title cut at %d, got %q", maxTitle, string(got))
+	}
+}
@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"sync"
+
+	"github.com/liyu1981/moshpf/pkg/protocol"
+)
+
+// replies hands the master's answers to the CLI commands waiting for them,
+// by the ID of their request. Answers nobody waits for any more, such as
+// those arriving after a timeout, are dropped.
+type replies struct {
+	mu      sync.Mutex
+	next    uint64
+	waiting map[uint64]chan protocol.Message
+}
+
+// wait returns the ID for a new request and the channel its answer arrives
+// on. done must be called once the answer is no longer awaited.
+func (r *replies) wait() (uint64, chan protocol.Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.waiting == nil {
+		r.waiting = make(map[uint64]chan protocol.Message)
+	}
+	r.next++
+	ch := make(chan protocol.Message, 1)
+	r.waiting[r.next] = ch
+	return r.next, ch
+}
+
+func (r *replies) done(id uint64) {
+	r.mu.Lock()
+	delete(r.waiting, id)
+	r.mu.Unlock()
+}
+
+// deliver passes msg to the command waiting for id, reporting whether one
+// was.
+func (r *replies) deliver(id uint64, msg protocol.Message) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ch, ok := r.waiting[id]
+	if !ok {
+		return false
+	}
+	delete(r.waiting, id)
+	ch <- msg
+	return true
+}
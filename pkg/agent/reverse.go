@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"encoding/gob"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/liyu1981/moshpf/pkg/protocol"
+	"github.com/liyu1981/moshpf/pkg/util"
+	"github.com/rs/zerolog/log"
+)
+
+type reverseListener struct {
+	ln         net.Listener
+	masterHost string
+	masterPort uint16
+}
+
+// listenReverse binds the remote side of a reverse forward requested by the
+// master. Connections accepted on it are tunneled back to the master.
+func (a *Agent) listenReverse(req protocol.ListenRequest) protocol.ListenResponse {
+	localAddr := req.LocalAddr
+	if strings.HasPrefix(localAddr, ":") {
+		localAddr = "127.0.0.1" + localAddr
+	}
+
+	var port uint16
+	if _, portStr, err := net.SplitHostPort(localAddr); err == nil {
+		p, _ := strconv.ParseUint(portStr, 10, 16)
+		port = uint16(p)
+	}
+
+	resp := protocol.ListenResponse{
+		RemotePort: req.RemotePort,
+		LocalPort:  port,
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if rl, exists := a.reverseListeners[port]; exists {
+		if rl.masterHost == req.RemoteHost && rl.masterPort == req.RemotePort {
+			// Already listening, e.g. the master reconnected and is resyncing.
+			resp.Success = true
+			return resp
+		}
+		resp.Reason = fmt.Sprintf("port %d already has a reverse forward", port)
+		return resp
+	}
+
+	ln, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		resp.Reason = err.Error()
+		return resp
+	}
+
+	rl := &reverseListener{
+		ln:         ln,
+		masterHost: req.RemoteHost,
+		masterPort: req.RemotePort,
+	}
+	a.reverseListeners[port] = rl
+	resp.Success = true
+
+	log.Info().
+		Str("local", localAddr).
+		Str("master", net.JoinHostPort(req.RemoteHost, strconv.Itoa(int(req.RemotePort)))).
+		Msg("Reverse forwarding started")
+
+	go func() {
+		defer func() {
+			ln.Close()
+			a.mu.Lock()
+			if a.reverseListeners[port] == rl {
+				delete(a.reverseListeners, port)
+			}
+			a.mu.Unlock()
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go a.handleReverseConnection(conn, rl.masterHost, rl.masterPort)
+		}
+	}()
+
+	return resp
+}
+
+func (a *Agent) closeReverse(port uint16) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rl, ok := a.reverseListeners[port]
+	if !ok {
+		return false
+	}
+	rl.ln.Close()
+	delete(a.reverseListeners, port)
+	log.Info().Uint16("port", port).Msg("Reverse forwarding stopped")
+	return true
+}
+
+func (a *Agent) handleReverseConnection(localConn net.Conn, masterHost string, masterPort uint16) {
+	defer localConn.Close()
+
+	s := a.getBestSession()
+	if s == nil {
+		log.Error().Msg("No active session for reverse forwarding")
+		return
+	}
+
+	masterConn, err := s.Mux.OpenStream()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to open multiplexer stream")
+		return
+	}
+	defer masterConn.Close()
+
+	encoder := gob.NewEncoder(masterConn)
+	err = encoder.Encode(protocol.StreamHeader{
+		Host: masterHost,
+		Port: masterPort,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to send stream header")
+		return
+	}
+
+	// Wait for 1-byte ACK (1 = success, 0 = fail)
+	ack := make([]byte, 1)
+	_, err = masterConn.Read(ack)
+	if err != nil || ack[0] != 1 {
+		log.Error().Err(err).Msg("Failed to get stream ACK")
+		return
+	}
+
+	util.Proxy(localConn, masterConn)
+}
@@ -0,0 +1,435 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/liyu1981/moshpf/pkg/protocol"
+	"golang.org/x/term"
+)
+
+// topRefresh is how often `mpf top` asks for the list.
+const topRefresh = time.Second
+
+// Keys understood by the dashboard, see readKeys.
+const (
+	keyUp   = "up"
+	keyDown = "down"
+	keyQuit = "quit"
+)
+
+// dashboard is the state behind `mpf top`: the last list answered on the
+// control socket and the counters of the refresh before, to derive the
+// throughput of every forward.
+type dashboard struct {
+	list     *protocol.ListResponse
+	status   *protocol.AgentStatus
+	entries  []protocol.ForwardEntry
+	rates    map[string][2]float64 // bytes in/out per second
+	prev     map[string]protocol.ForwardStats
+	prevAt   time.Time
+	updated  time.Time
+	selected string // entryKey of the selected forward
+	message  string
+}
+
+func newDashboard() *dashboard {
+	return &dashboard{
+		rates: make(map[string][2]float64),
+		prev:  make(map[string]protocol.ForwardStats),
+	}
+}
+
+// Top runs the full-screen dashboard of `mpf top` against the agent or master
+// listening on sockPath until q, Esc or Ctrl+C is pressed.
+func Top(sockPath string) error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return fmt.Errorf("mpf top needs a terminal")
+	}
+
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, oldState)
+
+	// Alternate screen, hidden cursor
+	fmt.Print("\033[?1049h\033[?25l")
+	defer fmt.Print("\033[?25h\033[?1049l")
+
+	d := newDashboard()
+	keys := readKeys(os.Stdin)
+	ticker := time.NewTicker(topRefresh)
+	defer ticker.Stop()
+
+	for {
+		d.refresh(sockPath, time.Now())
+		width, height, err := term.GetSize(fd)
+		if err != nil {
+			width, height = 80, 24
+		}
+		// Redraw in place, clearing what is left of every line
+		fmt.Print("\033[H" + strings.ReplaceAll(d.render(width, height), "\n", "\033[K\r\n") + "\033[K\033[J")
+
+		select {
+		case key, ok := <-keys:
+			if !ok || key == keyQuit {
+				return nil
+			}
+			d.handleKey(sockPath, key)
+		case <-ticker.C:
+		}
+	}
+}
+
+// readKeys turns the raw input into keys: keyUp, keyDown, keyQuit or the
+// character typed.
+func readKeys(in *os.File) <-chan string {
+	keys := make(chan string)
+	go func() {
+		defer close(keys)
+		buf := make([]byte, 3)
+		for {
+			n, err := in.Read(buf)
+			if err != nil {
+				return
+			}
+			switch {
+			case n == 3 && buf[0] == 0x1b && buf[1] == '[' && buf[2] == 'A':
+				keys <- keyUp
+			case n == 3 && buf[0] == 0x1b && buf[1] == '[' && buf[2] == 'B':
+				keys <- keyDown
+			case n == 1 && (buf[0] == 0x1b || buf[0] == 3 || buf[0] == 'q'):
+				keys <- keyQuit
+			case n == 1 && buf[0] == 'k':
+				keys <- keyUp
+			case n == 1 && buf[0] == 'j':
+				keys <- keyDown
+			case n == 1:
+				keys <- string(buf[:1])
+			}
+		}
+	}()
+	return keys
+}
+
+// refresh fetches the list and updates the throughput of every forward.
+func (d *dashboard) refresh(sockPath string, now time.Time) {
+	resp, err := protocol.SendControl(sockPath, protocol.CommandList)
+	if err != nil {
+		d.message = "ERROR: " + err.Error()
+		return
+	}
+	if resp.Error != nil {
+		d.message = "ERROR: " + resp.Error.Message
+		return
+	}
+	d.update(resp.List, resp.Status, now)
+}
+
+// update takes a new list, sorting its entries and deriving the throughput
+// from the counters of the previous list.
+func (d *dashboard) update(list *protocol.ListResponse, status *protocol.AgentStatus, now time.Time) {
+	d.list, d.status, d.updated = list, status, now
+	d.entries = append([]protocol.ForwardEntry(nil), list.Entries...)
+	sort.SliceStable(d.entries, func(i, j int) bool {
+		a, b := d.entries[i], d.entries[j]
+		if a.Reverse != b.Reverse {
+			return !a.Reverse
+		}
+		if pa, pb := localPort(a), localPort(b); pa != pb {
+			return pa < pb
+		}
+		return entryKey(a) < entryKey(b)
+	})
+
+	elapsed := now.Sub(d.prevAt).Seconds()
+	rates := make(map[string][2]float64)
+	prev := make(map[string]protocol.ForwardStats)
+	for _, e := range d.entries {
+		key := entryKey(e)
+		prev[key] = e.Stats
+		p, ok := d.prev[key]
+		if !ok || elapsed <= 0 || e.Stats.BytesIn < p.BytesIn || e.Stats.BytesOut < p.BytesOut {
+			continue
+		}
+		rates[key] = [2]float64{
+			float64(e.Stats.BytesIn-p.BytesIn) / elapsed,
+			float64(e.Stats.BytesOut-p.BytesOut) / elapsed,
+		}
+	}
+	d.rates, d.prev, d.prevAt = rates, prev, now
+
+	if d.selectedIndex() < 0 && len(d.entries) > 0 {
+		d.selected = entryKey(d.entries[0])
+	}
+}
+
+func (d *dashboard) selectedIndex() int {
+	for i, e := range d.entries {
+		if entryKey(e) == d.selected {
+			return i
+		}
+	}
+	return -1
+}
+
+// handleKey moves the selection or runs the command bound to key.
+func (d *dashboard) handleKey(sockPath string, key string) {
+	i := d.selectedIndex()
+	switch key {
+	case keyUp:
+		if i > 0 {
+			d.selected = entryKey(d.entries[i-1])
+		}
+		return
+	case keyDown:
+		if i >= 0 && i < len(d.entries)-1 {
+			d.selected = entryKey(d.entries[i+1])
+		}
+		return
+	}
+
+	command, args, err := d.commandFor(key)
+	if err != nil {
+		d.message = "ERROR: " + err.Error()
+		return
+	}
+	if command == "" {
+		return
+	}
+	resp, err := protocol.SendControl(sockPath, command, args...)
+	d.message = describeResponse(resp, err)
+}
+
+// commandFor returns the control command bound to key: c closes and p pins
+// the selected forward, a and l switch auto forwarding and local-only
+// binding. An empty command means the key is not bound.
+func (d *dashboard) commandFor(key string) (string, []string, error) {
+	var e *protocol.ForwardEntry
+	if i := d.selectedIndex(); i >= 0 {
+		e = &d.entries[i]
+	}
+
+	switch key {
+	case "c":
+		if e == nil {
+			return "", nil, fmt.Errorf("no forward selected")
+		}
+		args := closeArgs(*e)
+		if args == nil {
+			return "", nil, fmt.Errorf("cannot close %s", e.LocalAddr)
+		}
+		return protocol.CommandClose, args, nil
+	case "p":
+		if e == nil || !e.IsAuto || localPort(*e) == 0 {
+			return "", nil, fmt.Errorf("only auto forwards can be pinned")
+		}
+		return protocol.CommandPin, []string{strconv.Itoa(localPort(*e))}, nil
+	case "a":
+		return protocol.CommandAutoForward, []string{onOff(d.list == nil || !d.list.AutoForward)}, nil
+	case "l":
+		return protocol.CommandLocalOnly, []string{onOff(d.list == nil || !d.list.LocalOnly)}, nil
+	}
+	return "", nil, nil
+}
+
+// closeArgs returns the arguments of `mpf close` for e, or nil.
+func closeArgs(e protocol.ForwardEntry) []string {
+	switch {
+	case e.Reverse:
+		return []string{"--reverse", strconv.Itoa(int(e.RemotePort))}
+	case e.VHost != "":
+		return []string{"--host", e.VHost}
+	case strings.HasPrefix(e.LocalAddr, "unix:"):
+		return []string{e.LocalAddr}
+	}
+	port := localPort(e)
+	if port == 0 {
+		return nil
+	}
+	if e.Protocol == protocol.ProtocolUDP {
+		return []string{"udp:" + strconv.Itoa(port)}
+	}
+	return []string{strconv.Itoa(port)}
+}
+
+func describeResponse(resp protocol.ControlResponse, err error) string {
+	switch {
+	case err != nil:
+		return "ERROR: " + err.Error()
+	case resp.Error != nil:
+		return "ERROR: " + resp.Error.Message
+	}
+	var msgs []string
+	if resp.Message != "" {
+		msgs = append(msgs, resp.Message)
+	}
+	for _, r := range resp.Results {
+		if r.Success {
+			msgs = append(msgs, r.Message)
+		} else {
+			msgs = append(msgs, "ERROR: "+r.Message)
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// render draws the dashboard for a width x height terminal: a header with
+// the session and settings, a table of forwards with the selected one
+// highlighted, the last message and the key bindings.
+func (d *dashboard) render(width, height int) string {
+	var lines []string
+	add := func(s string) {
+		lines = append(lines, truncate(s, width))
+	}
+
+	add(d.header())
+	add("")
+	add(fmt.Sprintf("  %-12s %-24s %-24s %-8s %-9s %-11s %-11s %-11s %s",
+		"NAME", "LOCAL", "REMOTE", "KIND", "CONNS", "IN/s", "OUT/s", "IN", "OUT"))
+
+	// Keep the selected forward in view
+	rows := height - 5
+	if rows < 1 {
+		rows = 1
+	}
+	start := 0
+	if i := d.selectedIndex(); i >= rows {
+		start = i - rows + 1
+	}
+	for i := start; i < len(d.entries) && i < start+rows; i++ {
+		e := d.entries[i]
+		line := d.row(e)
+		if entryKey(e) == d.selected {
+			lines = append(lines, "\033[7m"+pad(truncate("> "+line, width), width)+"\033[0m")
+		} else {
+			add("  " + line)
+		}
+	}
+	if len(d.entries) == 0 {
+		add("  (no forwards)")
+	}
+
+	for len(lines) < height-2 {
+		lines = append(lines, "")
+	}
+	add(d.message)
+	add("↑/↓ select  c close  p pin  a auto-forward  l local-only  q quit")
+	return strings.Join(lines, "\n")
+}
+
+func (d *dashboard) header() string {
+	res := "mpf top"
+	if d.status != nil {
+		if d.status.Target != "" {
+			res += fmt.Sprintf("  %s (pid %d)", d.status.Target, d.status.PID)
+		} else {
+			res += fmt.Sprintf("  agent (pid %d)", d.status.PID)
+		}
+		if d.status.Sessions > 0 {
+			res += fmt.Sprintf("  %d session(s) over %s", d.status.Sessions, d.status.Transport)
+		} else {
+			res += "  no session"
+		}
+	}
+	if d.list != nil {
+		res += "  auto-forward " + onOff(d.list.AutoForward) + "  local-only " + onOff(d.list.LocalOnly)
+	}
+	if !d.updated.IsZero() {
+		res += "  " + d.updated.Format("15:04:05")
+	}
+	return res
+}
+
+func (d *dashboard) row(e protocol.ForwardEntry) string {
+	masterIP := ""
+	if d.list != nil {
+		masterIP = d.list.MasterIP
+	}
+	local := e.LocalAddr
+	if strings.HasPrefix(local, ":") {
+		local = masterIP + local
+	}
+
+	remote := strconv.Itoa(int(e.RemotePort))
+	if e.RemoteHost != "" && e.RemoteHost != "localhost" {
+		remote = net.JoinHostPort(e.RemoteHost, remote)
+	}
+	proto := e.Protocol
+	if proto == "" {
+		proto = protocol.ProtocolTCP
+	}
+	remote += "/" + proto
+
+	kind := "MANUAL"
+	switch {
+	case e.Dynamic:
+		kind, remote = "DYNAMIC", "*"
+	case e.Reverse:
+		kind = "REVERSE"
+	case proto == protocol.ProtocolUnix:
+		remote = "unix:" + e.RemotePath
+	case e.VHost != "":
+		kind = "HOST"
+	}
+	if e.IsAuto {
+		kind = "AUTO"
+	}
+
+	if e.Error != "" {
+		return fmt.Sprintf("%-12s %-24s %-24s %-8s ERROR: %s", e.Name, local, remote, kind, e.Error)
+	}
+	r := d.rates[entryKey(e)]
+	return fmt.Sprintf("%-12s %-24s %-24s %-8s %-9s %-11s %-11s %-11s %s",
+		e.Name, local, remote, kind,
+		fmt.Sprintf("%d/%d", e.Stats.ActiveConns, e.Stats.TotalConns),
+		formatBytes(uint64(r[0]))+"/s", formatBytes(uint64(r[1]))+"/s",
+		formatBytes(e.Stats.BytesIn), formatBytes(e.Stats.BytesOut))
+}
+
+// entryKey identifies a forward across refreshes.
+func entryKey(e protocol.ForwardEntry) string {
+	return fmt.Sprintf("%s|%s|%d|%t|%s", e.Protocol, e.LocalAddr, e.RemotePort, e.Reverse, e.VHost)
+}
+
+// localPort returns the port e listens on, or 0 for unix sockets and routes.
+func localPort(e protocol.ForwardEntry) int {
+	if e.VHost != "" {
+		return 0
+	}
+	_, port, err := net.SplitHostPort(e.LocalAddr)
+	if err != nil {
+		return 0
+	}
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+func truncate(s string, width int) string {
+	r := []rune(s)
+	if width > 0 && len(r) > width {
+		return string(r[:width])
+	}
+	return s
+}
+
+func pad(s string, width int) string {
+	if n := len([]rune(s)); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	return s
+}
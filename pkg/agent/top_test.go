@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liyu1981/moshpf/pkg/protocol"
+)
+
+func TestDashboardUpdate(t *testing.T) {
+	now := time.Now()
+	list := func(in, out uint64) *protocol.ListResponse {
+		return &protocol.ListResponse{
+			MasterIP:    "192.168.1.10",
+			AutoForward: true,
+			Entries: []protocol.ForwardEntry{
+				{LocalAddr: "127.0.0.1:9000", RemotePort: 9000, Protocol: protocol.ProtocolTCP, IsAuto: true},
+				{LocalAddr: "127.0.0.1:8080", RemotePort: 80, Protocol: protocol.ProtocolTCP, Name: "web",
+					Stats: protocol.ForwardStats{ActiveConns: 1, TotalConns: 2, BytesIn: in, BytesOut: out}},
+				{LocalAddr: "127.0.0.1:3000", RemotePort: 3000, Protocol: protocol.ProtocolTCP, Reverse: true},
+			},
+		}
+	}
+
+	d := newDashboard()
+	d.update(list(1000, 100), nil, now)
+	if got := []string{d.entries[0].LocalAddr, d.entries[1].LocalAddr, d.entries[2].LocalAddr}; !reflect.DeepEqual(got, []string{"127.0.0.1:8080", "127.0.0.1:9000", "127.0.0.1:3000"}) {
+		t.Errorf("Unexpected order: %v", got)
+	}
+	if d.selected != entryKey(d.entries[0]) {
+		t.Errorf("Expected the first forward to be selected")
+	}
+	if len(d.rates) != 0 {
+		t.Errorf("Expected no rates before the second refresh: %v", d.rates)
+	}
+
+	d.update(list(3048, 612), nil, now.Add(2*time.Second))
+	if got := d.rates[entryKey(d.entries[0])]; got != [2]float64{1024, 256} {
+		t.Errorf("Unexpected rates: %v", got)
+	}
+
+	d.handleKey("", keyDown)
+	if d.selectedIndex() != 1 {
+		t.Errorf("Expected the second forward to be selected, got %d", d.selectedIndex())
+	}
+	d.handleKey("", keyUp)
+	d.handleKey("", keyUp)
+	if d.selectedIndex() != 0 {
+		t.Errorf("Expected the first forward to be selected, got %d", d.selectedIndex())
+	}
+
+	out := d.render(120, 10)
+	if !strings.Contains(out, "> web") || !strings.Contains(out, "1.0 KiB/s") || !strings.Contains(out, "auto-forward on  local-only off") {
+		t.Errorf("Unexpected render:\n%s", out)
+	}
+	if n := len(strings.Split(out, "\n")); n != 10 {
+		t.Errorf("Expected 10 lines, got %d", n)
+	}
+}
+
+func TestDashboardCommands(t *testing.T) {
+	d := newDashboard()
+	d.update(&protocol.ListResponse{
+		LocalOnly: true,
+		Entries: []protocol.ForwardEntry{
+			{LocalAddr: "127.0.0.1:8080", RemotePort: 80, Protocol: protocol.ProtocolTCP},
+			{LocalAddr: "127.0.0.1:9000", RemotePort: 9000, Protocol: protocol.ProtocolTCP, IsAuto: true},
+		},
+	}, nil, time.Now())
+
+	tests := []struct {
+		key      string
+		down     bool
+		wantCmd  string
+		wantArgs []string
+		wantErr  bool
+	}{
+		{key: "c", wantCmd: protocol.CommandClose, wantArgs: []string{"8080"}},
+		{key: "p", wantErr: true},
+		{key: "p", down: true, wantCmd: protocol.CommandPin, wantArgs: []string{"9000"}},
+		{key: "a", wantCmd: protocol.CommandAutoForward, wantArgs: []string{"on"}},
+		{key: "l", wantCmd: protocol.CommandLocalOnly, wantArgs: []string{"off"}},
+		{key: "x"},
+	}
+	for _, tt := range tests {
+		d.selected = entryKey(d.entries[0])
+		if tt.down {
+			d.handleKey("", keyDown)
+		}
+		cmd, args, err := d.commandFor(tt.key)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("commandFor(%q) error = %v, wantErr %v", tt.key, err, tt.wantErr)
+			continue
+		}
+		if cmd != tt.wantCmd || !reflect.DeepEqual(args, tt.wantArgs) {
+			t.Errorf("commandFor(%q) = %s %v, want %s %v", tt.key, cmd, args, tt.wantCmd, tt.wantArgs)
+		}
+	}
+}
+
+func TestCloseArgs(t *testing.T) {
+	tests := []struct {
+		entry protocol.ForwardEntry
+		want  []string
+	}{
+		{protocol.ForwardEntry{LocalAddr: "127.0.0.1:8080", Protocol: protocol.ProtocolTCP}, []string{"8080"}},
+		{protocol.ForwardEntry{LocalAddr: "127.0.0.1:5353", Protocol: protocol.ProtocolUDP}, []string{"udp:5353"}},
+		{protocol.ForwardEntry{LocalAddr: "unix:/tmp/a.sock", Protocol: protocol.ProtocolUnix}, []string{"unix:/tmp/a.sock"}},
+		{protocol.ForwardEntry{LocalAddr: "127.0.0.1:8443", VHost: "app"}, []string{"--host", "app"}},
+		{protocol.ForwardEntry{LocalAddr: "127.0.0.1:3000", RemotePort: 3001, Reverse: true}, []string{"--reverse", "3001"}},
+		{protocol.ForwardEntry{LocalAddr: "bad"}, nil},
+	}
+	for _, tt := range tests {
+		if got := closeArgs(tt.entry); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("closeArgs(%+v) = %v, want %v", tt.entry, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/liyu1981/moshpf/pkg/protocol"
+	"github.com/liyu1981/moshpf/pkg/tunnel"
+	"github.com/liyu1981/moshpf/pkg/util"
+	"github.com/rs/zerolog/log"
+)
+
+// handleUDPStream serves a packet flow opened by the master: packets from the
+// flow are sent to the target and replies are sent back on the flow.
+func (a *Agent) handleUDPStream(s *tunnel.Session, stream io.ReadWriteCloser, header protocol.StreamHeader) {
+	target := net.JoinHostPort(header.Host, strconv.Itoa(int(header.Port)))
+	remoteConn, err := util.DialUDP(header.Host, header.Port)
+	if err != nil {
+		log.Error().Err(err).Str("target", target).Msg("Failed to dial UDP target")
+		_, _ = stream.Write([]byte{0}) // NAK
+		return
+	}
+	defer remoteConn.Close()
+
+	_, _ = stream.Write([]byte{1}) // ACK
+
+	flow := tunnel.NewPacketFlow(s, stream, header.FlowID, header.Datagrams)
+	defer flow.Close()
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, err := remoteConn.Read(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				// e.g. ICMP port unreachable; the service may come up later
+				continue
+			}
+			p := make([]byte, n)
+			copy(p, buf[:n])
+			if err := flow.WritePacket(p); err != nil {
+				flow.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		p, err := flow.ReadPacket()
+		if err != nil {
+			return
+		}
+		if _, err := remoteConn.Write(p); err != nil {
+			log.Debug().Err(err).Str("target", target).Msg("Failed to write UDP packet")
+		}
+	}
+}
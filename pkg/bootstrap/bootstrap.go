@@ -3,13 +3,17 @@ package bootstrap
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/liyu1981/moshpf/pkg/agent"
+	"github.com/liyu1981/moshpf/pkg/config"
 	"github.com/liyu1981/moshpf/pkg/constant"
 	"github.com/liyu1981/moshpf/pkg/forward"
 	"github.com/liyu1981/moshpf/pkg/logger"
@@ -61,11 +65,15 @@ const (
 	TransportModeTCP      TransportMode = "tcp"
 )
 
-func Run(args []string, remoteBinaryPath string, isDev bool, mode TransportMode, autoForward, noRestore, localOnly bool) error {
+// Run deploys and starts the agent on the remote as settings say, and runs
+// mosh while serving forwards.
+func Run(args []string, settings config.Settings, isDev bool, dynamic []string, vhostAddr string, remap *forward.RemapPolicy) error {
 	if len(args) < 1 {
 		return fmt.Errorf("usage: mpf mosh [user@]host")
 	}
 
+	mode := TransportMode(settings.Transport)
+
 	target := args[0]
 
 	stateMgr, err := state.NewManager()
@@ -100,7 +108,7 @@ func Run(args []string, remoteBinaryPath string, isDev bool, mode TransportMode,
 		return fmt.Errorf("failed to connect: %v", err)
 	}
 
-	remotePath, err := DeployAgent(client, remoteBinaryPath, isDev)
+	remotePath, err := DeployAgent(client, settings.RemotePath, isDev)
 	if err != nil {
 		client.Close()
 		return fmt.Errorf("failed to deploy agent: %v", err)
@@ -124,31 +132,84 @@ func Run(args []string, remoteBinaryPath string, isDev bool, mode TransportMode,
 		return err
 	}
 
-	fwd := forward.NewForwarder(nil, remoteHostname, stateMgr, target, localOnly)
+	fwd := forward.NewForwarder(nil, remoteHostname, stateMgr, target, settings.LocalOnly)
+	fwd.SetAutoForward(settings.AutoForward)
+	if remap != nil {
+		fwd.SetRemapPolicy(remap)
+	}
+	if stateMgr != nil {
+		fwd.RestoreRemaps(stateMgr.GetRemaps(target))
+		fwd.RestoreLabels(stateMgr.GetLabels(target))
+	}
+
+	for _, addr := range dynamic {
+		if err := fwd.ListenDynamic(addr); err != nil {
+			fmt.Printf("\033[33m⚠️  Failed to start dynamic forwarding on %s: %v\033[0m\r\n", addr, err)
+		}
+	}
+
+	if vhostAddr != "" {
+		if err := fwd.ListenVHost(vhostAddr); err != nil {
+			fmt.Printf("\033[33m⚠️  Failed to start host routing on %s: %v\033[0m\r\n", vhostAddr, err)
+		}
+	}
+
+	if stopControl, err := serveControl(target, fwd); err != nil {
+		log.Warn().Err(err).Msg("Failed to start master control socket")
+	} else {
+		defer stopControl()
+	}
 
 	// Start the session for port forwarding
 	if shouldStartAgent {
 		go func() {
 			// Initial restore from state
-			if stateMgr != nil && !noRestore {
+			if stateMgr != nil && settings.Restore {
 				for mStr, sStr := range stateMgr.GetForwards(target) {
+					sHost, sPort, err := state.ParseTarget(sStr)
+					if err == nil {
+						_ = fwd.ListenAndForward(state.ParseLocal(mStr), sHost, sPort, false)
+					}
+				}
+				for mStr, sStr := range stateMgr.GetUDPForwards(target) {
+					sHost, sPort, err := state.ParseTarget(sStr)
+					if err == nil {
+						_ = fwd.ListenUDPAndForward(state.ParseLocal(mStr), sHost, sPort, false)
+					}
+				}
+				for local, path := range stateMgr.GetUnixForwards(target) {
+					if !strings.HasPrefix(local, "unix:") {
+						local = state.ParseLocal(local)
+					}
+					_ = fwd.ListenUnixAndForward(local, path)
+				}
+				for _, mStr := range stateMgr.GetDynamics(target) {
+					_ = fwd.ListenDynamic(state.ParseLocal(mStr))
+				}
+				for name, sStr := range stateMgr.GetRoutes(target) {
+					sHost, sPort, err := state.ParseTarget(sStr)
+					if err == nil {
+						_ = fwd.AddRoute(name, sHost, sPort, false)
+					}
+				}
+				for sStr, mStr := range stateMgr.GetReverses(target) {
 					var mPort, sPort uint16
 					fmt.Sscanf(mStr, "%d", &mPort)
 					fmt.Sscanf(sStr, "%d", &sPort)
 					if mPort > 0 && sPort > 0 {
-						_ = fwd.ListenAndForward(fmt.Sprintf(":%d", mPort), "localhost", sPort, false)
+						_ = fwd.AddReverse(sPort, "localhost", mPort)
 					}
 				}
 			}
 			// Initial session using the already established client
-			err := runSessionWithClient(client, remotePath, target, fwd, mode, autoForward)
+			err := runSessionWithClient(client, remotePath, settings, target, fwd, mode)
 			if err != nil {
 				log.Error().Err(err).Msg("Initial session failed, reconnecting...")
 			}
 
 			backoff := 1 * time.Second
 			for {
-				err := runSession(target, remoteBinaryPath, isDev, fwd, mode, autoForward)
+				err := runSession(target, settings, isDev, fwd, mode)
 				if err != nil {
 					log.Error().Err(err).Msg("Session failed, reconnecting...")
 					time.Sleep(backoff)
@@ -182,13 +243,21 @@ func checkRemoteConflict(client *ssh.Client, remotePath string) (bool, error) {
 	session.Stderr = &stderr
 
 	// Probe with "list"
-	_ = session.Run(fmt.Sprintf("./%s list", remotePath))
-	out := stdout.String()
+	_ = session.Run(fmt.Sprintf("./%s --json list", remotePath))
+	var resp protocol.ControlResponse
+	if err := json.Unmarshal([]byte(stdout.String()), &resp); err != nil {
+		// No agent or other error, assume we can start one
+		return true, nil
+	}
 
-	if strings.Contains(out, "Session:") {
+	if resp.Success {
 		// Active conflict
 		fmt.Printf("\r\n\033[33m⚠️  An active moshpf agent is already running for this user.\033[0m\r\n")
-		fmt.Printf("Existing Forwardings:\r\n%s\r\n", out)
+		existing := resp.Message
+		if resp.List != nil {
+			existing = agent.FormatList(resp.List, resp.Status, time.Now())
+		}
+		fmt.Printf("Existing Forwardings:\r\n%s\r\n", strings.ReplaceAll(existing, "\n", "\r\n"))
 		fmt.Printf("\033[33m⚠️  Note: If you continue, mpf agent will not start and there is no auto port forwarding.\033[0m\r\n")
 
 		options := []string{
@@ -207,7 +276,7 @@ func checkRemoteConflict(client *ssh.Client, remotePath string) (bool, error) {
 			return false, nil
 		}
 		os.Exit(0)
-	} else if strings.Contains(out, "ERROR: No active session") {
+	} else if resp.Error != nil && resp.Error.Code == protocol.CodeNoSession {
 		// Idle agent - stop it
 		fmt.Printf("\r\n\033[33m⚠️  An idle moshpf agent is already running. Restarting it...\033[0m\r\n")
 		sStop, err := client.NewSession()
@@ -224,21 +293,21 @@ func checkRemoteConflict(client *ssh.Client, remotePath string) (bool, error) {
 	return true, nil
 }
 
-func runSession(target string, remoteBinaryPath string, isDev bool, fwd *forward.Forwarder, mode TransportMode, autoForward bool) error {
+func runSession(target string, settings config.Settings, isDev bool, fwd *forward.Forwarder, mode TransportMode) error {
 	client, err := Connect(target)
 	if err != nil {
 		return fmt.Errorf("failed to connect: %v", err)
 	}
 	defer client.Close()
 
-	remotePath, err := DeployAgent(client, remoteBinaryPath, isDev)
+	remotePath, err := DeployAgent(client, settings.RemotePath, isDev)
 	if err != nil {
 		return fmt.Errorf("failed to deploy agent: %v", err)
 	}
-	return runSessionWithClient(client, remotePath, target, fwd, mode, autoForward)
+	return runSessionWithClient(client, remotePath, settings, target, fwd, mode)
 }
 
-func runSessionWithClient(client *ssh.Client, remotePath, target string, fwd *forward.Forwarder, mode TransportMode, autoForward bool) error {
+func runSessionWithClient(client *ssh.Client, remotePath string, settings config.Settings, target string, fwd *forward.Forwarder, mode TransportMode) error {
 	session, err := client.NewSession()
 	if err != nil {
 		return err
@@ -266,6 +335,9 @@ func runSessionWithClient(client *ssh.Client, remotePath, target string, fwd *fo
 	}()
 
 	agentCmd := fmt.Sprintf("./%s agent", remotePath)
+	for _, arg := range settings.AgentArgs() {
+		agentCmd += " " + shellQuote(arg)
+	}
 	if util.IsDev() {
 		if err := session.Setenv("APP_ENV", "dev"); err != nil {
 			log.Error().Msgf("Set APP_ENV=dev for remote failed: %s", err.Error())
@@ -287,7 +359,8 @@ func runSessionWithClient(client *ssh.Client, remotePath, target string, fwd *fo
 
 	if err := tSession.Send(protocol.Hello{
 		Version:     constant.Version,
-		AutoForward: autoForward,
+		AutoForward: fwd.AutoForward(),
+		Rules:       settings.Rules,
 	}); err != nil {
 		return err
 	}
@@ -304,8 +377,14 @@ func runSessionWithClient(client *ssh.Client, remotePath, target string, fwd *fo
 
 	log.Info().Msg("Tunnel established")
 
+	fwd.SyncReverses(tSession)
+	for _, req := range fwd.ProbeTargets() {
+		_ = tSession.Send(req)
+	}
+
 	errChan := make(chan error, 1)
 	remoteHostname := fwd.GetRemoteName()
+	notify := newNotifier(settings, remoteHostname)
 
 	var startControlLoop func(s *tunnel.Session)
 	startControlLoop = func(s *tunnel.Session) {
@@ -325,11 +404,13 @@ func runSessionWithClient(client *ssh.Client, remotePath, target string, fwd *fo
 
 				log.Debug().Type("type", msg).Msg("Master received message")
 
-				if stop := handleMasterMessage(s, msg, fwd, remoteHostname, errChan); stop {
+				if stop := handleMasterMessage(s, msg, fwd, remoteHostname, notify, errChan); stop {
 					return
 				}
 			}
 		}()
+
+		go fwd.ServeStreams(s)
 	}
 
 	startControlLoop(tSession)
@@ -351,48 +432,62 @@ func runSessionWithClient(client *ssh.Client, remotePath, target string, fwd *fo
 	return <-errChan
 }
 
-func handleMasterMessage(s *tunnel.Session, msg protocol.Message, fwd *forward.Forwarder, remoteHostname string, errChan chan error) bool {
+func handleMasterMessage(s *tunnel.Session, msg protocol.Message, fwd *forward.Forwarder, remoteHostname string, notify *notifier, errChan chan error) bool {
 	switch m := msg.(type) {
 	case protocol.Heartbeat:
 		_ = s.Send(protocol.HeartbeatAck{})
 	case protocol.HeartbeatAck:
 		// OK
 	case protocol.ListenRequest:
-		log.Info().
-			Str("local", m.LocalAddr).
-			Str("remote", fmt.Sprintf("%s:%d", remoteHostname, m.RemotePort)).
-			Bool("auto", m.IsAuto).
-			Msg("Dynamic listen request received")
-		err := fwd.ListenAndForward(m.LocalAddr, m.RemoteHost, m.RemotePort, m.IsAuto)
-		resp := protocol.ListenResponse{
-			RemotePort: m.RemotePort,
-			Success:    err == nil,
+		_ = s.Send(handleListenRequest(m, fwd, remoteHostname, notify))
+	case protocol.ListenBatchRequest:
+		resp := protocol.ListenBatchResponse{
+			ID:        m.ID,
+			Responses: make([]protocol.ListenResponse, 0, len(m.Requests)),
 		}
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to handle dynamic listen request")
-			resp.Reason = err.Error()
+		for _, req := range m.Requests {
+			resp.Responses = append(resp.Responses, handleListenRequest(req, fwd, remoteHostname, notify))
 		}
 		_ = s.Send(resp)
+	case protocol.ListenResponse:
+		fwd.HandleListenResponse(m)
+	case protocol.ReverseRequest:
+		go func() {
+			_ = s.Send(handleReverseRequest(m, fwd, remoteHostname))
+		}()
 	case protocol.ListRequest:
-		entries := fwd.GetForwardEntries()
-		masterIP := fwd.GetMasterIP()
-		err := s.Send(protocol.ListResponse{
-			Entries:  entries,
-			MasterIP: masterIP,
-		})
-		if err != nil {
+		if err := s.Send(fwd.GetList()); err != nil {
 			log.Error().Err(err).Msg("Master failed to send ListResponse")
 		}
+	case protocol.PinRequest:
+		_ = s.Send(handlePinRequest(m, fwd))
+	case protocol.ProbeResult:
+		log.Debug().Str("host", m.Host).Uint16("port", m.Port).Str("service", m.Service).Msg("Forwarded port probed")
+		fwd.SetService(m)
+		notify.probed(m)
+	case protocol.AutoForwardState:
+		log.Info().Bool("enabled", m.Enabled).Msg("Agent switched auto forwarding")
+		fwd.SetAutoForward(m.Enabled)
+	case protocol.LocalOnlyRequest:
+		fwd.SetLocalOnly(m.Enabled)
 	case protocol.CloseRequest:
-		log.Info().
-			Str("remote", remoteHostname).
-			Uint16("port", m.Port).
-			Msg("Close request received")
-		success := fwd.CloseForward(m.Port)
-		_ = s.Send(protocol.CloseResponse{
-			Port:    m.Port,
-			Success: success,
-		})
+		resp := handleCloseRequest(m, fwd, remoteHostname)
+		// The auto forwarder does not wait for an answer
+		if !m.IsAuto {
+			_ = s.Send(resp)
+		}
+	case protocol.CloseBatchRequest:
+		resp := protocol.CloseBatchResponse{
+			ID:        m.ID,
+			Responses: make([]protocol.CloseResponse, 0, len(m.Requests)),
+		}
+		for _, req := range m.Requests {
+			resp.Responses = append(resp.Responses, handleCloseRequest(req, fwd, remoteHostname))
+		}
+		_ = s.Send(resp)
+	case protocol.CloseResponse:
+		// Agent confirming a reverse forward was closed
+		log.Debug().Uint16("port", m.Port).Bool("success", m.Success).Msg("Agent closed reverse forward")
 	case protocol.Shutdown:
 		errChan <- nil
 		return true
@@ -400,6 +495,84 @@ func handleMasterMessage(s *tunnel.Session, msg protocol.Message, fwd *forward.F
 	return false
 }
 
+func handleListenRequest(m protocol.ListenRequest, fwd *forward.Forwarder, remoteHostname string, notify *notifier) protocol.ListenResponse {
+	log.Info().
+		Str("local", m.LocalAddr).
+		Str("remote", fmt.Sprintf("%s:%d", remoteHostname, m.RemotePort)).
+		Str("protocol", m.Protocol).
+		Bool("auto", m.IsAuto).
+		Msg("Dynamic listen request received")
+	err := fwd.HandleListenRequest(m)
+	resp := protocol.ListenResponse{
+		RemotePort: m.RemotePort,
+		Success:    err == nil,
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to handle dynamic listen request")
+		resp.Reason = err.Error()
+	} else if m.VHost != "" {
+		resp.LocalAddr = fwd.RouteAddr(m.VHost)
+	} else if _, portStr, err := net.SplitHostPort(m.LocalAddr); err == nil && m.Protocol != protocol.ProtocolUDP {
+		port, _ := strconv.ParseUint(portStr, 10, 16)
+		resp.LocalPort = fwd.ActualPort(uint16(port))
+	}
+	sendEvent(fwd, listenEvent(m, resp))
+	if resp.Success && m.VHost == "" && (m.Protocol == "" || m.Protocol == protocol.ProtocolTCP) {
+		sendProbe(fwd, m.RemoteHost, m.RemotePort)
+	}
+	notify.forwardStarted(m, resp)
+	return resp
+}
+
+func handleReverseRequest(m protocol.ReverseRequest, fwd *forward.Forwarder, remoteHostname string) protocol.ReverseResponse {
+	log.Info().
+		Uint16("master", m.MasterPort).
+		Str("remote", fmt.Sprintf("%s:%d", remoteHostname, m.RemotePort)).
+		Msg("Reverse forward request received")
+	err := fwd.ListenReverse(m.RemotePort, m.MasterPort)
+	resp := protocol.ReverseResponse{
+		ID:         m.ID,
+		RemotePort: m.RemotePort,
+		Success:    err == nil,
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to handle reverse forward request")
+		resp.Reason = err.Error()
+	}
+	return resp
+}
+
+func handleCloseRequest(m protocol.CloseRequest, fwd *forward.Forwarder, remoteHostname string) protocol.CloseResponse {
+	log.Info().
+		Str("remote", remoteHostname).
+		Uint16("port", m.Port).
+		Str("host", m.VHost).
+		Bool("reverse", m.Reverse).
+		Msg("Close request received")
+	before := fwd.GetForwardEntries()
+	resp := protocol.CloseResponse{
+		ID:      m.ID,
+		Port:    m.Port,
+		Success: fwd.HandleCloseRequest(m),
+	}
+	if !resp.Success {
+		resp.Reason = "no active forward"
+	}
+	for _, ev := range stoppedEvents(before, fwd.GetForwardEntries()) {
+		sendEvent(fwd, ev)
+	}
+	return resp
+}
+
+func handlePinRequest(m protocol.PinRequest, fwd *forward.Forwarder) protocol.PinResponse {
+	resp := protocol.PinResponse{ID: m.ID, Port: m.Port, Success: true}
+	if err := fwd.Pin(m.Port); err != nil {
+		resp.Success = false
+		resp.Reason = err.Error()
+	}
+	return resp
+}
+
 func attemptQUICUpgrade(target string, ack protocol.HelloAck, fwd *forward.Forwarder, mode TransportMode, startControl func(*tunnel.Session), tSession *tunnel.Session) error {
 	remoteHost := target
 	if i := strings.Index(remoteHost, "@"); i != -1 {
@@ -415,7 +588,8 @@ func attemptQUICUpgrade(target string, ack protocol.HelloAck, fwd *forward.Forwa
 	defer cancel()
 
 	quicConfig := &quic.Config{
-		Tracer: logger.GetQuicTracer(),
+		Tracer:          logger.GetQuicTracer(),
+		EnableDatagrams: true,
 	}
 
 	qConn, err := quic.DialAddr(ctx, fmt.Sprintf("%s:%d", remoteHost, ack.UDPPort), tlsConf, quicConfig)
@@ -434,6 +608,10 @@ func attemptQUICUpgrade(target string, ack protocol.HelloAck, fwd *forward.Forwa
 	log.Info().Msg("QUIC upgrade successful")
 	startControl(qSession)
 
+	ev := protocol.NewEvent(protocol.EventTransportSwitched, "Transport switched from TCP to QUIC")
+	ev.Transport = qSession.Mux.Type()
+	_ = qSession.Send(ev)
+
 	if mode == TransportModeQUIC {
 		log.Info().Msg("QUIC-only mode: closing TCP tunnel")
 		fwd.RemoveSession(tSession)
@@ -0,0 +1,207 @@
+package bootstrap
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/liyu1981/moshpf/pkg/constant"
+	"github.com/liyu1981/moshpf/pkg/forward"
+	"github.com/liyu1981/moshpf/pkg/protocol"
+	"github.com/liyu1981/moshpf/pkg/state"
+	"github.com/rs/zerolog/log"
+)
+
+// serveControl listens on the master control socket of target so that
+// `mpf --session <target> ...` and `mpf local ...` can manage forwards from this
+// machine, and registers the session for `mpf status`. The returned func
+// undoes both.
+func serveControl(target string, fwd *forward.Forwarder) (func(), error) {
+	sockPath := protocol.GetMasterSocketPath(target)
+
+	// Another master for the same target keeps its socket, this one is
+	// registered without.
+	if conn, err := net.DialTimeout("unix", sockPath, time.Second); err == nil {
+		conn.Close()
+		log.Warn().Str("path", sockPath).Msg("Master control socket already in use")
+		return registerSession(target, ""), nil
+	}
+	_ = os.Remove(sockPath)
+
+	ln, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Str("path", sockPath).Msg("Listening for local CLI requests")
+
+	unregister := registerSession(target, sockPath)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleControlConn(conn, target, fwd)
+		}
+	}()
+
+	return func() {
+		unregister()
+		ln.Close()
+		_ = os.Remove(sockPath)
+	}, nil
+}
+
+// registerSession records the session for `mpf status`, returning the func
+// that removes the record.
+func registerSession(target, sockPath string) func() {
+	unregister, err := state.Register(target, sockPath)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to register session")
+		return func() {}
+	}
+	return unregister
+}
+
+func handleControlConn(conn net.Conn, target string, fwd *forward.Forwarder) {
+	defer conn.Close()
+
+	req, err := protocol.ReadControlRequest(conn)
+	if err != nil {
+		_ = protocol.WriteControlResponse(conn, protocol.NewControlError(protocol.CodeBadRequest, "malformed request: %v", err))
+		return
+	}
+	_ = protocol.WriteControlResponse(conn, handleControl(req, target, fwd))
+}
+
+// handleControl runs a CLI request against the local Forwarder, the way the
+// agent runs it through the master.
+func handleControl(req protocol.ControlRequest, target string, fwd *forward.Forwarder) protocol.ControlResponse {
+	if req.Version != protocol.ControlVersion {
+		return protocol.NewControlError(protocol.CodeUnsupportedVersion,
+			"unsupported control protocol version %d, master speaks %d", req.Version, protocol.ControlVersion)
+	}
+
+	remoteHostname := fwd.GetRemoteName()
+
+	switch req.Command {
+	case protocol.CommandStatus:
+		return protocol.ControlResponse{Success: true, Status: masterStatus(target, fwd)}
+	case protocol.CommandList:
+		list := fwd.GetList()
+		return protocol.ControlResponse{Success: true, List: &list, Status: masterStatus(target, fwd)}
+	case protocol.CommandForward:
+		reqs, err := protocol.ParseForwardArgs(req.Args)
+		if err != nil {
+			return protocol.NewControlError(protocol.CodeInvalidArgument, "%v", err)
+		}
+		resps := make([]protocol.ListenResponse, 0, len(reqs))
+		for _, r := range reqs {
+			resps = append(resps, handleListenRequest(r, fwd, remoteHostname, nil))
+		}
+		return protocol.NewForwardResponse(reqs, resps)
+	case protocol.CommandClose:
+		var reqs []protocol.CloseRequest
+		if len(req.Args) > 0 && (req.Args[0] == "--reverse" || req.Args[0] == "-R") {
+			port, err := strconv.ParseUint(argAt(req.Args, 1), 10, 16)
+			if err != nil || len(req.Args) != 2 {
+				return protocol.NewControlError(protocol.CodeInvalidArgument, "close --reverse takes a single port")
+			}
+			reqs = []protocol.CloseRequest{{Port: uint16(port), Reverse: true}}
+		} else {
+			var err error
+			if reqs, err = protocol.ParseCloseArgs(req.Args); err != nil {
+				return protocol.NewControlError(protocol.CodeInvalidArgument, "%v", err)
+			}
+		}
+		resps := make([]protocol.CloseResponse, 0, len(reqs))
+		for _, r := range reqs {
+			resps = append(resps, handleCloseRequest(r, fwd, remoteHostname))
+		}
+		return protocol.NewCloseResponse(reqs, resps)
+	case protocol.CommandReverse:
+		if len(req.Args) != 1 {
+			return protocol.NewControlError(protocol.CodeInvalidArgument, "reverse takes a single <masterPort>[:<remotePort>]")
+		}
+		masterPort, remotePort, err := parseReverseArg(req.Args[0])
+		if err != nil {
+			return protocol.NewControlError(protocol.CodeInvalidArgument, "Invalid port mapping")
+		}
+		resp := handleReverseRequest(protocol.ReverseRequest{MasterPort: masterPort, RemotePort: remotePort}, fwd, remoteHostname)
+		if !resp.Success {
+			return protocol.NewControlError(protocol.CodeRejected, "Failed to start reverse forwarding: %s", resp.Reason)
+		}
+		return protocol.ControlResponse{
+			Success: true,
+			Message: fmt.Sprintf("Reverse forwarding started: slave %d -> master %d", remotePort, masterPort),
+		}
+	case protocol.CommandPin:
+		port, err := parsePort(argAt(req.Args, 0))
+		if err != nil || len(req.Args) != 1 {
+			return protocol.NewControlError(protocol.CodeInvalidArgument, "pin takes a single port")
+		}
+		return protocol.NewPinResponse(handlePinRequest(protocol.PinRequest{Port: port}, fwd))
+	case protocol.CommandAutoForward:
+		enabled, err := protocol.ParseSwitchArg(req.Args)
+		if err != nil {
+			return protocol.NewControlError(protocol.CodeInvalidArgument, "auto: %v", err)
+		}
+		fwd.SetAutoForward(enabled)
+		if s := fwd.GetSessions().GetBest(); s != nil {
+			if err := s.Send(protocol.AutoForwardState{Enabled: enabled}); err != nil {
+				return protocol.NewControlError(protocol.CodeSendFailed, "Failed to switch auto forwarding")
+			}
+		}
+		return protocol.NewSwitchResponse("Auto forwarding", enabled)
+	case protocol.CommandLocalOnly:
+		enabled, err := protocol.ParseSwitchArg(req.Args)
+		if err != nil {
+			return protocol.NewControlError(protocol.CodeInvalidArgument, "local-only: %v", err)
+		}
+		fwd.SetLocalOnly(enabled)
+		return protocol.NewSwitchResponse("Local-only binding", enabled)
+	default:
+		return protocol.NewControlError(protocol.CodeUnknownCommand, "unknown command for the local master: %s", req.Command)
+	}
+}
+
+func masterStatus(target string, fwd *forward.Forwarder) *protocol.AgentStatus {
+	st := &protocol.AgentStatus{
+		Target:    target,
+		Version:   constant.Version,
+		PID:       os.Getpid(),
+		Sessions:  fwd.GetSessions().Count(),
+		MasterIPs: fwd.GetMasterIPs(),
+		Forwards:  len(fwd.GetForwardEntries()),
+	}
+	if s := fwd.GetSessions().GetBest(); s != nil {
+		st.Transport = s.Mux.Type()
+	}
+	return st
+}
+
+// parseReverseArg parses "<masterPort>[:<remotePort>]".
+func parseReverseArg(arg string) (masterPort, remotePort uint16, err error) {
+	m, r, found := strings.Cut(arg, ":")
+	if masterPort, err = parsePort(m); err != nil || masterPort == 0 {
+		return 0, 0, fmt.Errorf("invalid port mapping: %s", arg)
+	}
+	remotePort = masterPort
+	if found {
+		if remotePort, err = parsePort(r); err != nil || remotePort == 0 {
+			return 0, 0, fmt.Errorf("invalid port mapping: %s", arg)
+		}
+	}
+	return masterPort, remotePort, nil
+}
+
+func argAt(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+}
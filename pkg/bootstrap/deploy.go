@@ -180,3 +180,8 @@ func uploadBinary(client *ssh.Client, remotePath string) error {
 
 	return nil
 }
+
+// shellQuote quotes s for the remote shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,120 @@
+package bootstrap
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/liyu1981/moshpf/pkg/forward"
+	"github.com/liyu1981/moshpf/pkg/protocol"
+	"github.com/rs/zerolog/log"
+)
+
+// sendEvent pushes ev to the agent for `mpf watch`.
+func sendEvent(fwd *forward.Forwarder, ev protocol.Event) {
+	s := fwd.GetSessions().GetBest()
+	if s == nil {
+		return
+	}
+	if err := s.Send(ev); err != nil {
+		log.Debug().Err(err).Str("type", ev.Type).Msg("Failed to send event")
+	}
+}
+
+// sendProbe asks the agent what listens on the remote end of a new TCP
+// forward, answered with a ProbeResult.
+func sendProbe(fwd *forward.Forwarder, host string, port uint16) {
+	s := fwd.GetSessions().GetBest()
+	if s == nil {
+		return
+	}
+	if err := s.Send(protocol.ProbeRequest{Host: host, Port: port}); err != nil {
+		log.Debug().Err(err).Uint16("port", port).Msg("Failed to send probe request")
+	}
+}
+
+// listenEvent describes the outcome of a ListenRequest.
+func listenEvent(m protocol.ListenRequest, resp protocol.ListenResponse) protocol.Event {
+	entry := protocol.ForwardEntry{
+		LocalAddr:  m.LocalAddr,
+		RemoteHost: m.RemoteHost,
+		RemotePort: m.RemotePort,
+		RemotePath: m.RemotePath,
+		Protocol:   m.Protocol,
+		IsAuto:     m.IsAuto,
+		VHost:      m.VHost,
+		Name:       m.Name,
+	}
+	if resp.LocalAddr != "" {
+		entry.LocalAddr = resp.LocalAddr
+	} else if host, port, err := net.SplitHostPort(m.LocalAddr); err == nil && resp.LocalPort != 0 && port != strconv.Itoa(int(resp.LocalPort)) {
+		entry.LocalAddr = net.JoinHostPort(host, strconv.Itoa(int(resp.LocalPort)))
+		entry.RemappedFrom, _ = parsePort(port)
+	}
+
+	kind := "Forward"
+	if m.IsAuto {
+		kind = "Auto forward"
+	}
+
+	var ev protocol.Event
+	if resp.Success {
+		ev = protocol.NewEvent(protocol.EventForwardStarted, "%s started: %s -> %s", kind, describeRemote(entry), entry.LocalAddr)
+	} else {
+		entry.Error = resp.Reason
+		ev = protocol.NewEvent(protocol.EventListenFailed, "%s failed: %s -> %s: %s", kind, describeRemote(entry), entry.LocalAddr, resp.Reason)
+	}
+	ev.Forward = &entry
+	return ev
+}
+
+// stoppedEvents reports the forwards in before that are gone from after.
+func stoppedEvents(before, after []protocol.ForwardEntry) []protocol.Event {
+	left := make(map[protocol.ForwardEntry]int)
+	for _, e := range after {
+		e.Stats = protocol.ForwardStats{}
+		left[e]++
+	}
+
+	var events []protocol.Event
+	for _, e := range before {
+		e.Stats = protocol.ForwardStats{}
+		if left[e] > 0 {
+			left[e]--
+			continue
+		}
+		kind := "Forward"
+		if e.IsAuto {
+			kind = "Auto forward"
+		}
+		if e.Reverse {
+			kind = "Reverse forward"
+		}
+		entry := e
+		ev := protocol.NewEvent(protocol.EventForwardStopped, "%s stopped: %s -> %s", kind, describeRemote(e), e.LocalAddr)
+		ev.Forward = &entry
+		events = append(events, ev)
+	}
+	return events
+}
+
+func describeRemote(e protocol.ForwardEntry) string {
+	proto := e.Protocol
+	if proto == "" {
+		proto = protocol.ProtocolTCP
+	}
+	switch {
+	case e.Dynamic:
+		return "*"
+	case proto == protocol.ProtocolUnix:
+		return "unix:" + e.RemotePath
+	case e.RemoteHost != "" && e.RemoteHost != "localhost":
+		return net.JoinHostPort(e.RemoteHost, strconv.Itoa(int(e.RemotePort))) + "/" + proto
+	default:
+		return strconv.Itoa(int(e.RemotePort)) + "/" + proto
+	}
+}
+
+func parsePort(s string) (uint16, error) {
+	p, err := strconv.ParseUint(s, 10, 16)
+	return uint16(p), err
+}
@@ -0,0 +1,216 @@
+package bootstrap
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/liyu1981/moshpf/pkg/config"
+	"github.com/liyu1981/moshpf/pkg/constant"
+	"github.com/liyu1981/moshpf/pkg/forward"
+	"github.com/liyu1981/moshpf/pkg/protocol"
+	"github.com/rs/zerolog/log"
+)
+
+// notifier tells the user on the master about new auto forwards, as the
+// Notify and NotifyCommand settings say. Port forwards are announced once
+// the agent probed what listens on them, to give the right URL.
+type notifier struct {
+	kinds   []string
+	command string
+	remote  string
+	// term receives the OSC sequences, logPath the event log lines.
+	term    io.Writer
+	logPath string
+
+	mu      sync.Mutex
+	pending map[protocol.ProbeRequest]*notice
+}
+
+// notice is a new auto forward waiting for its probe.
+type notice struct {
+	m     protocol.ListenRequest
+	addr  string
+	timer *time.Timer
+}
+
+func newNotifier(settings config.Settings, remote string) *notifier {
+	n := &notifier{
+		kinds:   settings.Notify,
+		command: settings.NotifyCommand,
+		remote:  remote,
+		term:    os.Stdout,
+		pending: make(map[protocol.ProbeRequest]*notice),
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		n.logPath = filepath.Join(home, ".mpf", "events.log")
+	}
+	return n
+}
+
+// forwardAddr returns the master address a started TCP auto forward is
+// reachable at, or "" for forwards not worth a notice.
+func forwardAddr(m protocol.ListenRequest, resp protocol.ListenResponse) string {
+	if !resp.Success || !m.IsAuto || m.Silent || (m.Protocol != "" && m.Protocol != protocol.ProtocolTCP) {
+		return ""
+	}
+	if resp.LocalAddr != "" {
+		return resp.LocalAddr
+	}
+
+	host, port, err := net.SplitHostPort(m.LocalAddr)
+	if err != nil {
+		return ""
+	}
+	if resp.LocalPort != 0 {
+		port = strconv.Itoa(int(resp.LocalPort))
+	}
+	return forward.BrowseAddr(net.JoinHostPort(host, port))
+}
+
+// forwardStarted notifies about the auto forward a ListenRequest started,
+// right away for host routes and else when probed is called for it or
+// constant.ProbeWait passed. A nil *notifier notifies nothing.
+func (n *notifier) forwardStarted(m protocol.ListenRequest, resp protocol.ListenResponse) {
+	addr := forwardAddr(m, resp)
+	if n == nil || addr == "" {
+		return
+	}
+	if m.VHost != "" {
+		n.send(m, addr, protocol.ServiceHTTP, "")
+		return
+	}
+
+	key := protocol.ProbeRequest{Host: m.RemoteHost, Port: m.RemotePort}
+	nt := &notice{m: m, addr: addr}
+	n.mu.Lock()
+	if old, ok := n.pending[key]; ok {
+		old.timer.Stop()
+	}
+	n.pending[key] = nt
+	nt.timer = time.AfterFunc(constant.ProbeWait, func() {
+		if n.take(key, nt) {
+			n.send(m, addr, "", "")
+		}
+	})
+	n.mu.Unlock()
+}
+
+// probed sends the notice waiting for the probe r.
+func (n *notifier) probed(r protocol.ProbeResult) {
+	if n == nil {
+		return
+	}
+	key := protocol.ProbeRequest{Host: r.Host, Port: r.Port}
+	n.mu.Lock()
+	nt, ok := n.pending[key]
+	n.mu.Unlock()
+	if ok && n.take(key, nt) {
+		nt.timer.Stop()
+		n.send(nt.m, nt.addr, r.Service, r.Title)
+	}
+}
+
+// take removes nt from the pending notices, reporting whether it was still
+// there.
+func (n *notifier) take(key protocol.ProbeRequest, nt *notice) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.pending[key] != nt {
+		return false
+	}
+	delete(n.pending, key)
+	return true
+}
+
+// send tells about the forward to addr of m, a URL for web services.
+func (n *notifier) send(m protocol.ListenRequest, addr, service, title string) {
+	url := protocol.ServiceURL(service, addr)
+	where := url
+	if url == "" {
+		where = addr
+		if service != "" {
+			where += " (" + service + ")"
+		}
+	}
+
+	name := m.Name
+	if name == "" {
+		name = "Port"
+	}
+	msg := fmt.Sprintf("%s (%d) available at %s", name, m.RemotePort, where)
+	if title != "" {
+		msg += ": " + title
+	}
+	header := "mpf: " + n.remote
+
+	for _, kind := range n.kinds {
+		switch kind {
+		case config.NotifyOSC9:
+			_, _ = fmt.Fprintf(n.term, "\033]9;%s\a", oscText(header+": "+msg))
+		case config.NotifyOSC777:
+			_, _ = fmt.Fprintf(n.term, "\033]777;notify;%s;%s\a", oscText(header), oscText(msg))
+		case config.NotifyLog:
+			n.appendLog(msg)
+		}
+	}
+	if n.command != "" {
+		n.runCommand(header, msg, url, service, title, m)
+	}
+}
+
+// appendLog adds msg to ~/.mpf/events.log.
+func (n *notifier) appendLog(msg string) {
+	if n.logPath == "" {
+		return
+	}
+	file, err := os.OpenFile(n.logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to open event log")
+		return
+	}
+	defer file.Close()
+	_, _ = fmt.Fprintf(file, "%s %s %s\n", time.Now().Format(time.RFC3339), n.remote, msg)
+}
+
+// runCommand runs NotifyCommand through the shell with the notice in its
+// environment, without waiting for it.
+func (n *notifier) runCommand(header, msg, url, service, title string, m protocol.ListenRequest) {
+	cmd := exec.Command("sh", "-c", n.command)
+	cmd.Env = append(os.Environ(),
+		"MPF_TITLE="+header,
+		"MPF_MESSAGE="+msg,
+		"MPF_URL="+url,
+		"MPF_SERVICE="+service,
+		"MPF_PAGE_TITLE="+title,
+		"MPF_REMOTE="+n.remote,
+		"MPF_PORT="+strconv.Itoa(int(m.RemotePort)),
+		"MPF_LABEL="+m.Name,
+	)
+	if err := cmd.Start(); err != nil {
+		log.Warn().Err(err).Msg("Failed to run notify command")
+		return
+	}
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.Warn().Err(err).Msg("Notify command failed")
+		}
+	}()
+}
+
+// oscText drops what would end or split an OSC sequence.
+func oscText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f || r == ';' {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,518 @@
+// Package config reads ~/.mpf/config, which sets defaults for `mpf mosh`
+// globally and per remote, in the style of ssh_config:
+//
+//	# applies to every remote
+//	Transport tcp
+//
+//	Host dev-* user@build.example.com
+//	    LocalOnly yes
+//	    QUICPorts 61000-61100
+//
+// Keywords are case-insensitive and take their value after a space or "=".
+// Settings before the first Host block are the defaults; a Host block
+// matching the remote overrides them, and when several blocks match, the
+// first one setting a keyword wins. AutoForwardRule is the exception: it may
+// be repeated, and the rules of matching Host blocks come before the
+// global ones.
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/liyu1981/moshpf/pkg/constant"
+	"github.com/liyu1981/moshpf/pkg/protocol"
+)
+
+// Transports accepted by the Transport keyword.
+const (
+	TransportFallback = "fallback"
+	TransportQUIC     = "quic"
+	TransportTCP      = "tcp"
+)
+
+// Ways of the Notify setting to tell about a new auto forward.
+const (
+	NotifyOSC9   = "osc9"
+	NotifyOSC777 = "osc777"
+	NotifyLog    = "log"
+)
+
+// Settings are the values the config file can set for a remote.
+type Settings struct {
+	// Transport is TransportFallback, TransportQUIC or TransportTCP.
+	Transport   string
+	AutoForward bool
+	Restore     bool
+	LocalOnly   bool
+	// RemotePath is where the agent binary is deployed, relative to the
+	// remote home directory.
+	RemotePath string
+	// Notify lists how the master tells about new auto forwards, see the
+	// Notify constants, and NotifyCommand is run for each when set.
+	Notify        []string
+	NotifyCommand string
+
+	// The agent side, passed on with AgentArgs.
+	QUICPortStart uint16
+	QUICPortEnd   uint16
+	// ScanInterval paces the gopsutil scans and the container API, and
+	// WatchInterval the reads of /proc/net/tcp on Linux.
+	ScanInterval  time.Duration
+	WatchInterval time.Duration
+	Exclude       []string
+	// OtherUsers auto forwards the ports of other users' processes too.
+	OtherUsers bool
+	// Containers auto forwards the ports published by Docker and Podman
+	// containers.
+	Containers bool
+	// Rules are sent to the agent in the Hello.
+	Rules []protocol.AutoForwardRule
+}
+
+// Default returns the settings used when the config file sets nothing.
+func Default() Settings {
+	return Settings{
+		Transport:     TransportFallback,
+		AutoForward:   true,
+		Restore:       true,
+		RemotePath:    constant.RemotePath,
+		Notify:        []string{NotifyOSC9},
+		QUICPortStart: constant.QUIC_PORT_START,
+		QUICPortEnd:   constant.QUIC_PORT_END,
+		ScanInterval:  constant.AutoForwardScanInterval,
+		WatchInterval: constant.AutoForwardWatchInterval,
+		Exclude:       constant.AutoForwardExcludedSubstrings,
+		Containers:    true,
+	}
+}
+
+type option struct {
+	key   string // lower case
+	value string
+}
+
+type hostBlock struct {
+	patterns []string
+	options  []option
+}
+
+// Config is a parsed config file.
+type Config struct {
+	global []option
+	hosts  []hostBlock
+}
+
+// Path returns the location of the config file, ~/.mpf/config.
+func Path() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".mpf", "config"), nil
+}
+
+// Load reads the config file. A missing file is an empty config.
+func Load() (*Config, error) {
+	p, err := Path()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return &Config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	cfg, err := Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", p, err)
+	}
+	return cfg, nil
+}
+
+// Parse reads a config file, checking every value.
+func Parse(r io.Reader) (*Config, error) {
+	cfg := &Config{}
+	var block *hostBlock
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value := splitLine(line)
+		if value == "" {
+			return nil, fmt.Errorf("line %d: missing value for %s", n, key)
+		}
+		key = strings.ToLower(key)
+
+		if key == "host" {
+			cfg.hosts = append(cfg.hosts, hostBlock{patterns: strings.Fields(value)})
+			block = &cfg.hosts[len(cfg.hosts)-1]
+			continue
+		}
+
+		// Check the value now to point at the line
+		var s Settings
+		if err := s.apply(key, value); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+
+		opt := option{key: key, value: value}
+		if block != nil {
+			block.options = append(block.options, opt)
+		} else {
+			cfg.global = append(cfg.global, opt)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// splitLine splits "Key value" or "Key=value".
+func splitLine(line string) (string, string) {
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return line, ""
+	}
+	value := strings.TrimSpace(line[i+1:])
+	if line[i] != '=' {
+		value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+	}
+	return line[:i], value
+}
+
+// For returns the settings for target, [user@]host as given to `mpf mosh`.
+func (c *Config) For(target string) Settings {
+	s := Default()
+	for _, o := range c.global {
+		_ = s.apply(o.key, o.value)
+	}
+	globalRules := s.Rules
+	s.Rules = nil
+
+	set := make(map[string]bool)
+	for _, b := range c.hosts {
+		if !matchHost(b.patterns, target) {
+			continue
+		}
+		for _, o := range b.options {
+			if o.key == "autoforwardrule" || !set[o.key] {
+				set[o.key] = true
+				_ = s.apply(o.key, o.value)
+			}
+		}
+	}
+	s.Rules = append(s.Rules, globalRules...)
+	return s
+}
+
+// matchHost reports whether target matches any of patterns and none of the
+// negated ones. Patterns with a "@" match the whole target, others its host.
+func matchHost(patterns []string, target string) bool {
+	host := target
+	if i := strings.LastIndex(target, "@"); i >= 0 {
+		host = target[i+1:]
+	}
+
+	matched := false
+	for _, p := range patterns {
+		negate := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+
+		name := host
+		if strings.Contains(p, "@") {
+			name = target
+		}
+		if ok, _ := path.Match(strings.ToLower(p), strings.ToLower(name)); !ok {
+			continue
+		}
+		if negate {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+func (s *Settings) apply(key, value string) error {
+	var err error
+	switch key {
+	case "transport":
+		switch v := strings.ToLower(value); v {
+		case TransportFallback, TransportQUIC, TransportTCP:
+			s.Transport = v
+		default:
+			return fmt.Errorf("transport must be fallback, quic or tcp, not %s", value)
+		}
+	case "autoforward":
+		s.AutoForward, err = parseYesNo(key, value)
+	case "restore":
+		s.Restore, err = parseYesNo(key, value)
+	case "localonly":
+		s.LocalOnly, err = parseYesNo(key, value)
+	case "remotepath":
+		if strings.HasPrefix(value, "/") {
+			return fmt.Errorf("remotepath must be relative to the remote home directory: %s", value)
+		}
+		s.RemotePath = value
+	case "notify":
+		s.Notify, err = ParseNotify(value)
+	case "notifycommand":
+		s.NotifyCommand = value
+	case "quicports":
+		s.QUICPortStart, s.QUICPortEnd, err = ParsePortRange(value)
+	case "scaninterval":
+		s.ScanInterval, err = ParseInterval(value)
+	case "watchinterval":
+		s.WatchInterval, err = ParseWatchInterval(value)
+	case "autoforwardexclude":
+		s.Exclude = ParseExclude(value)
+	case "autoforwardotherusers":
+		s.OtherUsers, err = parseYesNo(key, value)
+	case "autoforwardcontainers":
+		s.Containers, err = parseYesNo(key, value)
+	case "autoforwardrule":
+		var rule protocol.AutoForwardRule
+		if rule, err = ParseRule(value); err == nil {
+			s.Rules = append(s.Rules, rule)
+		}
+	default:
+		return fmt.Errorf("unknown keyword %s", key)
+	}
+	return err
+}
+
+func parseYesNo(key, value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes", "true", "on":
+		return true, nil
+	case "no", "false", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("%s must be yes or no, not %s", key, value)
+}
+
+// ParsePortRange parses the QUIC port range "62000-63000".
+func ParsePortRange(value string) (uint16, uint16, error) {
+	first, last, _ := strings.Cut(value, "-")
+	start, err1 := strconv.ParseUint(first, 10, 16)
+	end, err2 := strconv.ParseUint(last, 10, 16)
+	if err1 != nil || err2 != nil || start == 0 || start > end {
+		return 0, 0, fmt.Errorf("invalid port range %s, expected <first>-<last>", value)
+	}
+	return uint16(start), uint16(end), nil
+}
+
+// ParseInterval parses the scan interval, a duration like "5s" of at least
+// a second.
+func ParseInterval(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < time.Second {
+		return 0, fmt.Errorf("invalid scan interval %s, expected a duration like 5s of at least 1s", value)
+	}
+	return d, nil
+}
+
+// ParseWatchInterval parses the watch interval, a duration like "250ms" of
+// at least 100ms.
+func ParseWatchInterval(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 100*time.Millisecond {
+		return 0, fmt.Errorf("invalid watch interval %s, expected a duration like 250ms of at least 100ms", value)
+	}
+	return d, nil
+}
+
+// ParseExclude parses the auto forward exclusion list, separated by commas
+// or spaces. "none" excludes nothing.
+func ParseExclude(value string) []string {
+	if strings.EqualFold(value, "none") {
+		return []string{}
+	}
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+// ParseNotify parses a comma separated list of the Notify constants, or
+// "none".
+func ParseNotify(value string) ([]string, error) {
+	if strings.EqualFold(value, "none") {
+		return []string{}, nil
+	}
+	var res []string
+	for _, v := range ParseExclude(value) {
+		switch v = strings.ToLower(v); v {
+		case NotifyOSC9, NotifyOSC777, NotifyLog:
+			res = append(res, v)
+		default:
+			return nil, fmt.Errorf("notify must be %s, %s, %s or none, not %s", NotifyOSC9, NotifyOSC777, NotifyLog, v)
+		}
+	}
+	return res, nil
+}
+
+// ParseRule parses the value of AutoForwardRule, space separated key=value
+// pairs such as
+//
+//	ports=3000-3999 process=^node$ action=forward label=web localport=13000
+//
+// Values containing spaces may be double quoted.
+func ParseRule(value string) (protocol.AutoForwardRule, error) {
+	var rule protocol.AutoForwardRule
+	fields, err := splitQuoted(value)
+	if err != nil {
+		return rule, err
+	}
+	for _, f := range fields {
+		k, v, found := strings.Cut(f, "=")
+		if !found {
+			return rule, fmt.Errorf("rule field %s is not key=value", f)
+		}
+		switch strings.ToLower(k) {
+		case "ports":
+			rule.Ports = v
+		case "process":
+			rule.Process = v
+		case "cmdline":
+			rule.Cmdline = v
+		case "bind":
+			rule.Bind = v
+		case "user":
+			rule.User = v
+		case "container":
+			rule.Container = v
+		case "notify":
+			notify, err := parseYesNo("notify", v)
+			if err != nil {
+				return rule, err
+			}
+			rule.Silent = !notify
+		case "action":
+			rule.Action = strings.ToLower(v)
+		case "label":
+			rule.Label = v
+		case "localport":
+			p, err := strconv.ParseUint(v, 10, 16)
+			if err != nil || p == 0 {
+				return rule, fmt.Errorf("invalid localport %s", v)
+			}
+			rule.LocalPort = uint16(p)
+		default:
+			return rule, fmt.Errorf("unknown rule field %s", k)
+		}
+	}
+	if rule.Action == "" {
+		return rule, fmt.Errorf("rule needs an action")
+	}
+	if _, err := protocol.CompileRules([]protocol.AutoForwardRule{rule}); err != nil {
+		return rule, err
+	}
+	return rule, nil
+}
+
+// splitQuoted splits s at spaces outside double quotes, dropping the quotes.
+func splitQuoted(s string) ([]string, error) {
+	var fields []string
+	var cur strings.Builder
+	inQuote, inField := false, false
+	for _, c := range s {
+		switch {
+		case c == '"':
+			inQuote = !inQuote
+			inField = true
+		case !inQuote && (c == ' ' || c == '\t'):
+			if inField {
+				fields = append(fields, cur.String())
+				cur.Reset()
+				inField = false
+			}
+		default:
+			cur.WriteRune(c)
+			inField = true
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("unterminated quote in %s", s)
+	}
+	if inField {
+		fields = append(fields, cur.String())
+	}
+	return fields, nil
+}
+
+// AgentArgs returns the `mpf agent` flags carrying the agent side of s to
+// the remote, leaving out the defaults.
+func (s Settings) AgentArgs() []string {
+	def := Default()
+	var args []string
+	if s.QUICPortStart != def.QUICPortStart || s.QUICPortEnd != def.QUICPortEnd {
+		args = append(args, "--quic-ports", fmt.Sprintf("%d-%d", s.QUICPortStart, s.QUICPortEnd))
+	}
+	if s.ScanInterval != def.ScanInterval {
+		args = append(args, "--scan-interval", s.ScanInterval.String())
+	}
+	if s.WatchInterval != def.WatchInterval {
+		args = append(args, "--watch-interval", s.WatchInterval.String())
+	}
+	if strings.Join(s.Exclude, ",") != strings.Join(def.Exclude, ",") {
+		exclude := strings.Join(s.Exclude, ",")
+		if exclude == "" {
+			exclude = "none"
+		}
+		args = append(args, "--exclude", exclude)
+	}
+	if s.OtherUsers {
+		args = append(args, "--other-users", "yes")
+	}
+	if !s.Containers {
+		args = append(args, "--containers", "no")
+	}
+	return args
+}
+
+// ParseAgentArgs applies the flags made by AgentArgs to s.
+func ParseAgentArgs(args []string, s *Settings) error {
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return fmt.Errorf("missing value for %s", args[i])
+		}
+		var err error
+		switch value := args[i+1]; args[i] {
+		case "--quic-ports":
+			s.QUICPortStart, s.QUICPortEnd, err = ParsePortRange(value)
+		case "--scan-interval":
+			s.ScanInterval, err = ParseInterval(value)
+		case "--watch-interval":
+			s.WatchInterval, err = ParseWatchInterval(value)
+		case "--exclude":
+			s.Exclude = ParseExclude(value)
+		case "--other-users":
+			s.OtherUsers, err = parseYesNo(args[i], value)
+		case "--containers":
+			s.Containers, err = parseYesNo(args[i], value)
+		default:
+			return fmt.Errorf("unknown agent flag %s", args[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liyu1981/moshpf/pkg/protocol"
+)
+
+const testConfig = `
+# defaults for every remote
+Transport tcp
+ScanInterval=10s
+WatchInterval 500ms
+
+Host dev-* !dev-db
+    LocalOnly yes
+    QUICPorts 61000-61100
+
+Host *
+    LocalOnly no
+    AutoForward no
+    Transport quic
+
+Host alice@build.example.com
+    RemotePath bin/mpf
+    AutoForwardExclude node, java
+    AutoForwardOtherUsers yes
+    AutoForwardContainers no
+    Notify osc777, log
+    NotifyCommand notify-send "$MPF_TITLE" "$MPF_MESSAGE"
+`
+
+func TestConfigFor(t *testing.T) {
+	cfg, err := Parse(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	tests := []struct {
+		target string
+		want   func(*Settings)
+	}{
+		{"dev-web", func(s *Settings) {
+			s.Transport = TransportQUIC
+			s.ScanInterval = 10 * time.Second
+			s.WatchInterval = 500 * time.Millisecond
+			s.LocalOnly = true
+			s.QUICPortStart, s.QUICPortEnd = 61000, 61100
+			s.AutoForward = false
+		}},
+		{"user@dev-db", func(s *Settings) {
+			s.Transport = TransportQUIC
+			s.ScanInterval = 10 * time.Second
+			s.WatchInterval = 500 * time.Millisecond
+			s.AutoForward = false
+		}},
+		{"alice@build.example.com", func(s *Settings) {
+			s.Transport = TransportQUIC
+			s.ScanInterval = 10 * time.Second
+			s.WatchInterval = 500 * time.Millisecond
+			s.AutoForward = false
+			s.RemotePath = "bin/mpf"
+			s.Exclude = []string{"node", "java"}
+			s.OtherUsers = true
+			s.Containers = false
+			s.Notify = []string{NotifyOSC777, NotifyLog}
+			s.NotifyCommand = `notify-send "$MPF_TITLE" "$MPF_MESSAGE"`
+		}},
+		{"bob@build.example.com", func(s *Settings) {
+			s.Transport = TransportQUIC
+			s.ScanInterval = 10 * time.Second
+			s.WatchInterval = 500 * time.Millisecond
+			s.AutoForward = false
+		}},
+	}
+	for _, tt := range tests {
+		want := Default()
+		tt.want(&want)
+		if got := cfg.For(tt.target); !reflect.DeepEqual(got, want) {
+			t.Errorf("For(%q) = %+v, want %+v", tt.target, got, want)
+		}
+	}
+
+	if got := (&Config{}).For("host"); !reflect.DeepEqual(got, Default()) {
+		t.Errorf("Expected defaults from an empty config, got %+v", got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"Transport udp", "line 1: transport must be"},
+		{"\nHost x\n  LocalOnly maybe", "line 3: localonly must be yes or no"},
+		{"QUICPorts 63000-62000", "line 1: invalid port range"},
+		{"ScanInterval 10ms", "line 1: invalid scan interval"},
+		{"WatchInterval 10ms", "line 1: invalid watch interval"},
+		{"RemotePath /usr/bin/mpf", "line 1: remotepath must be relative"},
+		{"Colour blue", "line 1: unknown keyword colour"},
+		{"AutoForward", "line 1: missing value"},
+		{"Notify bell", "line 1: notify must be"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(strings.NewReader(tt.input))
+		if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("Parse(%q) error = %v, want %q", tt.input, err, tt.want)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load without a file failed: %v", err)
+	}
+	if !reflect.DeepEqual(cfg.For("host"), Default()) {
+		t.Errorf("Expected defaults without a file")
+	}
+
+	if err := os.MkdirAll(filepath.Join(home, ".mpf"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(home, ".mpf", "config"), []byte("Restore no\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.For("host").Restore {
+		t.Errorf("Expected Restore no from the file")
+	}
+}
+
+func TestAgentArgs(t *testing.T) {
+	if args := Default().AgentArgs(); len(args) != 0 {
+		t.Errorf("Expected no flags for the defaults, got %v", args)
+	}
+
+	s := Default()
+	s.QUICPortStart, s.QUICPortEnd = 61000, 61100
+	s.ScanInterval = 30 * time.Second
+	s.WatchInterval = time.Second
+	s.Exclude = []string{}
+	s.OtherUsers = true
+	s.Containers = false
+	args := s.AgentArgs()
+	want := []string{"--quic-ports", "61000-61100", "--scan-interval", "30s", "--watch-interval", "1s", "--exclude", "none", "--other-users", "yes", "--containers", "no"}
+	if !reflect.DeepEqual(args, want) {
+		t.Fatalf("AgentArgs() = %v, want %v", args, want)
+	}
+
+	got := Default()
+	if err := ParseAgentArgs(args, &got); err != nil {
+		t.Fatalf("ParseAgentArgs failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, s) {
+		t.Errorf("ParseAgentArgs = %+v, want %+v", got, s)
+	}
+
+	if err := ParseAgentArgs([]string{"--exclude"}, &got); err == nil {
+		t.Errorf("Expected missing value to fail")
+	}
+	if err := ParseAgentArgs([]string{"--bogus", "1"}, &got); err == nil {
+		t.Errorf("Expected unknown flag to fail")
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	rule, err := ParseRule(`ports=3000-3999 process=^node$ cmdline="npm run dev" container=web action=Forward label=web localport=13000 notify=no`)
+	if err != nil {
+		t.Fatalf("ParseRule failed: %v", err)
+	}
+	want := protocol.AutoForwardRule{
+		Ports:     "3000-3999",
+		Process:   "^node$",
+		Cmdline:   "npm run dev",
+		Container: "web",
+		Action:    protocol.ActionForward,
+		Label:     "web",
+		LocalPort: 13000,
+		Silent:    true,
+	}
+	if rule != want {
+		t.Errorf("ParseRule = %+v, want %+v", rule, want)
+	}
+
+	for _, bad := range []string{
+		"ports=3000",
+		"action=forward colour=blue",
+		"action=forward localport=x",
+		`action=forward cmdline="npm`,
+		"action=forward process",
+		"action=maybe",
+		"action=forward notify=maybe",
+	} {
+		if _, err := ParseRule(bad); err == nil {
+			t.Errorf("Expected ParseRule(%q) to fail", bad)
+		}
+	}
+}
+
+func TestConfigRules(t *testing.T) {
+	cfg, err := Parse(strings.NewReader(`
+AutoForwardRule ports=1-1023 action=ignore
+Host dev
+    AutoForwardRule process=jupyter action=require-approval
+    AutoForwardRule user=root action=notify-only
+Host *
+    AutoForwardRule ports=8080 action=forward localport=18080
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	var actions []string
+	for _, r := range cfg.For("dev").Rules {
+		actions = append(actions, r.Action)
+	}
+	want := []string{protocol.ActionRequireApproval, protocol.ActionNotifyOnly, protocol.ActionForward, protocol.ActionIgnore}
+	if !reflect.DeepEqual(actions, want) {
+		t.Errorf("Rules for dev = %v, want %v", actions, want)
+	}
+	if n := len(cfg.For("other").Rules); n != 2 {
+		t.Errorf("Expected 2 rules for other, got %d", n)
+	}
+}
+
+func TestParseNotify(t *testing.T) {
+	got, err := ParseNotify("OSC9,log")
+	if err != nil || !reflect.DeepEqual(got, []string{NotifyOSC9, NotifyLog}) {
+		t.Errorf("ParseNotify = %v, %v", got, err)
+	}
+	if got, err := ParseNotify("none"); err != nil || len(got) != 0 {
+		t.Errorf("Expected none to notify nothing, got %v, %v", got, err)
+	}
+	if _, err := ParseNotify("osc9, popup"); err == nil {
+		t.Errorf("Expected an unknown kind to fail")
+	}
+}
@@ -3,8 +3,16 @@ package constant
 import "time"
 
 const (
-	// AutoForwardScanInterval is the period between port scans on the agent.
+	// AutoForwardScanInterval is the period between port scans on the agent
+	// where /proc/net/tcp is missing, and between container API requests.
 	AutoForwardScanInterval = 5 * time.Second
+
+	// AutoForwardWatchInterval is the default period between reads of
+	// /proc/net/tcp on Linux, which replace the slower scans there.
+	AutoForwardWatchInterval = 250 * time.Millisecond
+
+	// ContainerAPITimeout bounds a request to the Docker or Podman API.
+	ContainerAPITimeout = 2 * time.Second
 )
 
 var (
@@ -20,4 +28,22 @@ var (
 		"mpf",
 		"mosh",
 	}
+
+	// ContainerAPISockets are the system wide Docker and Podman API sockets
+	// the agent lists published container ports from, besides the rootless
+	// ones in $XDG_RUNTIME_DIR and $DOCKER_HOST.
+	ContainerAPISockets = []string{
+		"/var/run/docker.sock",
+		"/run/podman/podman.sock",
+	}
+
+	// ContainerProxies are the processes listening on published container
+	// ports to pass them on to the container.
+	ContainerProxies = []string{
+		"docker-proxy",
+		"rootlesskit",
+		"rootlessport",
+		"slirp4netns",
+		"pasta",
+	}
 )
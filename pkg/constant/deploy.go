@@ -0,0 +1,5 @@
+package constant
+
+// RemotePath is where the agent binary is deployed on the remote, relative
+// to the home directory.
+const RemotePath = "~/.local/bin/mpf"
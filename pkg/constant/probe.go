@@ -0,0 +1,11 @@
+package constant
+
+import "time"
+
+// ProbeTimeout bounds each attempt of the agent to find out what listens on
+// a forwarded port, see ProbeRequest.
+const ProbeTimeout = 500 * time.Millisecond
+
+// ProbeWait is how long the master waits for the probe of a new auto
+// forward before notifying about it without.
+const ProbeWait = 10 * time.Second
@@ -0,0 +1,9 @@
+package constant
+
+import "time"
+
+const (
+	// UDPFlowIdleTimeout is how long a forwarded UDP flow may stay silent
+	// before the master tears down its stream.
+	UDPFlowIdleTimeout = 2 * time.Minute
+)
@@ -0,0 +1,11 @@
+package constant
+
+import "time"
+
+// VHostAddr is where the master listens for hostname routed forwards unless
+// another address is given with `mpf mosh --vhost`.
+const VHostAddr = ":8443"
+
+// VHostSniffTimeout bounds how long a client may take to send the HTTP
+// request line and headers or the TLS ClientHello.
+const VHostSniffTimeout = 10 * time.Second
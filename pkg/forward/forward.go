@@ -2,8 +2,11 @@ package forward
 
 import (
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -18,10 +21,23 @@ type Forwarder struct {
 	sessions   *tunnel.SessionManager
 	remoteName string
 	masterIP   string
+	masterIPs  []string
 	localOnly  bool
+	autoFwd    bool // whether the agent auto forwards, see SetAutoForward
 	nextID     uint32
 	listeners  map[uint16]net.Listener
+	handlers   map[uint16]func(net.Conn, *connStats)
 	forwards   map[uint16]protocol.ForwardEntry
+	reverses   map[uint16]protocol.ForwardEntry
+	udp        map[uint16]*udpForward
+	sockets    map[string]*unixForward
+	routes     map[string]protocol.ForwardEntry
+	remap      *RemapPolicy
+	remapped   map[uint16]uint16 // requested -> actual master port
+	stats      map[string]*connStats
+	labels     map[string]string // see requestKey
+	vhostLn    net.Listener
+	pending    map[uint16]chan protocol.ListenResponse
 	state      *state.Manager
 	target     string // user@host
 	mu         sync.Mutex
@@ -32,11 +48,21 @@ func NewForwarder(session *tunnel.Session, remoteName string, stateMgr *state.Ma
 		sessions:   tunnel.NewSessionManager(),
 		remoteName: remoteName,
 		masterIP:   protocol.GetLocalIP(),
+		masterIPs:  protocol.GetLocalIPs(),
 		localOnly:  localOnly,
 		state:      stateMgr,
 		target:     target,
 		listeners:  make(map[uint16]net.Listener),
+		handlers:   make(map[uint16]func(net.Conn, *connStats)),
 		forwards:   make(map[uint16]protocol.ForwardEntry),
+		reverses:   make(map[uint16]protocol.ForwardEntry),
+		udp:        make(map[uint16]*udpForward),
+		sockets:    make(map[string]*unixForward),
+		routes:     make(map[string]protocol.ForwardEntry),
+		remapped:   make(map[uint16]uint16),
+		stats:      make(map[string]*connStats),
+		labels:     make(map[string]string),
+		pending:    make(map[uint16]chan protocol.ListenResponse),
 	}
 	if session != nil {
 		f.AddSession(session)
@@ -56,6 +82,12 @@ func (f *Forwarder) GetMasterIP() string {
 	return f.masterIP
 }
 
+func (f *Forwarder) GetMasterIPs() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.masterIPs...)
+}
+
 func (f *Forwarder) AddSession(session *tunnel.Session) {
 	f.sessions.Add(session, nil)
 }
@@ -76,10 +108,10 @@ func (f *Forwarder) getBestSessionLocked() *tunnel.Session {
 	return f.sessions.GetBest()
 }
 
-func (f *Forwarder) ListenAndForward(localAddr, remoteHost string, remotePort uint16, isAuto bool) error {
-	var masterPort uint16
-
-	// Resolve localAddr based on localOnly if it is a port-only address
+// resolveLocalAddr applies localOnly to a port-only address and returns the
+// resulting listen address together with its port. Addresses with an explicit
+// bind host, e.g. "[::1]:8080", are used as given.
+func (f *Forwarder) resolveLocalAddr(localAddr string) (string, uint16) {
 	if strings.HasPrefix(localAddr, ":") {
 		if f.localOnly {
 			localAddr = "127.0.0.1" + localAddr
@@ -88,49 +120,169 @@ func (f *Forwarder) ListenAndForward(localAddr, remoteHost string, remotePort ui
 		}
 	}
 
-	fmt.Sscanf(localAddr, "%*[^:]:%d", &masterPort)
-	if masterPort == 0 {
-		// Try to parse if it contains hostname
-		_, portStr, err := net.SplitHostPort(localAddr)
-		if err == nil {
-			fmt.Sscanf(portStr, "%d", &masterPort)
+	_, portStr, err := net.SplitHostPort(localAddr)
+	if err != nil {
+		return localAddr, 0
+	}
+	port, _ := strconv.ParseUint(portStr, 10, 16)
+	return localAddr, uint16(port)
+}
+
+// HandleListenRequest starts the forward described by a ListenRequest from the
+// agent, dispatching on its protocol, and labels it with the request's Name.
+func (f *Forwarder) HandleListenRequest(m protocol.ListenRequest) error {
+	key := f.requestKey(m)
+	if err := f.checkLabel(key, m.Name); err != nil {
+		if !m.IsAuto {
+			return err
 		}
+		// Several ports of one process share its name
+		m.Name = fmt.Sprintf("%s-%d", m.Name, m.RemotePort)
 	}
 
+	var err error
+	switch {
+	case m.VHost != "":
+		err = f.AddRoute(m.VHost, m.RemoteHost, m.RemotePort, m.IsAuto)
+	case m.Protocol == protocol.ProtocolUDP:
+		err = f.ListenUDPAndForward(m.LocalAddr, m.RemoteHost, m.RemotePort, m.IsAuto)
+	case m.Protocol == protocol.ProtocolUnix:
+		err = f.ListenUnixAndForward(m.LocalAddr, m.RemotePath)
+	default:
+		if m.IsAuto {
+			if _, port := f.resolveLocalAddr(m.LocalAddr); f.hasManualForward(port) {
+				return nil
+			}
+			// Routed by name even if the local port turns out to be taken
+			f.addAutoRoute(m.RemoteHost, m.RemotePort)
+		}
+		err = f.ListenAndForward(m.LocalAddr, m.RemoteHost, m.RemotePort, m.IsAuto)
+		if err == nil && m.IsAuto {
+			_, port := f.resolveLocalAddr(m.LocalAddr)
+			f.setRemoteDetails(port, m.User, m.RemoteBind)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if m.IsAuto {
+		_ = f.setLabel(key, m.Name, false)
+		return nil
+	}
+	return f.setLabel(key, m.Name, true)
+}
+
+// setRemoteDetails records the owner and bind addresses of the remote
+// service of the TCP forward requested on port, for the list.
+func (f *Forwarder) setRemoteDetails(port uint16, user, bind string) {
 	f.mu.Lock()
-	if _, exists := f.listeners[masterPort]; exists {
-		f.mu.Unlock()
-		return fmt.Errorf("port %d already has an active listener", masterPort)
+	defer f.mu.Unlock()
+
+	if _, exists := f.forwards[port]; !exists && f.isRemappedLocked(port) {
+		port = f.remapped[port]
+	}
+	if e, ok := f.forwards[port]; ok {
+		e.User = user
+		e.RemoteBind = bind
+		f.forwards[port] = e
 	}
+}
 
-	ln, err := net.Listen("tcp", localAddr)
-	if err != nil {
-		f.forwards[masterPort] = protocol.ForwardEntry{
-			LocalAddr:  localAddr,
-			RemoteHost: remoteHost,
-			RemotePort: remotePort,
-			IsAuto:     isAuto,
-			Error:      err.Error(),
+// SetService records what the agent found listening on the remote end of the
+// TCP forwards to r.Host:r.Port, for the list.
+func (f *Forwarder) SetService(r protocol.ProbeResult) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for port, e := range f.forwards {
+		if e.Dynamic || e.RemoteHost != r.Host || e.RemotePort != r.Port {
+			continue
 		}
-		f.mu.Unlock()
-		return err
+		e.Service = r.Service
+		e.Title = r.Title
+		e.URL = protocol.ServiceURL(r.Service, BrowseAddr(e.LocalAddr))
+		f.forwards[port] = e
 	}
+}
 
-	if masterPort == 0 {
-		if addr, ok := ln.Addr().(*net.TCPAddr); ok {
-			masterPort = uint16(addr.Port)
+// ProbeTargets returns the remote ends of the active TCP forwards whose
+// service is not known yet.
+func (f *Forwarder) ProbeTargets() []protocol.ProbeRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	seen := make(map[protocol.ProbeRequest]bool)
+	var res []protocol.ProbeRequest
+	for port, e := range f.forwards {
+		req := protocol.ProbeRequest{Host: e.RemoteHost, Port: e.RemotePort}
+		if e.Dynamic || e.Service != "" || f.listeners[port] == nil || seen[req] {
+			continue
 		}
+		seen[req] = true
+		res = append(res, req)
 	}
+	return res
+}
 
-	f.forwards[masterPort] = protocol.ForwardEntry{
-		LocalAddr:  localAddr,
+// BrowseAddr turns the listen address of a forward into one to connect to,
+// localhost for forwards on every interface.
+func BrowseAddr(localAddr string) string {
+	host, port, err := net.SplitHostPort(localAddr)
+	if err != nil {
+		return localAddr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// HandleCloseRequest stops the forward described by a CloseRequest from the
+// agent and reports whether an active forward was closed.
+func (f *Forwarder) HandleCloseRequest(m protocol.CloseRequest) bool {
+	if m.IsAuto && f.hasManualForward(m.Port) {
+		return false
+	}
+	switch {
+	case m.Name != "":
+		return f.closeNamed(m.Name)
+	case m.VHost != "":
+		return f.CloseRoute(m.VHost)
+	case m.Reverse:
+		return f.CloseReverse(m.Port)
+	case m.LocalPath != "":
+		return f.CloseUnixForward(m.LocalPath)
+	case m.Protocol == protocol.ProtocolUDP:
+		return f.CloseUDPForward(m.Port)
+	default:
+		closed := f.CloseForward(m.Port)
+		if f.closeAutoRoute(m.Port) {
+			closed = true
+		}
+		return closed
+	}
+}
+
+func (f *Forwarder) ListenAndForward(localAddr, remoteHost string, remotePort uint16, isAuto bool) error {
+	entry := protocol.ForwardEntry{
 		RemoteHost: remoteHost,
 		RemotePort: remotePort,
+		Protocol:   protocol.ProtocolTCP,
 		IsAuto:     isAuto,
 	}
+	header := protocol.StreamHeader{
+		Host: remoteHost,
+		Port: remotePort,
+	}
 
-	if f.state != nil {
-		_ = f.state.AddForward(f.target, fmt.Sprintf("%d", remotePort), fmt.Sprintf("%d", masterPort))
+	bind := localAddr
+	localAddr, err := f.listenTCP(localAddr, entry, func(masterPort uint16) {
+		_ = f.state.AddForward(f.target, state.FormatTarget(remoteHost, remotePort), state.FormatLocal(bind, masterPort))
+	}, func(conn net.Conn, st *connStats) {
+		f.handleConnection(conn, header, st)
+	})
+	if err != nil {
+		return err
 	}
 
 	displayHost := remoteHost
@@ -138,61 +290,255 @@ func (f *Forwarder) ListenAndForward(localAddr, remoteHost string, remotePort ui
 		displayHost = f.remoteName
 	}
 
-	f.listeners[masterPort] = ln
-	f.mu.Unlock()
-
 	log.Info().
 		Str("local", localAddr).
 		Str("remote", fmt.Sprintf("%s:%d", displayHost, remotePort)).
 		Msg("Forwarding started")
 
-	go func() {
-		defer func() {
-			ln.Close()
-			f.mu.Lock()
-			if f.listeners[masterPort] == ln {
-				delete(f.listeners, masterPort)
-				delete(f.forwards, masterPort)
-			}
-			f.mu.Unlock()
-		}()
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				return
+	return nil
+}
+
+// listenTCP binds localAddr and registers entry under the bound port. persist
+// is called with the requested port when a state manager is configured, and
+// handle serves every accepted connection, counting it in the forward's
+// stats. It returns the resolved listen address. A failed bind is still
+// recorded so that it shows up in the list.
+//
+// Plain TCP forwards whose port is busy are moved to another port, following
+// an earlier remap of the same port or the configured RemapPolicy.
+func (f *Forwarder) listenTCP(localAddr string, entry protocol.ForwardEntry, persist func(masterPort uint16), handle func(net.Conn, *connStats)) (string, error) {
+	localAddr, masterPort := f.resolveLocalAddr(localAddr)
+	entry.LocalAddr = localAddr
+	requested := masterPort
+
+	f.mu.Lock()
+	if e, exists := f.forwards[masterPort]; exists && f.listeners[masterPort] != nil && sameTarget(e, entry) {
+		f.mu.Unlock()
+		return localAddr, fmt.Errorf("port %d already has an active listener", masterPort)
+	}
+	if f.isRemappedLocked(requested) {
+		f.mu.Unlock()
+		return localAddr, fmt.Errorf("port %d already has an active listener on port %d", requested, f.remapped[requested])
+	}
+
+	ports := []uint16{masterPort}
+	if masterPort != 0 && entry.Protocol == protocol.ProtocolTCP {
+		if actual, ok := f.remapped[requested]; ok {
+			ports = []uint16{actual, masterPort}
+		}
+		if f.remap != nil {
+			ports = append(ports, f.remap.candidates(requested)...)
+		}
+	}
+
+	var ln net.Listener
+	var err, firstErr error
+	for _, p := range ports {
+		addr := withPort(localAddr, p)
+		if _, taken := f.listeners[p]; taken {
+			err = fmt.Errorf("port %d already has an active listener", p)
+		} else {
+			ln, err = net.Listen("tcp", addr)
+		}
+		if err == nil {
+			localAddr, masterPort = addr, p
+			break
+		}
+		if p == requested {
+			firstErr = err
+			if !isAddrInUse(err) && f.listeners[p] == nil {
+				break
 			}
-			go f.handleConnection(conn, remoteHost, remotePort)
 		}
+	}
+
+	if ln == nil {
+		if firstErr != nil {
+			err = firstErr
+		}
+		if f.listeners[requested] == nil {
+			entry.Error = err.Error()
+			f.forwards[requested] = entry
+		}
+		f.mu.Unlock()
+		return localAddr, err
+	}
+
+	if masterPort == 0 {
+		if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+			masterPort = uint16(addr.Port)
+		}
+		requested = masterPort
+	}
+
+	entry.LocalAddr = localAddr
+	if masterPort != requested {
+		entry.RemappedFrom = requested
+		f.remapped[requested] = masterPort
+		if f.listeners[requested] == nil {
+			delete(f.forwards, requested) // drop an earlier failed entry
+		}
+		log.Info().
+			Uint16("requested", requested).
+			Uint16("port", masterPort).
+			Msg("Master port remapped")
+	} else if _, ok := f.remapped[requested]; ok {
+		delete(f.remapped, requested)
+		if f.state != nil {
+			_ = f.state.RemoveRemap(f.target, fmt.Sprintf("%d", requested))
+		}
+	}
+	f.forwards[masterPort] = entry
+
+	if f.state != nil {
+		persist(requested)
+		if entry.RemappedFrom != 0 {
+			_ = f.state.AddRemap(f.target, fmt.Sprintf("%d", requested), fmt.Sprintf("%d", masterPort))
+		}
+	}
+
+	f.listeners[masterPort] = ln
+	f.handlers[masterPort] = handle
+	st := f.newStatsLocked(tcpKey(masterPort))
+	f.mu.Unlock()
+
+	go f.serveTCP(ln, masterPort, st, handle)
+
+	return localAddr, nil
+}
+
+// serveTCP accepts the connections of the forward on masterPort until ln is
+// closed, then drops the forward unless ln was replaced meanwhile.
+func (f *Forwarder) serveTCP(ln net.Listener, masterPort uint16, st *connStats, handle func(net.Conn, *connStats)) {
+	defer func() {
+		ln.Close()
+		f.mu.Lock()
+		if f.listeners[masterPort] == ln {
+			delete(f.listeners, masterPort)
+			delete(f.handlers, masterPort)
+			delete(f.forwards, masterPort)
+			delete(f.stats, tcpKey(masterPort))
+		}
+		f.mu.Unlock()
 	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go handle(conn, st)
+	}
+}
 
-	return nil
+func sameTarget(a, b protocol.ForwardEntry) bool {
+	return a.RemoteHost == b.RemoteHost &&
+		a.RemotePort == b.RemotePort &&
+		a.RemotePath == b.RemotePath &&
+		a.Protocol == b.Protocol &&
+		a.Dynamic == b.Dynamic
+}
+
+// isRemappedLocked reports whether a forward requested on port is active on
+// another port after a remap.
+func (f *Forwarder) isRemappedLocked(port uint16) bool {
+	actual, ok := f.remapped[port]
+	if !ok || f.listeners[actual] == nil {
+		return false
+	}
+	return f.forwards[actual].RemappedFrom == port
 }
 
 func (f *Forwarder) CloseForward(masterPort uint16) bool {
 	f.mu.Lock()
+	if _, exists := f.forwards[masterPort]; !exists && f.isRemappedLocked(masterPort) {
+		// Closing by the requested port of a remapped forward
+		masterPort = f.remapped[masterPort]
+	}
+	if e, exists := f.forwards[masterPort]; exists {
+		requested := masterPort
+		if e.RemappedFrom != 0 {
+			requested = e.RemappedFrom
+		}
+		delete(f.labels, tcpKey(requested))
+	}
 	ln, ok := f.listeners[masterPort]
 	if ok {
 		ln.Close()
+		f.removeStateLocked(masterPort)
 		delete(f.listeners, masterPort)
+		delete(f.handlers, masterPort)
 		delete(f.forwards, masterPort)
-		if f.state != nil {
-			_ = f.state.RemoveForward(f.target, fmt.Sprintf("%d", masterPort))
-		}
+		delete(f.stats, tcpKey(masterPort))
 		log.Info().
 			Str("remote", f.remoteName).
 			Uint16("port", masterPort).
 			Msg("Forwarding stopped")
 	} else if _, exists := f.forwards[masterPort]; exists {
 		// Even if no listener (e.g. failed), remove from forwards and state
+		f.removeStateLocked(masterPort)
 		delete(f.forwards, masterPort)
-		if f.state != nil {
-			_ = f.state.RemoveForward(f.target, fmt.Sprintf("%d", masterPort))
-		}
 	}
 	f.mu.Unlock()
 	return ok
 }
 
+func (f *Forwarder) removeStateLocked(masterPort uint16) {
+	if f.state == nil {
+		return
+	}
+	e := f.forwards[masterPort]
+	if e.RemappedFrom != 0 {
+		delete(f.remapped, e.RemappedFrom)
+		_ = f.state.RemoveRemap(f.target, fmt.Sprintf("%d", e.RemappedFrom))
+		masterPort = e.RemappedFrom
+	}
+	if e.Dynamic {
+		_ = f.state.RemoveDynamic(f.target, fmt.Sprintf("%d", masterPort))
+		return
+	}
+	if e.Protocol == protocol.ProtocolUnix {
+		_ = f.state.RemoveUnixForward(f.target, fmt.Sprintf("%d", masterPort))
+		return
+	}
+	_ = f.state.RemoveForward(f.target, fmt.Sprintf("%d", masterPort))
+}
+
+// dialFailedError is returned by openStreamOn when the agent NAKs a stream.
+type dialFailedError struct {
+	target string
+}
+
+func (e *dialFailedError) Error() string {
+	return fmt.Sprintf("agent failed to dial %s", e.target)
+}
+
+func isDialFailed(err error) bool {
+	var dfe *dialFailedError
+	return errors.As(err, &dfe)
+}
+
+func describeTarget(header protocol.StreamHeader) string {
+	if header.Network == protocol.ProtocolUnix {
+		return "unix:" + header.Path
+	}
+	return net.JoinHostPort(header.Host, strconv.Itoa(int(header.Port)))
+}
+
+// GetList answers a ListRequest.
+func (f *Forwarder) GetList() protocol.ListResponse {
+	list := protocol.ListResponse{
+		Entries:   f.GetForwardEntries(),
+		MasterIP:  f.GetMasterIP(),
+		MasterIPs: f.GetMasterIPs(),
+	}
+
+	f.mu.Lock()
+	list.LocalOnly = f.localOnly
+	list.AutoForward = f.autoFwd
+	f.mu.Unlock()
+	return list
+}
+
 func (f *Forwarder) GetForwardEntries() []protocol.ForwardEntry {
 	f.mu.Lock()
 	defer f.mu.Unlock()
@@ -203,15 +549,43 @@ func (f *Forwarder) GetForwardEntries() []protocol.ForwardEntry {
 		transport = s.Mux.Type()
 	}
 
-	entries := make([]protocol.ForwardEntry, 0, len(f.forwards))
-	for _, e := range f.forwards {
+	entries := make([]protocol.ForwardEntry, 0, len(f.forwards)+len(f.reverses)+len(f.udp)+len(f.sockets)+len(f.routes))
+	for port, e := range f.forwards {
+		e.Name = f.entryLabelLocked(port, e)
+		e.Transport = transport
+		e.Stats = f.stats[tcpKey(port)].snapshot()
+		entries = append(entries, e)
+	}
+	for port, u := range f.udp {
+		e := u.entry
+		e.Name = f.labels[udpKey(port)]
+		e.Transport = transport
+		e.Stats = f.stats[udpKey(port)].snapshot()
+		entries = append(entries, e)
+	}
+	for path, u := range f.sockets {
+		e := u.entry
+		e.Name = f.labels[unixKey(path)]
+		e.Transport = transport
+		e.Stats = f.stats[unixKey(path)].snapshot()
+		entries = append(entries, e)
+	}
+	for port, e := range f.reverses {
+		e.Transport = transport
+		e.Stats = f.stats[reverseKey(port)].snapshot()
+		entries = append(entries, e)
+	}
+	for name, e := range f.routes {
+		e.LocalAddr = f.routeAddrLocked(name)
+		e.Name = f.labels[routeKey(name)]
 		e.Transport = transport
+		e.Stats = f.stats[routeKey(name)].snapshot()
 		entries = append(entries, e)
 	}
 	return entries
 }
 
-func (f *Forwarder) handleConnection(localConn net.Conn, remoteHost string, remotePort uint16) {
+func (f *Forwarder) handleConnection(localConn net.Conn, header protocol.StreamHeader, st *connStats) {
 	defer localConn.Close()
 
 	s := f.getBestSession()
@@ -220,31 +594,59 @@ func (f *Forwarder) handleConnection(localConn net.Conn, remoteHost string, remo
 		return
 	}
 
-	remoteConn, err := s.Mux.OpenStream()
+	remoteConn, err := f.openStreamOn(s, header)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to open multiplexer stream")
+		if isDialFailed(err) {
+			st.failedDial()
+		}
+		log.Error().Err(err).Msg("Failed to open forwarding stream")
 		return
 	}
 	defer remoteConn.Close()
 
-	// Send header directly on the stream
-	encoder := gob.NewEncoder(remoteConn)
-	err = encoder.Encode(protocol.StreamHeader{
+	st.opened()
+	defer st.closed()
+	util.Proxy(st.wrap(localConn), remoteConn)
+}
+
+// openStream opens a stream on the best session and asks the agent to dial
+// remoteHost:remotePort. The stream is returned once the agent has ACKed.
+func (f *Forwarder) openStream(remoteHost string, remotePort uint16) (io.ReadWriteCloser, error) {
+	s := f.getBestSession()
+	if s == nil {
+		return nil, fmt.Errorf("no active session for forwarding")
+	}
+	return f.openStreamOn(s, protocol.StreamHeader{
 		Host: remoteHost,
 		Port: remotePort,
 	})
+}
+
+func (f *Forwarder) openStreamOn(s *tunnel.Session, header protocol.StreamHeader) (io.ReadWriteCloser, error) {
+	remoteConn, err := s.Mux.OpenStream()
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to send stream header")
-		return
+		return nil, fmt.Errorf("failed to open multiplexer stream: %v", err)
+	}
+
+	// Send header directly on the stream
+	encoder := gob.NewEncoder(remoteConn)
+	err = encoder.Encode(header)
+	if err != nil {
+		remoteConn.Close()
+		return nil, fmt.Errorf("failed to send stream header: %v", err)
 	}
 
 	// Wait for 1-byte ACK (1 = success, 0 = fail)
 	ack := make([]byte, 1)
 	_, err = remoteConn.Read(ack)
-	if err != nil || ack[0] != 1 {
-		log.Error().Err(err).Msg("Failed to get stream ACK")
-		return
+	if err != nil {
+		remoteConn.Close()
+		return nil, fmt.Errorf("failed to get stream ACK: %v", err)
+	}
+	if ack[0] != 1 {
+		remoteConn.Close()
+		return nil, &dialFailedError{target: describeTarget(header)}
 	}
 
-	util.Proxy(localConn, remoteConn)
+	return remoteConn, nil
 }
@@ -1,93 +1,889 @@
 package forward
 
 import (
+	"crypto/tls"
+	"encoding/gob"
+	"fmt"
+	"io"
 	"net"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/liyu1981/moshpf/pkg/protocol"
+	"github.com/liyu1981/moshpf/pkg/state"
 	"github.com/liyu1981/moshpf/pkg/tunnel"
 )
 
-func TestForwarder(t *testing.T) {
-	// Setup a session using net.Pipe
-	s_conn, c_conn := net.Pipe()
-
+// newSessionPair connects an agent and a master session over a pipe.
+func newSessionPair(t *testing.T) (*tunnel.Session, *tunnel.Session) {
+	t.Helper()
+	agentConn, masterConn := net.Pipe()
+	var agentSide, masterSide *tunnel.Session
 	errChan := make(chan error, 2)
-	var s_session, c_session *tunnel.Session
-
 	go func() {
 		var err error
-		s_session, err = tunnel.NewSession(s_conn, true)
+		agentSide, err = tunnel.NewSession(agentConn, true)
 		errChan <- err
 	}()
-
 	go func() {
 		var err error
-		c_session, err = tunnel.NewSession(c_conn, false)
+		masterSide, err = tunnel.NewSession(masterConn, false)
 		errChan <- err
 	}()
-
 	for i := 0; i < 2; i++ {
 		if err := <-errChan; err != nil {
 			t.Fatalf("NewSession failed: %v", err)
 		}
 	}
-	_ = s_session // Avoid unused error
+	t.Cleanup(func() {
+		agentSide.Mux.Close()
+		masterSide.Mux.Close()
+	})
+	return agentSide, masterSide
+}
 
-	f := NewForwarder(c_session, "test-remote", nil, "user@host", false)
+// newTestForwarder returns a local only Forwarder on a new session, and the
+// agent side of that session.
+func newTestForwarder(t *testing.T) (*Forwarder, *tunnel.Session) {
+	t.Helper()
+	agentSide, masterSide := newSessionPair(t)
+	return NewForwarder(masterSide, "test-remote", nil, "user@host", true), agentSide
+}
+
+// playAgent hands each stream the master opens on s to handle along with its
+// header, the way the agent serves them.
+func playAgent(s *tunnel.Session, handle func(protocol.StreamHeader, io.ReadWriteCloser)) {
+	go func() {
+		for {
+			stream, err := s.Mux.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				var header protocol.StreamHeader
+				if err := gob.NewDecoder(stream).Decode(&header); err != nil {
+					return
+				}
+				handle(header, stream)
+			}()
+		}
+	}()
+}
+
+// echoStreams makes playAgent accept every stream, report its header on
+// headers and echo it.
+func echoStreams(headers chan<- protocol.StreamHeader) func(protocol.StreamHeader, io.ReadWriteCloser) {
+	return func(header protocol.StreamHeader, stream io.ReadWriteCloser) {
+		if headers != nil {
+			headers <- header
+		}
+		_, _ = stream.Write([]byte{1})
+		_, _ = io.Copy(stream, stream)
+	}
+}
+
+// assertEcho sends ping through rw and expects it back.
+func assertEcho(t *testing.T, rw io.ReadWriter) {
+	t.Helper()
+	if _, err := rw.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(rw, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("Expected echo 'ping', got %q (err %v)", buf, err)
+	}
+}
+
+func TestForwarder(t *testing.T) {
+	f, _ := newTestForwarder(t)
 
-	// Test ListenAndForward
 	// Use :0 to get an ephemeral port
-	err := f.ListenAndForward(":0", "localhost", 1234, false)
-	if err != nil {
+	if err := f.ListenAndForward(":0", "localhost", 1234, false); err != nil {
 		t.Fatalf("ListenAndForward failed: %v", err)
 	}
-
 	entries := f.GetForwardEntries()
 	if len(entries) != 1 {
-		t.Errorf("Expected 1 entry, got %d", len(entries))
+		t.Fatalf("Expected 1 entry, got %d", len(entries))
+	}
+	if !strings.HasPrefix(entries[0].LocalAddr, "127.0.0.1:") {
+		t.Errorf("Expected localAddr to start with 127.0.0.1:, got %s", entries[0].LocalAddr)
 	}
 
 	var masterPort uint16
 	for p := range f.listeners {
 		masterPort = p
-		break
+	}
+	if !f.CloseForward(masterPort) {
+		t.Errorf("CloseForward failed")
+	}
+	if len(f.GetForwardEntries()) != 0 {
+		t.Errorf("Expected 0 entries after close")
+	}
+
+	// Without localOnly forwards listen on every address
+	f2 := NewForwarder(nil, "test-remote", nil, "user@host", false)
+	if err := f2.ListenAndForward(":0", "localhost", 1234, false); err != nil {
+		t.Fatalf("ListenAndForward failed: %v", err)
+	}
+	for _, e := range f2.GetForwardEntries() {
+		if !strings.HasPrefix(e.LocalAddr, "0.0.0.0:") {
+			t.Errorf("Expected localAddr to start with 0.0.0.0:, got %s", e.LocalAddr)
+		}
+	}
+}
+
+func TestReverseForward(t *testing.T) {
+	agentSide, masterSide := newSessionPair(t)
+
+	// Master-side service the reverse forward points at
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	masterPort := uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	f := NewForwarder(masterSide, "test-remote", nil, "user@host", true)
+	go f.ServeStreams(masterSide)
+	go func() {
+		for {
+			msg, err := masterSide.Receive()
+			if err != nil {
+				return
+			}
+			if resp, ok := msg.(protocol.ListenResponse); ok {
+				f.HandleListenResponse(resp)
+			}
+		}
+	}()
+
+	// Play the agent: confirm the ListenRequest
+	go func() {
+		msg, err := agentSide.Receive()
+		if err != nil {
+			return
+		}
+		req := msg.(protocol.ListenRequest)
+		_ = agentSide.Send(protocol.ListenResponse{
+			RemotePort: req.RemotePort,
+			LocalPort:  6000,
+			Success:    true,
+		})
+	}()
+
+	if err := f.ListenReverse(6000, masterPort); err != nil {
+		t.Fatalf("ListenReverse failed: %v", err)
+	}
+	entries := f.GetForwardEntries()
+	if len(entries) != 1 || !entries[0].Reverse || entries[0].RemotePort != 6000 {
+		t.Fatalf("Unexpected entries: %+v", entries)
+	}
+
+	// Agent opens a stream back to the master
+	openStream := func(port uint16) io.ReadWriteCloser {
+		stream, err := agentSide.Mux.OpenStream()
+		if err != nil {
+			t.Fatalf("OpenStream failed: %v", err)
+		}
+		if err := gob.NewEncoder(stream).Encode(protocol.StreamHeader{Host: "localhost", Port: port}); err != nil {
+			t.Fatalf("Encode header failed: %v", err)
+		}
+		return stream
+	}
+
+	stream := openStream(masterPort)
+	defer stream.Close()
+	ack := make([]byte, 1)
+	if _, err := io.ReadFull(stream, ack); err != nil || ack[0] != 1 {
+		t.Fatalf("Expected ACK, got %v (err %v)", ack, err)
+	}
+	assertEcho(t, stream)
+
+	// Streams for unregistered targets must be refused
+	other := openStream(masterPort + 1)
+	defer other.Close()
+	if _, err := io.ReadFull(other, ack); err != nil || ack[0] != 0 {
+		t.Fatalf("Expected NAK, got %v (err %v)", ack, err)
+	}
+
+	if !f.CloseReverse(6000) {
+		t.Errorf("CloseReverse failed")
+	}
+}
+
+func TestDynamicForward(t *testing.T) {
+	f, agentSide := newTestForwarder(t)
+	headers := make(chan protocol.StreamHeader, 2)
+	playAgent(agentSide, echoStreams(headers))
+
+	if err := f.ListenDynamic(":0"); err != nil {
+		t.Fatalf("ListenDynamic failed: %v", err)
+	}
+	var addr string
+	for _, ln := range f.listeners {
+		addr = ln.Addr().String()
+	}
+	if entries := f.GetForwardEntries(); len(entries) != 1 || !entries[0].Dynamic {
+		t.Fatalf("Unexpected entries: %+v", entries)
+	}
+
+	// SOCKS5 CONNECT with a domain name
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{0x05, 0x01, 0x00})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0x00 {
+		t.Fatalf("Unexpected greeting reply %v (err %v)", reply, err)
+	}
+	domain := "db.internal"
+	req := append([]byte{0x05, 0x01, 0x00, 0x03, byte(len(domain))}, domain...)
+	req = append(req, 0x15, 0x38) // 5432
+	conn.Write(req)
+	reply = make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0x00 {
+		t.Fatalf("Unexpected connect reply %v (err %v)", reply, err)
+	}
+	if h := <-headers; h.Host != domain || h.Port != 5432 {
+		t.Errorf("Unexpected stream header %+v", h)
+	}
+	assertEcho(t, conn)
+
+	// HTTP CONNECT
+	conn2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn2.Close()
+	conn2.Write([]byte("CONNECT web.internal:443 HTTP/1.1\r\nHost: web.internal:443\r\n\r\n"))
+	status := make([]byte, len("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if _, err := io.ReadFull(conn2, status); err != nil || !strings.HasPrefix(string(status), "HTTP/1.1 200") {
+		t.Fatalf("Unexpected CONNECT reply %q (err %v)", status, err)
+	}
+	if h := <-headers; h.Host != "web.internal" || h.Port != 443 {
+		t.Errorf("Unexpected stream header %+v", h)
+	}
+	assertEcho(t, conn2)
+}
+
+func TestUDPForward(t *testing.T) {
+	f, agentSide := newTestForwarder(t)
+
+	// Play the agent: echo every packet of every flow
+	playAgent(agentSide, func(header protocol.StreamHeader, stream io.ReadWriteCloser) {
+		if header.Network != protocol.ProtocolUDP {
+			stream.Write([]byte{0})
+			return
+		}
+		stream.Write([]byte{1})
+		flow := tunnel.NewPacketFlow(agentSide, stream, header.FlowID, header.Datagrams)
+		defer flow.Close()
+		for {
+			p, err := flow.ReadPacket()
+			if err != nil {
+				return
+			}
+			flow.WritePacket(p)
+		}
+	})
+
+	if err := f.ListenUDPAndForward(":0", "localhost", 53, false); err != nil {
+		t.Fatalf("ListenUDPAndForward failed: %v", err)
+	}
+	var masterPort uint16
+	var addr string
+	for p, u := range f.udp {
+		masterPort = p
+		addr = u.pc.LocalAddr().String()
+	}
+	if entries := f.GetForwardEntries(); len(entries) != 1 || entries[0].Protocol != protocol.ProtocolUDP {
+		t.Fatalf("Unexpected entries: %+v", entries)
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	for _, msg := range []string{"ping", "pong"} {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != msg {
+			t.Fatalf("Expected echo %q, got %q (err %v)", msg, buf[:n], err)
+		}
 	}
 
-	if masterPort == 0 {
-		t.Fatal("Failed to get master port")
+	if !f.CloseUDPForward(masterPort) {
+		t.Errorf("CloseUDPForward failed")
 	}
+}
+
+func TestForwardStats(t *testing.T) {
+	f, agentSide := newTestForwarder(t)
 
-	// Test CloseForward
+	// Play the agent: echo one message on port 1234 and hang up once done is
+	// closed, refuse everything else
+	done := make(chan struct{})
+	playAgent(agentSide, func(header protocol.StreamHeader, stream io.ReadWriteCloser) {
+		if header.Port != 1234 {
+			stream.Write([]byte{0})
+			return
+		}
+		stream.Write([]byte{1})
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(stream, buf); err == nil {
+			stream.Write(buf)
+		}
+		<-done
+	})
+
+	if err := f.ListenAndForward(":0", "localhost", 1234, false); err != nil {
+		t.Fatalf("ListenAndForward failed: %v", err)
+	}
+	if err := f.ListenAndForward(":0", "localhost", 4321, false); err != nil {
+		t.Fatalf("ListenAndForward failed: %v", err)
+	}
+	addrs := make(map[uint16]string)
+	for p, ln := range f.listeners {
+		addrs[f.forwards[p].RemotePort] = ln.Addr().String()
+	}
+
+	conn, err := net.Dial("tcp", addrs[1234])
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	assertEcho(t, conn)
+
+	// The refused target should count a failed dial and no connection
+	refused, err := net.Dial("tcp", addrs[4321])
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	_, _ = refused.Read(make([]byte, 1))
+	refused.Close()
+
+	stats := func() map[uint16]protocol.ForwardStats {
+		res := make(map[uint16]protocol.ForwardStats)
+		for _, e := range f.GetForwardEntries() {
+			res[e.RemotePort] = e.Stats
+		}
+		return res
+	}
+
+	st := stats()[1234]
+	if st.ActiveConns != 1 || st.TotalConns != 1 || st.BytesIn != 4 || st.BytesOut != 4 || st.LastActive.IsZero() {
+		t.Errorf("Unexpected stats while connected: %+v", st)
+	}
+	if st := stats()[4321]; st.FailedDials != 1 || st.TotalConns != 0 {
+		t.Errorf("Unexpected stats for refused target: %+v", st)
+	}
+
+	conn.Close()
+	close(done)
+	deadline := time.Now().Add(2 * time.Second)
+	for stats()[1234].ActiveConns != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Connection still counted as active: %+v", stats()[1234])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestResolveLocalAddr(t *testing.T) {
+	tests := []struct {
+		localOnly bool
+		in        string
+		addr      string
+		port      uint16
+	}{
+		{false, ":8080", "0.0.0.0:8080", 8080},
+		{true, ":8080", "127.0.0.1:8080", 8080},
+		{true, "[::1]:8081", "[::1]:8081", 8081},
+		{false, "[::]:8082", "[::]:8082", 8082},
+		{false, "192.168.1.5:8083", "192.168.1.5:8083", 8083},
+		{false, "[fe80::1%eth0]:8084", "[fe80::1%eth0]:8084", 8084},
+	}
+
+	for _, tt := range tests {
+		f := NewForwarder(nil, "test-remote", nil, "user@host", tt.localOnly)
+		addr, port := f.resolveLocalAddr(tt.in)
+		if addr != tt.addr || port != tt.port {
+			t.Errorf("resolveLocalAddr(%q) = %q, %d; want %q, %d", tt.in, addr, port, tt.addr, tt.port)
+		}
+	}
+}
+
+func TestUnixForward(t *testing.T) {
+	f, agentSide := newTestForwarder(t)
+
+	// Play the agent: only accept unix streams for the docker socket, then echo
+	echo := echoStreams(nil)
+	playAgent(agentSide, func(header protocol.StreamHeader, stream io.ReadWriteCloser) {
+		if header.Network != protocol.ProtocolUnix || header.Path != "/var/run/docker.sock" {
+			stream.Write([]byte{0})
+			return
+		}
+		echo(header, stream)
+	})
+
+	dial := func(network, addr string) {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer conn.Close()
+		assertEcho(t, conn)
+	}
+
+	// Remote socket -> local unix socket
+	localPath := filepath.Join(t.TempDir(), "docker.sock")
+	if err := f.ListenUnixAndForward("unix:"+localPath, "/var/run/docker.sock"); err != nil {
+		t.Fatalf("ListenUnixAndForward failed: %v", err)
+	}
+	dial("unix", localPath)
+
+	// Remote socket -> local TCP port
+	if err := f.ListenUnixAndForward(":0", "/var/run/docker.sock"); err != nil {
+		t.Fatalf("ListenUnixAndForward failed: %v", err)
+	}
+	var masterPort uint16
+	var addr string
+	for p, ln := range f.listeners {
+		masterPort, addr = p, ln.Addr().String()
+	}
+	dial("tcp", addr)
+
+	entries := f.GetForwardEntries()
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %+v", entries)
+	}
+	for _, e := range entries {
+		if e.Protocol != protocol.ProtocolUnix || e.RemotePath != "/var/run/docker.sock" {
+			t.Errorf("Unexpected entry %+v", e)
+		}
+	}
+
+	if !f.CloseUnixForward(localPath) {
+		t.Errorf("CloseUnixForward failed")
+	}
 	if !f.CloseForward(masterPort) {
 		t.Errorf("CloseForward failed")
 	}
+}
 
-	if len(f.GetForwardEntries()) != 0 {
-		t.Errorf("Expected 0 entries after close")
+func TestVHostForward(t *testing.T) {
+	agentSide, masterSide := newSessionPair(t)
+	headers := make(chan protocol.StreamHeader, 2)
+	playAgent(agentSide, echoStreams(headers))
+
+	// Route hosts are lower case
+	f := NewForwarder(masterSide, "Test-Remote", nil, "user@host", true)
+	if err := f.ListenVHost(":0"); err != nil {
+		t.Fatalf("ListenVHost failed: %v", err)
+	}
+	if err := f.AddRoute("web", "localhost", 3000, false); err != nil {
+		t.Fatalf("AddRoute failed: %v", err)
+	}
+	if err := f.AddRoute("api", "localhost", 8080, false); err != nil {
+		t.Fatalf("AddRoute failed: %v", err)
+	}
+	if err := f.AddRoute("web", "localhost", 3001, false); err == nil {
+		t.Errorf("Expected error for duplicate route")
+	}
+	if err := f.AddRoute("not_valid", "localhost", 3001, false); err == nil {
+		t.Errorf("Expected error for invalid route name")
 	}
 
-	// Test localOnly
-	f2 := NewForwarder(nil, "test-remote", nil, "user@host", true)
-	err = f2.ListenAndForward(":0", "localhost", 1234, false)
+	addr := f.vhostLn.Addr().String()
+	_, port, _ := net.SplitHostPort(addr)
+	if got := f.RouteAddr("web"); got != "web.test-remote.localhost:"+port {
+		t.Errorf("Unexpected route address %s", got)
+	}
+	if entries := f.GetForwardEntries(); len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %+v", entries)
+	}
+
+	// HTTP is routed by Host and the request is passed on unchanged
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	req := "GET / HTTP/1.1\r\nHost: web.test-remote.localhost:" + port + "\r\n\r\n"
+	conn.Write([]byte(req))
+	if h := <-headers; h.Host != "localhost" || h.Port != 3000 {
+		t.Errorf("Unexpected stream header %+v", h)
+	}
+	buf := make([]byte, len(req))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != req {
+		t.Fatalf("Expected echoed request, got %q (err %v)", buf, err)
+	}
+
+	// TLS is routed by SNI
+	conn2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn2.Close()
+	go tls.Client(conn2, &tls.Config{ServerName: "api.test-remote.localhost"}).Handshake()
+	select {
+	case h := <-headers:
+		if h.Port != 8080 {
+			t.Errorf("Unexpected stream header %+v", h)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("TLS connection was not routed")
+	}
+
+	// Unknown hosts get a 404
+	conn3, err := net.Dial("tcp", addr)
 	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn3.Close()
+	conn3.Write([]byte("GET / HTTP/1.1\r\nHost: nope.test-remote.localhost\r\n\r\n"))
+	status, _ := io.ReadAll(conn3)
+	if !strings.HasPrefix(string(status), "HTTP/1.1 404") {
+		t.Errorf("Expected 404, got %q", status)
+	}
+
+	if !f.CloseRoute("web") {
+		t.Errorf("CloseRoute failed")
+	}
+	if f.CloseRoute("web") {
+		t.Errorf("CloseRoute succeeded twice")
+	}
+}
+
+func TestRemapBusyPort(t *testing.T) {
+	// Something else already listens on the requested port
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer busy.Close()
+	port := uint16(busy.Addr().(*net.TCPAddr).Port)
+	localAddr := fmt.Sprintf(":%d", port)
+
+	f := NewForwarder(nil, "test-remote", nil, "user@host", true)
+	if err := f.ListenAndForward(localAddr, "localhost", 3000, true); err == nil {
+		t.Fatalf("Expected busy port to fail without a remap policy")
+	}
+
+	policy, err := ParseRemapPolicy("")
+	if err != nil {
+		t.Fatalf("ParseRemapPolicy failed: %v", err)
+	}
+	f.SetRemapPolicy(policy)
+	if err := f.ListenAndForward(localAddr, "localhost", 3000, true); err != nil {
+		t.Fatalf("ListenAndForward with remap failed: %v", err)
+	}
+
+	actual := f.ActualPort(port)
+	if actual == port {
+		t.Fatalf("Expected port %d to be remapped", port)
+	}
+	entries := f.GetForwardEntries()
+	if len(entries) != 1 || entries[0].RemappedFrom != port || entries[0].Error != "" {
+		t.Fatalf("Unexpected entries: %+v", entries)
+	}
+	if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", actual)); err != nil {
+		t.Errorf("Remapped port %d is not listening: %v", actual, err)
+	} else {
+		conn.Close()
+	}
+
+	// The same request again is a duplicate, not another remap
+	if err := f.ListenAndForward(localAddr, "localhost", 3000, true); err == nil {
+		t.Errorf("Expected duplicate forward to fail")
+	}
+
+	// Closing by the requested port closes the remapped listener
+	if !f.CloseForward(port) {
+		t.Fatalf("CloseForward(%d) failed", port)
+	}
+	if len(f.GetForwardEntries()) != 0 {
+		t.Errorf("Expected no entries after close")
+	}
+
+	// A remap from an earlier session is tried first, even if the port is free
+	busy.Close()
+	f.RestoreRemaps(map[string]string{fmt.Sprintf("%d", port): fmt.Sprintf("%d", actual)})
+	if err := f.ListenAndForward(localAddr, "localhost", 3000, false); err != nil {
 		t.Fatalf("ListenAndForward failed: %v", err)
 	}
-	for _, e := range f2.GetForwardEntries() {
-		if !strings.HasPrefix(e.LocalAddr, "127.0.0.1:") {
-			t.Errorf("Expected localAddr to start with 127.0.0.1:, got %s", e.LocalAddr)
+	if got := f.ActualPort(port); got != actual {
+		t.Errorf("Expected restored remap to port %d, got %d", actual, got)
+	}
+	f.CloseForward(port)
+}
+
+func TestParseRemapPolicy(t *testing.T) {
+	p, err := ParseRemapPolicy("+10000")
+	if err != nil {
+		t.Fatalf("ParseRemapPolicy failed: %v", err)
+	}
+	if c := p.candidates(3000); len(c) == 0 || c[0] != 13000 {
+		t.Errorf("Unexpected candidates %v", c)
+	}
+
+	p, err = ParseRemapPolicy("20000-20002")
+	if err != nil {
+		t.Fatalf("ParseRemapPolicy failed: %v", err)
+	}
+	if c := p.candidates(20001); len(c) != 2 || c[0] != 20000 || c[1] != 20002 {
+		t.Errorf("Unexpected candidates %v", c)
+	}
+
+	p, _ = ParseRemapPolicy("")
+	if c := p.candidates(65534); len(c) != 1 || c[0] != 65535 {
+		t.Errorf("Unexpected candidates %v", c)
+	}
+
+	for _, s := range []string{"+0", "+abc", "2000-1000", "abc", "0-10"} {
+		if _, err := ParseRemapPolicy(s); err == nil {
+			t.Errorf("ParseRemapPolicy(%q) expected error", s)
 		}
 	}
+}
 
-	// Test default (0.0.0.0)
-	f3 := NewForwarder(nil, "test-remote", nil, "user@host", false)
-	err = f3.ListenAndForward(":0", "localhost", 1234, false)
+func TestForwardLabels(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	mgr, err := state.NewManager()
 	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+
+	freePort := func() uint16 {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		defer ln.Close()
+		return uint16(ln.Addr().(*net.TCPAddr).Port)
+	}
+	p1, p2 := freePort(), freePort()
+
+	f := NewForwarder(nil, "test-remote", mgr, "user@host", true)
+	err = f.HandleListenRequest(protocol.ListenRequest{
+		LocalAddr:  fmt.Sprintf(":%d", p1),
+		RemoteHost: "localhost",
+		RemotePort: 5432,
+		Protocol:   protocol.ProtocolTCP,
+		Name:       "pg",
+	})
+	if err != nil {
+		t.Fatalf("HandleListenRequest failed: %v", err)
+	}
+	entries := f.GetForwardEntries()
+	if len(entries) != 1 || entries[0].Name != "pg" {
+		t.Fatalf("Unexpected entries: %+v", entries)
+	}
+	if got := mgr.GetLabels("user@host")[fmt.Sprintf("tcp:%d", p1)]; got != "pg" {
+		t.Errorf("Expected label to be saved, got %q", got)
+	}
+
+	// A manual forward cannot take a name in use, an auto forward gets the
+	// port appended
+	req := protocol.ListenRequest{
+		LocalAddr:  fmt.Sprintf(":%d", p2),
+		RemoteHost: "localhost",
+		RemotePort: 6543,
+		Protocol:   protocol.ProtocolTCP,
+		Name:       "pg",
+	}
+	if err := f.HandleListenRequest(req); err == nil {
+		t.Fatalf("Expected duplicate name to fail")
+	}
+	if len(f.GetForwardEntries()) != 1 {
+		t.Fatalf("Expected the duplicate not to be forwarded")
+	}
+	req.IsAuto = true
+	if err := f.HandleListenRequest(req); err != nil {
+		t.Fatalf("HandleListenRequest failed: %v", err)
+	}
+	for _, e := range f.GetForwardEntries() {
+		if e.IsAuto && e.Name != "pg-6543" {
+			t.Errorf("Expected auto forward to be named pg-6543, got %q", e.Name)
+		}
+	}
+	if len(mgr.GetLabels("user@host")) != 1 {
+		t.Errorf("Expected auto labels not to be saved: %v", mgr.GetLabels("user@host"))
+	}
+
+	if !f.HandleCloseRequest(protocol.CloseRequest{Name: "pg"}) {
+		t.Fatalf("Closing by name failed")
+	}
+	entries = f.GetForwardEntries()
+	if len(entries) != 1 || entries[0].Name != "pg-6543" {
+		t.Errorf("Unexpected entries after close: %+v", entries)
+	}
+	if len(mgr.GetLabels("user@host")) != 0 {
+		t.Errorf("Expected label to be removed: %v", mgr.GetLabels("user@host"))
+	}
+	f.CloseForward(p2)
+
+	// Labels saved by an earlier session apply to restored forwards
+	f.RestoreLabels(map[string]string{fmt.Sprintf("tcp:%d", p1): "db"})
+	if err := f.ListenAndForward(fmt.Sprintf(":%d", p1), "localhost", 5432, false); err != nil {
 		t.Fatalf("ListenAndForward failed: %v", err)
 	}
-	for _, e := range f3.GetForwardEntries() {
-		if !strings.HasPrefix(e.LocalAddr, "0.0.0.0:") {
-			t.Errorf("Expected localAddr to start with 0.0.0.0:, got %s", e.LocalAddr)
+	if entries := f.GetForwardEntries(); len(entries) != 1 || entries[0].Name != "db" {
+		t.Errorf("Expected restored label, got %+v", entries)
+	}
+	f.CloseForward(p1)
+}
+
+func TestPinAndLocalOnly(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	mgr, err := state.NewManager()
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+	ln.Close()
+
+	f := NewForwarder(nil, "test-remote", mgr, "user@host", true)
+	f.SetAutoForward(true)
+	if !f.GetList().AutoForward || !f.GetList().LocalOnly {
+		t.Errorf("Expected auto forward and local-only in the list: %+v", f.GetList())
+	}
+
+	err = f.HandleListenRequest(protocol.ListenRequest{
+		LocalAddr:  fmt.Sprintf(":%d", port),
+		RemoteHost: "localhost",
+		RemotePort: port,
+		Protocol:   protocol.ProtocolTCP,
+		IsAuto:     true,
+		User:       "alice",
+		RemoteBind: "0.0.0.0",
+	})
+	if err != nil {
+		t.Fatalf("HandleListenRequest failed: %v", err)
+	}
+	if entries := f.GetForwardEntries(); len(entries) != 1 || entries[0].User != "alice" || entries[0].RemoteBind != "0.0.0.0" {
+		t.Errorf("Expected the owner and bind in the entry, got %+v", entries)
+	}
+	if f.hasManualForward(port) {
+		t.Errorf("Expected auto forward not to count as manual")
+	}
+
+	if err := f.Pin(port + 1); err == nil {
+		t.Errorf("Expected pinning an unknown port to fail")
+	}
+	if err := f.Pin(port); err != nil {
+		t.Fatalf("Pin failed: %v", err)
+	}
+	if err := f.Pin(port); err == nil {
+		t.Errorf("Expected pinning a manual forward to fail")
+	}
+	if !f.hasManualForward(port) {
+		t.Errorf("Expected pinned forward to count as manual")
+	}
+	if got := mgr.GetForwards("user@host")[fmt.Sprintf("%d", port)]; got != fmt.Sprintf("%d", port) {
+		t.Errorf("Expected pinned forward to be saved, got %q", got)
+	}
+
+	// The auto forwarder closing the remote port leaves a pinned forward
+	if f.HandleCloseRequest(protocol.CloseRequest{Port: port, IsAuto: true}) {
+		t.Errorf("Expected auto close of a pinned forward to be ignored")
+	}
+	if len(f.GetForwardEntries()) != 1 {
+		t.Fatalf("Expected pinned forward to stay")
+	}
+
+	// Switching local-only rebinds the running forward
+	f.SetLocalOnly(false)
+	entries := f.GetForwardEntries()
+	if len(entries) != 1 || entries[0].LocalAddr != fmt.Sprintf("0.0.0.0:%d", port) || entries[0].Error != "" {
+		t.Fatalf("Expected forward on all interfaces, got %+v", entries)
+	}
+	if f.GetList().LocalOnly {
+		t.Errorf("Expected local-only off in the list")
+	}
+	f.SetLocalOnly(true)
+	entries = f.GetForwardEntries()
+	if len(entries) != 1 || entries[0].LocalAddr != fmt.Sprintf("127.0.0.1:%d", port) {
+		t.Fatalf("Expected forward on loopback, got %+v", entries)
+	}
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("Expected rebound forward to accept: %v", err)
+	}
+	conn.Close()
+
+	f.CloseForward(port)
+}
+
+func TestSetService(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+	ln.Close()
+
+	f := NewForwarder(nil, "test-remote", nil, "user@host", true)
+	if err := f.ListenAndForward(fmt.Sprintf(":%d", port), "localhost", 3000, true); err != nil {
+		t.Fatalf("ListenAndForward failed: %v", err)
+	}
+	defer f.CloseForward(port)
+
+	want := protocol.ProbeRequest{Host: "localhost", Port: 3000}
+	if got := f.ProbeTargets(); len(got) != 1 || got[0] != want {
+		t.Errorf("ProbeTargets() = %+v, want %+v", got, want)
+	}
+
+	f.SetService(protocol.ProbeResult{Host: "localhost", Port: 3000, Service: protocol.ServiceHTTP, Title: "Vite App"})
+	entries := f.GetForwardEntries()
+	if len(entries) != 1 || entries[0].Service != protocol.ServiceHTTP || entries[0].Title != "Vite App" ||
+		entries[0].URL != fmt.Sprintf("http://127.0.0.1:%d", port) {
+		t.Errorf("Expected the service in the entry, got %+v", entries)
+	}
+	if got := f.ProbeTargets(); len(got) != 0 {
+		t.Errorf("Expected no probe for a known service, got %+v", got)
+	}
+}
+
+func TestBrowseAddr(t *testing.T) {
+	tests := map[string]string{
+		":3000":        "localhost:3000",
+		"0.0.0.0:3000": "localhost:3000",
+		"[::]:3000":    "localhost:3000",
+		"127.0.0.1:80": "127.0.0.1:80",
+		"[::1]:8080":   "[::1]:8080",
+		"not-an-addr":  "not-an-addr",
+	}
+	for in, want := range tests {
+		if got := BrowseAddr(in); got != want {
+			t.Errorf("BrowseAddr(%q) = %q, want %q", in, got, want)
 		}
 	}
 }
@@ -0,0 +1,123 @@
+package forward
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/liyu1981/moshpf/pkg/protocol"
+	"github.com/rs/zerolog/log"
+)
+
+// requestKey returns the key labelling the forward a ListenRequest starts,
+// see stats.go. TCP forwards are keyed by the requested port, so the label
+// survives a remap.
+func (f *Forwarder) requestKey(m protocol.ListenRequest) string {
+	if m.VHost != "" {
+		return routeKey(strings.ToLower(m.VHost))
+	}
+	if path, ok := strings.CutPrefix(m.LocalAddr, "unix:"); ok {
+		return unixKey(path)
+	}
+	_, port := f.resolveLocalAddr(m.LocalAddr)
+	if m.Protocol == protocol.ProtocolUDP {
+		return udpKey(port)
+	}
+	return tcpKey(port)
+}
+
+// entryLabelLocked returns the label of the TCP forward e listening on port.
+func (f *Forwarder) entryLabelLocked(port uint16, e protocol.ForwardEntry) string {
+	if e.RemappedFrom != 0 {
+		port = e.RemappedFrom
+	}
+	return f.labels[tcpKey(port)]
+}
+
+// checkLabel fails when name already labels a forward other than key.
+func (f *Forwarder) checkLabel(key, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.checkLabelLocked(key, name)
+}
+
+func (f *Forwarder) checkLabelLocked(key, name string) error {
+	if name == "" {
+		return nil
+	}
+	for k, n := range f.labels {
+		if n == name && k != key {
+			return fmt.Errorf("name %s is already used by another forward", name)
+		}
+	}
+	return nil
+}
+
+// setLabel names the forward stored under key, or removes its name when name
+// is empty. persist keeps the change in the state file.
+func (f *Forwarder) setLabel(key, name string, persist bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkLabelLocked(key, name); err != nil {
+		return err
+	}
+	if name != "" {
+		f.labels[key] = name
+	} else {
+		delete(f.labels, key)
+	}
+
+	if f.state != nil && persist {
+		_ = f.state.SetLabel(f.target, key, name)
+	}
+	return nil
+}
+
+// RestoreLabels loads the forward labels saved by an earlier session.
+func (f *Forwarder) RestoreLabels(labels map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for key, name := range labels {
+		f.labels[key] = name
+	}
+}
+
+// closeNamed closes every forward labelled name and reports whether an
+// active forward was closed.
+func (f *Forwarder) closeNamed(name string) bool {
+	f.mu.Lock()
+	var keys []string
+	for k, n := range f.labels {
+		if n == name {
+			keys = append(keys, k)
+		}
+	}
+	f.mu.Unlock()
+
+	closed := false
+	for _, key := range keys {
+		kind, v, _ := strings.Cut(key, ":")
+		port, _ := strconv.ParseUint(v, 10, 16)
+		switch kind {
+		case "tcp":
+			closed = f.CloseForward(uint16(port)) || closed
+		case "udp":
+			closed = f.CloseUDPForward(uint16(port)) || closed
+		case "unix":
+			closed = f.CloseUnixForward(v) || closed
+		case "host":
+			closed = f.CloseRoute(v) || closed
+		}
+		// A forward that was not running still drops its label
+		_ = f.setLabel(key, "", true)
+	}
+
+	log.Info().
+		Str("remote", f.remoteName).
+		Str("name", name).
+		Int("forwards", len(keys)).
+		Msg("Named forwards closed")
+	return closed
+}
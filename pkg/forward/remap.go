@@ -0,0 +1,115 @@
+package forward
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// remapSearchLimit is how many ports are tried after the first candidate
+// when looking for a free one.
+const remapSearchLimit = 100
+
+// RemapPolicy picks another master port for a TCP forward whose port is busy.
+// The zero value tries the ports following the busy one.
+type RemapPolicy struct {
+	// Offset is added to the busy port to get the first candidate.
+	Offset int
+	// First and Last, when set, restrict candidates to that range.
+	First uint16
+	Last  uint16
+}
+
+// ParseRemapPolicy parses the value of --remap-busy: empty for the next free
+// port, "+N" to start at the busy port plus N, or "A-B" for a port range.
+func ParseRemapPolicy(s string) (*RemapPolicy, error) {
+	p := &RemapPolicy{}
+	if s == "" {
+		return p, nil
+	}
+
+	if offset, ok := strings.CutPrefix(s, "+"); ok {
+		n, err := strconv.ParseUint(offset, 10, 16)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid remap offset: %s", s)
+		}
+		p.Offset = int(n)
+		return p, nil
+	}
+
+	firstStr, lastStr, found := strings.Cut(s, "-")
+	first, err1 := strconv.ParseUint(firstStr, 10, 16)
+	last, err2 := strconv.ParseUint(lastStr, 10, 16)
+	if !found || err1 != nil || err2 != nil || first == 0 || last < first {
+		return nil, fmt.Errorf("invalid remap range: %s", s)
+	}
+	p.First, p.Last = uint16(first), uint16(last)
+	return p, nil
+}
+
+// candidates lists the ports to try, in order, when port is busy.
+func (p *RemapPolicy) candidates(port uint16) []uint16 {
+	var res []uint16
+	if p.First != 0 {
+		for c := int(p.First); c <= int(p.Last); c++ {
+			if c != int(port) {
+				res = append(res, uint16(c))
+			}
+		}
+		return res
+	}
+
+	start := int(port) + 1
+	if p.Offset != 0 {
+		start = int(port) + p.Offset
+	}
+	for c := start; c < start+remapSearchLimit && c <= 65535; c++ {
+		res = append(res, uint16(c))
+	}
+	return res
+}
+
+// SetRemapPolicy enables remapping of busy master ports for TCP forwards.
+func (f *Forwarder) SetRemapPolicy(p *RemapPolicy) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.remap = p
+}
+
+// RestoreRemaps loads requested -> actual master ports saved by an earlier
+// session, so that the same remap is tried first.
+func (f *Forwarder) RestoreRemaps(remaps map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for reqStr, actualStr := range remaps {
+		requested, err1 := strconv.ParseUint(reqStr, 10, 16)
+		actual, err2 := strconv.ParseUint(actualStr, 10, 16)
+		if err1 == nil && err2 == nil {
+			f.remapped[uint16(requested)] = uint16(actual)
+		}
+	}
+}
+
+// ActualPort returns the master port a forward requested on port ended up on.
+func (f *Forwarder) ActualPort(port uint16) uint16 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if actual, ok := f.remapped[port]; ok {
+		return actual
+	}
+	return port
+}
+
+func isAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
+
+func withPort(addr string, port uint16) string {
+	host, _, _ := net.SplitHostPort(addr)
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
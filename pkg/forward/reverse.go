@@ -0,0 +1,228 @@
+package forward
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/liyu1981/moshpf/pkg/protocol"
+	"github.com/liyu1981/moshpf/pkg/tunnel"
+	"github.com/liyu1981/moshpf/pkg/util"
+	"github.com/rs/zerolog/log"
+)
+
+// AddReverse registers a reverse forward: the agent listens on remotePort and
+// every connection it accepts is dialed to masterHost:masterPort on this side.
+// The agent is asked to listen right away if a session is available, otherwise
+// the request is sent by SyncReverses once a session comes up.
+func (f *Forwarder) AddReverse(remotePort uint16, masterHost string, masterPort uint16) error {
+	f.mu.Lock()
+	if _, exists := f.reverses[remotePort]; exists {
+		f.mu.Unlock()
+		return fmt.Errorf("remote port %d already has a reverse forward", remotePort)
+	}
+
+	f.newStatsLocked(reverseKey(remotePort))
+	f.reverses[remotePort] = protocol.ForwardEntry{
+		LocalAddr:  net.JoinHostPort(masterHost, strconv.Itoa(int(masterPort))),
+		RemoteHost: "localhost",
+		RemotePort: remotePort,
+		Protocol:   protocol.ProtocolTCP,
+		Reverse:    true,
+	}
+
+	if f.state != nil {
+		_ = f.state.AddReverse(f.target, fmt.Sprintf("%d", remotePort), fmt.Sprintf("%d", masterPort))
+	}
+	f.mu.Unlock()
+
+	s := f.getBestSession()
+	if s == nil {
+		return nil
+	}
+	return s.Send(reverseListenRequest(remotePort, masterHost, masterPort))
+}
+
+// ListenReverse registers a reverse forward and waits for the agent to confirm
+// that it is listening. On failure the reverse forward is dropped again.
+func (f *Forwarder) ListenReverse(remotePort, masterPort uint16) error {
+	ch := make(chan protocol.ListenResponse, 1)
+	f.mu.Lock()
+	f.pending[remotePort] = ch
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		delete(f.pending, remotePort)
+		f.mu.Unlock()
+	}()
+
+	if err := f.AddReverse(remotePort, "localhost", masterPort); err != nil {
+		return err
+	}
+
+	select {
+	case resp := <-ch:
+		if !resp.Success {
+			f.removeReverse(remotePort)
+			return fmt.Errorf("%s", resp.Reason)
+		}
+		return nil
+	case <-time.After(5 * time.Second):
+		f.removeReverse(remotePort)
+		return fmt.Errorf("timeout waiting for agent to listen on port %d", remotePort)
+	}
+}
+
+// SyncReverses asks the agent on s to listen for every registered reverse
+// forward. It is called whenever a new tunnel is established.
+func (f *Forwarder) SyncReverses(s *tunnel.Session) {
+	f.mu.Lock()
+	reqs := make([]protocol.ListenRequest, 0, len(f.reverses))
+	for remotePort, e := range f.reverses {
+		host, portStr, err := net.SplitHostPort(e.LocalAddr)
+		if err != nil {
+			continue
+		}
+		masterPort, _ := strconv.ParseUint(portStr, 10, 16)
+		reqs = append(reqs, reverseListenRequest(remotePort, host, uint16(masterPort)))
+	}
+	f.mu.Unlock()
+
+	for _, req := range reqs {
+		if err := s.Send(req); err != nil {
+			log.Error().Err(err).Str("addr", req.LocalAddr).Msg("Failed to send reverse ListenRequest")
+		}
+	}
+}
+
+// HandleListenResponse records the agent's answer to a reverse ListenRequest.
+func (f *Forwarder) HandleListenResponse(resp protocol.ListenResponse) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if ch, ok := f.pending[resp.LocalPort]; ok {
+		select {
+		case ch <- resp:
+		default:
+		}
+	}
+
+	e, ok := f.reverses[resp.LocalPort]
+	if !ok {
+		return
+	}
+	if resp.Success {
+		e.Error = ""
+		log.Info().Uint16("remote", resp.LocalPort).Str("local", e.LocalAddr).Msg("Reverse forwarding started")
+	} else {
+		e.Error = resp.Reason
+		log.Error().Uint16("remote", resp.LocalPort).Str("reason", resp.Reason).Msg("Reverse forwarding failed on agent")
+	}
+	f.reverses[resp.LocalPort] = e
+}
+
+// CloseReverse drops the reverse forward on remotePort and asks the agent to
+// stop listening.
+func (f *Forwarder) CloseReverse(remotePort uint16) bool {
+	if !f.removeReverse(remotePort) {
+		return false
+	}
+
+	log.Info().
+		Str("remote", f.remoteName).
+		Uint16("port", remotePort).
+		Msg("Reverse forwarding stopped")
+
+	if s := f.getBestSession(); s != nil {
+		_ = s.Send(protocol.CloseRequest{Port: remotePort})
+	}
+	return true
+}
+
+func (f *Forwarder) removeReverse(remotePort uint16) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.reverses[remotePort]; !ok {
+		return false
+	}
+	delete(f.reverses, remotePort)
+	delete(f.stats, reverseKey(remotePort))
+	if f.state != nil {
+		_ = f.state.RemoveReverse(f.target, fmt.Sprintf("%d", remotePort))
+	}
+	return true
+}
+
+// reverseTarget returns the stats of the reverse forward dialing host:port,
+// and whether there is one.
+func (f *Forwarder) reverseTarget(host string, port uint16) (*connStats, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	for remotePort, e := range f.reverses {
+		if e.LocalAddr == addr {
+			return f.stats[reverseKey(remotePort)], true
+		}
+	}
+	return nil, false
+}
+
+// ServeStreams accepts streams opened by the agent on s for reverse forwards.
+// It returns when the session is closed.
+func (f *Forwarder) ServeStreams(s *tunnel.Session) {
+	for {
+		stream, err := s.Mux.AcceptStream()
+		if err != nil {
+			return
+		}
+		go f.handleAcceptedStream(stream)
+	}
+}
+
+func (f *Forwarder) handleAcceptedStream(stream io.ReadWriteCloser) {
+	defer stream.Close()
+
+	decoder := gob.NewDecoder(stream)
+	var header protocol.StreamHeader
+	if err := decoder.Decode(&header); err != nil {
+		log.Error().Err(err).Msg("Failed to decode stream header")
+		return
+	}
+
+	target := net.JoinHostPort(header.Host, strconv.Itoa(int(header.Port)))
+	st, ok := f.reverseTarget(header.Host, header.Port)
+	if !ok {
+		log.Warn().Str("target", target).Msg("Rejected stream for unknown reverse forward")
+		_, _ = stream.Write([]byte{0}) // NAK
+		return
+	}
+
+	localConn, err := util.DialTCP(header.Host, header.Port)
+	if err != nil {
+		st.failedDial()
+		log.Error().Err(err).Str("target", target).Msg("Failed to dial reverse target")
+		_, _ = stream.Write([]byte{0}) // NAK
+		return
+	}
+	defer localConn.Close()
+
+	_, _ = stream.Write([]byte{1}) // ACK
+
+	st.opened()
+	defer st.closed()
+	util.Proxy(st.wrap(localConn), stream)
+}
+
+func reverseListenRequest(remotePort uint16, masterHost string, masterPort uint16) protocol.ListenRequest {
+	return protocol.ListenRequest{
+		LocalAddr:  fmt.Sprintf(":%d", remotePort),
+		RemoteHost: masterHost,
+		RemotePort: masterPort,
+	}
+}
@@ -0,0 +1,124 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/liyu1981/moshpf/pkg/state"
+	"github.com/rs/zerolog/log"
+)
+
+// hasManualForward reports whether a manual TCP forward listens on port,
+// either created so or pinned. The agent's auto forwarder leaves it alone.
+func (f *Forwarder) hasManualForward(port uint16) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, exists := f.forwards[port]; !exists && f.isRemappedLocked(port) {
+		port = f.remapped[port]
+	}
+	e, ok := f.forwards[port]
+	return ok && f.listeners[port] != nil && !e.IsAuto
+}
+
+// Pin turns the auto forward on port into a manual one, which is saved and
+// kept when the remote port closes.
+func (f *Forwarder) Pin(port uint16) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	masterPort := port
+	if _, exists := f.forwards[port]; !exists && f.isRemappedLocked(port) {
+		masterPort = f.remapped[port]
+	}
+	e, ok := f.forwards[masterPort]
+	if !ok || f.listeners[masterPort] == nil {
+		return fmt.Errorf("no active forward on port %d", port)
+	}
+	if !e.IsAuto {
+		return fmt.Errorf("port %d is not auto forwarded", port)
+	}
+	e.IsAuto = false
+	f.forwards[masterPort] = e
+
+	requested := masterPort
+	if e.RemappedFrom != 0 {
+		requested = e.RemappedFrom
+	}
+	if f.state != nil {
+		_ = f.state.AddForward(f.target, state.FormatTarget(e.RemoteHost, e.RemotePort), fmt.Sprintf("%d", requested))
+		if name := f.labels[tcpKey(requested)]; name != "" {
+			_ = f.state.SetLabel(f.target, tcpKey(requested), name)
+		}
+	}
+
+	log.Info().
+		Str("remote", f.remoteName).
+		Uint16("port", masterPort).
+		Msg("Auto forward pinned")
+	return nil
+}
+
+// AutoForward reports whether the agent auto forwards its listening ports.
+func (f *Forwarder) AutoForward() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.autoFwd
+}
+
+// SetAutoForward records whether the agent auto forwards, as announced by
+// protocol.AutoForwardState. It is sent in the Hello of new sessions.
+func (f *Forwarder) SetAutoForward(enabled bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.autoFwd = enabled
+}
+
+// SetLocalOnly switches between binding forwards to 127.0.0.1 and to all
+// interfaces. Running TCP forwards on the previous default address are
+// moved over; a forward whose port cannot be bound again shows the error in
+// the list. UDP forwards keep their address until they are restarted.
+func (f *Forwarder) SetLocalOnly(enabled bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.localOnly == enabled {
+		return
+	}
+	from, to := "0.0.0.0", "127.0.0.1"
+	if !enabled {
+		from, to = to, from
+	}
+	f.localOnly = enabled
+
+	for port, ln := range f.listeners {
+		if host, _, err := net.SplitHostPort(f.forwards[port].LocalAddr); err != nil || host != from {
+			continue
+		}
+		f.rebindLocked(port, ln, withPort(to+":0", port))
+	}
+
+	log.Info().Bool("local", enabled).Msg("Local-only binding switched")
+}
+
+// rebindLocked moves the TCP forward on port from ln to addr, keeping its
+// entry, stats and label.
+func (f *Forwarder) rebindLocked(port uint16, ln net.Listener, addr string) {
+	e := f.forwards[port]
+	ln.Close()
+
+	newLn, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Error().Err(err).Str("local", addr).Msg("Failed to rebind forward")
+		delete(f.listeners, port)
+		delete(f.handlers, port)
+		e.Error = err.Error()
+		f.forwards[port] = e
+		return
+	}
+
+	e.LocalAddr = addr
+	f.forwards[port] = e
+	f.listeners[port] = newLn
+	go f.serveTCP(newLn, port, f.stats[tcpKey(port)], f.handlers[port])
+}
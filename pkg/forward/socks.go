@@ -0,0 +1,220 @@
+package forward
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/liyu1981/moshpf/pkg/protocol"
+	"github.com/liyu1981/moshpf/pkg/state"
+	"github.com/liyu1981/moshpf/pkg/util"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthNoAcceptable = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5RepSuccess             = 0x00
+	socks5RepHostUnreachable     = 0x04
+	socks5RepCmdNotSupported     = 0x07
+	socks5RepAddrTypeUnsupported = 0x08
+)
+
+// ListenDynamic starts a SOCKS5 / HTTP CONNECT proxy on localAddr. Every
+// client request becomes a stream to the requested destination, dialed by
+// the agent on the remote side (like `ssh -D`).
+func (f *Forwarder) ListenDynamic(localAddr string) error {
+	entry := protocol.ForwardEntry{
+		Dynamic: true,
+	}
+
+	bind := localAddr
+	localAddr, err := f.listenTCP(localAddr, entry, func(masterPort uint16) {
+		_ = f.state.AddDynamic(f.target, state.FormatLocal(bind, masterPort))
+	}, f.handleDynamicConnection)
+	if err != nil {
+		return err
+	}
+
+	log.Info().
+		Str("local", localAddr).
+		Str("remote", f.remoteName).
+		Msg("Dynamic forwarding started")
+
+	return nil
+}
+
+// bufferedConn is a net.Conn whose reads go through a bufio.Reader, so bytes
+// buffered while parsing the proxy handshake are not lost.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (f *Forwarder) handleDynamicConnection(localConn net.Conn, st *connStats) {
+	defer localConn.Close()
+
+	conn := &bufferedConn{Conn: localConn, r: bufio.NewReader(localConn)}
+	first, err := conn.r.Peek(1)
+	if err != nil {
+		return
+	}
+
+	var remoteConn io.ReadWriteCloser
+	if first[0] == socks5Version {
+		remoteConn, err = f.handleSocks5(conn)
+	} else {
+		remoteConn, err = f.handleHTTPConnect(conn)
+	}
+	if err != nil {
+		if isDialFailed(err) {
+			st.failedDial()
+		}
+		log.Error().Err(err).Msg("Dynamic forwarding request failed")
+		return
+	}
+	defer remoteConn.Close()
+
+	st.opened()
+	defer st.closed()
+	util.Proxy(st.wrap(conn), remoteConn)
+}
+
+func (f *Forwarder) handleSocks5(conn *bufferedConn) (io.ReadWriteCloser, error) {
+	// Greeting: VER NMETHODS METHODS...
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn.r, hdr); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn.r, methods); err != nil {
+		return nil, err
+	}
+
+	method := byte(socks5AuthNoAcceptable)
+	for _, m := range methods {
+		if m == socks5AuthNone {
+			method = socks5AuthNone
+			break
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return nil, err
+	}
+	if method == socks5AuthNoAcceptable {
+		return nil, fmt.Errorf("socks5: no acceptable auth method")
+	}
+
+	// Request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn.r, req); err != nil {
+		return nil, err
+	}
+	if req[1] != socks5CmdConnect {
+		writeSocks5Reply(conn, socks5RepCmdNotSupported)
+		return nil, fmt.Errorf("socks5: unsupported command %d", req[1])
+	}
+
+	var host string
+	switch req[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		size := net.IPv4len
+		if req[3] == socks5AddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn.r, ip); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		l, err := conn.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		domain := make([]byte, l)
+		if _, err := io.ReadFull(conn.r, domain); err != nil {
+			return nil, err
+		}
+		host = string(domain)
+	default:
+		writeSocks5Reply(conn, socks5RepAddrTypeUnsupported)
+		return nil, fmt.Errorf("socks5: unsupported address type %d", req[3])
+	}
+
+	portBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn.r, portBuf); err != nil {
+		return nil, err
+	}
+	port := binary.BigEndian.Uint16(portBuf)
+
+	remoteConn, err := f.openStream(host, port)
+	if err != nil {
+		writeSocks5Reply(conn, socks5RepHostUnreachable)
+		return nil, err
+	}
+
+	if err := writeSocks5Reply(conn, socks5RepSuccess); err != nil {
+		remoteConn.Close()
+		return nil, err
+	}
+	return remoteConn, nil
+}
+
+func writeSocks5Reply(conn net.Conn, rep byte) error {
+	// The bound address is not meaningful for a tunneled connection
+	_, err := conn.Write([]byte{socks5Version, rep, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func (f *Forwarder) handleHTTPConnect(conn *bufferedConn) (io.ReadWriteCloser, error) {
+	req, err := http.ReadRequest(conn.r)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Method != http.MethodConnect {
+		_, _ = conn.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\nAllow: CONNECT\r\nConnection: close\r\n\r\n"))
+		return nil, fmt.Errorf("http proxy: unsupported method %s", req.Method)
+	}
+
+	host, portStr, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		_, _ = conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n"))
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		_, _ = conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n"))
+		return nil, err
+	}
+
+	remoteConn, err := f.openStream(host, uint16(port))
+	if err != nil {
+		_, _ = conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\n\r\n"))
+		return nil, err
+	}
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		remoteConn.Close()
+		return nil, err
+	}
+	return remoteConn, nil
+}
@@ -0,0 +1,124 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/liyu1981/moshpf/pkg/protocol"
+)
+
+// connStats counts the connections and traffic of one forward. All methods
+// are safe to call on a nil *connStats.
+type connStats struct {
+	active      atomic.Int64
+	total       atomic.Uint64
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
+	failedDials atomic.Uint64
+	lastActive  atomic.Int64
+}
+
+func (s *connStats) opened() {
+	if s == nil {
+		return
+	}
+	s.active.Add(1)
+	s.total.Add(1)
+	s.touch()
+}
+
+func (s *connStats) closed() {
+	if s == nil {
+		return
+	}
+	s.active.Add(-1)
+}
+
+func (s *connStats) failedDial() {
+	if s == nil {
+		return
+	}
+	s.failedDials.Add(1)
+}
+
+// received records n bytes coming back from the remote side.
+func (s *connStats) received(n int) {
+	if s == nil || n <= 0 {
+		return
+	}
+	s.bytesIn.Add(uint64(n))
+	s.touch()
+}
+
+// sent records n bytes going to the remote side.
+func (s *connStats) sent(n int) {
+	if s == nil || n <= 0 {
+		return
+	}
+	s.bytesOut.Add(uint64(n))
+	s.touch()
+}
+
+func (s *connStats) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+func (s *connStats) snapshot() protocol.ForwardStats {
+	if s == nil {
+		return protocol.ForwardStats{}
+	}
+	st := protocol.ForwardStats{
+		ActiveConns: s.active.Load(),
+		TotalConns:  s.total.Load(),
+		BytesIn:     s.bytesIn.Load(),
+		BytesOut:    s.bytesOut.Load(),
+		FailedDials: s.failedDials.Load(),
+	}
+	if ns := s.lastActive.Load(); ns != 0 {
+		st.LastActive = time.Unix(0, ns)
+	}
+	return st
+}
+
+// wrap returns conn with its traffic counted in s. Reading from the local
+// side is traffic sent to the remote, writing to it is traffic received.
+func (s *connStats) wrap(conn net.Conn) net.Conn {
+	if s == nil {
+		return conn
+	}
+	return &countingConn{Conn: conn, stats: s}
+}
+
+type countingConn struct {
+	net.Conn
+	stats *connStats
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.stats.sent(n)
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.stats.received(n)
+	return n, err
+}
+
+// Keys identifying a forward in f.stats and f.labels. Labels use the same
+// keys in the state file, with the requested port of remapped TCP forwards.
+func tcpKey(port uint16) string     { return fmt.Sprintf("tcp:%d", port) }
+func udpKey(port uint16) string     { return fmt.Sprintf("udp:%d", port) }
+func unixKey(path string) string    { return "unix:" + path }
+func routeKey(name string) string   { return "host:" + name }
+func reverseKey(port uint16) string { return fmt.Sprintf("reverse:%d", port) }
+
+// newStatsLocked starts fresh counters for key, replacing earlier ones.
+func (f *Forwarder) newStatsLocked(key string) *connStats {
+	st := &connStats{}
+	f.stats[key] = st
+	return st
+}
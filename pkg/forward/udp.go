@@ -0,0 +1,250 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/liyu1981/moshpf/pkg/constant"
+	"github.com/liyu1981/moshpf/pkg/protocol"
+	"github.com/liyu1981/moshpf/pkg/state"
+	"github.com/liyu1981/moshpf/pkg/tunnel"
+	"github.com/rs/zerolog/log"
+)
+
+type udpForward struct {
+	pc    net.PacketConn
+	entry protocol.ForwardEntry
+	stats *connStats
+
+	mu    sync.Mutex
+	flows map[string]*udpFlow
+}
+
+// udpFlow is the tunnel side of one local client address.
+type udpFlow struct {
+	flow       *tunnel.PacketFlow
+	lastActive atomic.Int64
+}
+
+func (fl *udpFlow) touch() {
+	fl.lastActive.Store(time.Now().UnixNano())
+}
+
+// ListenUDPAndForward forwards UDP packets received on localAddr to
+// remoteHost:remotePort on the agent side. Every local client address gets
+// its own flow, which is torn down after constant.UDPFlowIdleTimeout.
+func (f *Forwarder) ListenUDPAndForward(localAddr, remoteHost string, remotePort uint16, isAuto bool) error {
+	bind := localAddr
+	localAddr, masterPort := f.resolveLocalAddr(localAddr)
+
+	f.mu.Lock()
+	if u, exists := f.udp[masterPort]; exists && u.pc != nil {
+		f.mu.Unlock()
+		return fmt.Errorf("udp port %d already has an active listener", masterPort)
+	}
+
+	entry := protocol.ForwardEntry{
+		LocalAddr:  localAddr,
+		RemoteHost: remoteHost,
+		RemotePort: remotePort,
+		Protocol:   protocol.ProtocolUDP,
+		IsAuto:     isAuto,
+	}
+
+	pc, err := net.ListenPacket("udp", localAddr)
+	if err != nil {
+		entry.Error = err.Error()
+		f.udp[masterPort] = &udpForward{entry: entry}
+		f.mu.Unlock()
+		return err
+	}
+
+	if masterPort == 0 {
+		if addr, ok := pc.LocalAddr().(*net.UDPAddr); ok {
+			masterPort = uint16(addr.Port)
+		}
+	}
+
+	u := &udpForward{
+		pc:    pc,
+		entry: entry,
+		stats: f.newStatsLocked(udpKey(masterPort)),
+		flows: make(map[string]*udpFlow),
+	}
+	f.udp[masterPort] = u
+
+	if f.state != nil {
+		_ = f.state.AddUDPForward(f.target, state.FormatTarget(remoteHost, remotePort), state.FormatLocal(bind, masterPort))
+	}
+	f.mu.Unlock()
+
+	log.Info().
+		Str("local", localAddr).
+		Str("remote", fmt.Sprintf("%s:%d", remoteHost, remotePort)).
+		Msg("UDP forwarding started")
+
+	go f.serveUDP(u, masterPort)
+	return nil
+}
+
+// CloseUDPForward stops the UDP forward on masterPort.
+func (f *Forwarder) CloseUDPForward(masterPort uint16) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	u, ok := f.udp[masterPort]
+	if !ok {
+		return false
+	}
+	delete(f.udp, masterPort)
+	delete(f.stats, udpKey(masterPort))
+	delete(f.labels, udpKey(masterPort))
+	if f.state != nil {
+		_ = f.state.RemoveUDPForward(f.target, fmt.Sprintf("%d", masterPort))
+	}
+	if u.pc == nil {
+		return false
+	}
+
+	u.pc.Close()
+	log.Info().
+		Str("remote", f.remoteName).
+		Uint16("port", masterPort).
+		Msg("UDP forwarding stopped")
+	return true
+}
+
+func (f *Forwarder) serveUDP(u *udpForward, masterPort uint16) {
+	stop := make(chan struct{})
+	defer func() {
+		close(stop)
+		u.pc.Close()
+		u.mu.Lock()
+		for _, fl := range u.flows {
+			fl.flow.Close()
+		}
+		u.mu.Unlock()
+
+		f.mu.Lock()
+		if f.udp[masterPort] == u {
+			delete(f.udp, masterPort)
+			delete(f.stats, udpKey(masterPort))
+		}
+		f.mu.Unlock()
+	}()
+
+	go u.expireFlows(stop)
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := u.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		fl, err := f.udpFlowFor(u, addr)
+		if err != nil {
+			log.Error().Err(err).Str("client", addr.String()).Msg("Failed to open UDP flow")
+			continue
+		}
+
+		p := make([]byte, n)
+		copy(p, buf[:n])
+		fl.touch()
+		if err := fl.flow.WritePacket(p); err != nil {
+			log.Debug().Err(err).Str("client", addr.String()).Msg("Failed to send UDP packet")
+			continue
+		}
+		u.stats.sent(n)
+	}
+}
+
+func (f *Forwarder) udpFlowFor(u *udpForward, addr net.Addr) (*udpFlow, error) {
+	key := addr.String()
+
+	u.mu.Lock()
+	fl, ok := u.flows[key]
+	u.mu.Unlock()
+	if ok {
+		return fl, nil
+	}
+
+	s := f.getBestSession()
+	if s == nil {
+		return nil, fmt.Errorf("no active session for forwarding")
+	}
+
+	id := atomic.AddUint32(&f.nextID, 1)
+	datagrams := s.SupportsDatagrams()
+	stream, err := f.openStreamOn(s, protocol.StreamHeader{
+		Host:      u.entry.RemoteHost,
+		Port:      u.entry.RemotePort,
+		Network:   protocol.ProtocolUDP,
+		FlowID:    id,
+		Datagrams: datagrams,
+	})
+	if err != nil {
+		if isDialFailed(err) {
+			u.stats.failedDial()
+		}
+		return nil, err
+	}
+
+	fl = &udpFlow{flow: tunnel.NewPacketFlow(s, stream, id, datagrams)}
+	fl.touch()
+	u.stats.opened()
+
+	u.mu.Lock()
+	u.flows[key] = fl
+	u.mu.Unlock()
+
+	go func() {
+		defer func() {
+			fl.flow.Close()
+			u.stats.closed()
+			u.mu.Lock()
+			if u.flows[key] == fl {
+				delete(u.flows, key)
+			}
+			u.mu.Unlock()
+		}()
+		for {
+			p, err := fl.flow.ReadPacket()
+			if err != nil {
+				return
+			}
+			fl.touch()
+			if _, err := u.pc.WriteTo(p, addr); err != nil {
+				return
+			}
+			u.stats.received(len(p))
+		}
+	}()
+
+	return fl, nil
+}
+
+func (u *udpForward) expireFlows(stop chan struct{}) {
+	ticker := time.NewTicker(constant.UDPFlowIdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			deadline := time.Now().Add(-constant.UDPFlowIdleTimeout).UnixNano()
+			u.mu.Lock()
+			for key, fl := range u.flows {
+				if fl.lastActive.Load() < deadline {
+					fl.flow.Close()
+					delete(u.flows, key)
+				}
+			}
+			u.mu.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
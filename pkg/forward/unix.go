@@ -0,0 +1,144 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/liyu1981/moshpf/pkg/protocol"
+	"github.com/liyu1981/moshpf/pkg/state"
+	"github.com/rs/zerolog/log"
+)
+
+type unixForward struct {
+	ln    net.Listener
+	entry protocol.ForwardEntry
+}
+
+// ListenUnixAndForward forwards connections to the unix socket remotePath on
+// the agent side. localAddr is either a TCP address (":8080") or a local unix
+// socket ("unix:/path/to/socket").
+func (f *Forwarder) ListenUnixAndForward(localAddr, remotePath string) error {
+	entry := protocol.ForwardEntry{
+		RemotePath: remotePath,
+		Protocol:   protocol.ProtocolUnix,
+	}
+	header := protocol.StreamHeader{
+		Network: protocol.ProtocolUnix,
+		Path:    remotePath,
+	}
+	handle := func(conn net.Conn, st *connStats) {
+		f.handleConnection(conn, header, st)
+	}
+
+	localPath, isUnix := strings.CutPrefix(localAddr, "unix:")
+	if !isUnix {
+		bind := localAddr
+		localAddr, err := f.listenTCP(localAddr, entry, func(masterPort uint16) {
+			_ = f.state.AddUnixForward(f.target, remotePath, state.FormatLocal(bind, masterPort))
+		}, handle)
+		if err != nil {
+			return err
+		}
+		log.Info().
+			Str("local", localAddr).
+			Str("remote", fmt.Sprintf("%s:%s", f.remoteName, remotePath)).
+			Msg("Forwarding started")
+		return nil
+	}
+
+	f.mu.Lock()
+	if u, exists := f.sockets[localPath]; exists && u.ln != nil {
+		f.mu.Unlock()
+		return fmt.Errorf("socket %s already has an active listener", localPath)
+	}
+
+	entry.LocalAddr = localAddr
+	removeStaleSocket(localPath)
+	ln, err := net.Listen("unix", localPath)
+	if err != nil {
+		entry.Error = err.Error()
+		f.sockets[localPath] = &unixForward{entry: entry}
+		f.mu.Unlock()
+		return err
+	}
+
+	u := &unixForward{ln: ln, entry: entry}
+	f.sockets[localPath] = u
+	st := f.newStatsLocked(unixKey(localPath))
+
+	if f.state != nil {
+		_ = f.state.AddUnixForward(f.target, remotePath, localAddr)
+	}
+	f.mu.Unlock()
+
+	log.Info().
+		Str("local", localAddr).
+		Str("remote", fmt.Sprintf("%s:%s", f.remoteName, remotePath)).
+		Msg("Forwarding started")
+
+	go func() {
+		defer func() {
+			ln.Close()
+			f.mu.Lock()
+			if f.sockets[localPath] == u {
+				delete(f.sockets, localPath)
+				delete(f.stats, unixKey(localPath))
+			}
+			f.mu.Unlock()
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn, st)
+		}
+	}()
+
+	return nil
+}
+
+// CloseUnixForward stops the forward listening on the local unix socket
+// localPath.
+func (f *Forwarder) CloseUnixForward(localPath string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	u, ok := f.sockets[localPath]
+	if !ok {
+		return false
+	}
+	delete(f.sockets, localPath)
+	delete(f.stats, unixKey(localPath))
+	delete(f.labels, unixKey(localPath))
+	if f.state != nil {
+		_ = f.state.RemoveUnixForward(f.target, "unix:"+localPath)
+	}
+	if u.ln == nil {
+		return false
+	}
+
+	u.ln.Close()
+	log.Info().
+		Str("remote", f.remoteName).
+		Str("path", localPath).
+		Msg("Forwarding stopped")
+	return true
+}
+
+// removeStaleSocket removes a socket file left behind by a previous run, so
+// that listening on it does not fail with "address already in use".
+func removeStaleSocket(path string) {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		// Still in use by someone else
+		conn.Close()
+		return
+	}
+	_ = os.Remove(path)
+}
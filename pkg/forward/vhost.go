@@ -0,0 +1,301 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/liyu1981/moshpf/pkg/constant"
+	"github.com/liyu1981/moshpf/pkg/protocol"
+	"github.com/liyu1981/moshpf/pkg/state"
+	"github.com/rs/zerolog/log"
+)
+
+// tlsRecordHandshake is the first byte of a TLS ClientHello record.
+const tlsRecordHandshake = 0x16
+
+var errSNIFound = errors.New("sni found")
+
+// ListenVHost starts the listener that routes connections by HTTP Host header
+// or TLS SNI to the remote ports registered with AddRoute. It is a no-op when
+// the listener is already running.
+func (f *Forwarder) ListenVHost(localAddr string) error {
+	localAddr, _ = f.resolveLocalAddr(localAddr)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.vhostLn != nil {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return err
+	}
+	f.vhostLn = ln
+
+	log.Info().
+		Str("local", ln.Addr().String()).
+		Str("remote", f.remoteName).
+		Msg("Host routing started")
+
+	go func() {
+		defer func() {
+			ln.Close()
+			f.mu.Lock()
+			if f.vhostLn == ln {
+				f.vhostLn = nil
+			}
+			f.mu.Unlock()
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.handleVHostConnection(conn)
+		}
+	}()
+
+	return nil
+}
+
+// AddRoute routes connections for <name>.<remote>.localhost to
+// remoteHost:remotePort on the agent side, starting the host routing listener
+// on constant.VHostAddr if it is not running yet.
+func (f *Forwarder) AddRoute(name, remoteHost string, remotePort uint16, isAuto bool) error {
+	name = strings.ToLower(name)
+	if !isValidRouteName(name) {
+		return fmt.Errorf("invalid host name: %s", name)
+	}
+
+	if err := f.ListenVHost(constant.VHostAddr); err != nil {
+		return fmt.Errorf("failed to start host routing: %v", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, exists := f.routes[name]; exists {
+		return fmt.Errorf("host %s is already routed", name)
+	}
+
+	f.newStatsLocked(routeKey(name))
+	f.routes[name] = protocol.ForwardEntry{
+		LocalAddr:  f.routeAddrLocked(name),
+		RemoteHost: remoteHost,
+		RemotePort: remotePort,
+		Protocol:   protocol.ProtocolTCP,
+		IsAuto:     isAuto,
+		VHost:      name,
+	}
+
+	if f.state != nil && !isAuto {
+		_ = f.state.AddRoute(f.target, name, state.FormatTarget(remoteHost, remotePort))
+	}
+
+	log.Info().
+		Str("host", f.routeAddrLocked(name)).
+		Str("remote", fmt.Sprintf("%s:%d", remoteHost, remotePort)).
+		Msg("Host route added")
+
+	return nil
+}
+
+// CloseRoute removes the route registered under name.
+func (f *Forwarder) CloseRoute(name string) bool {
+	name = strings.ToLower(name)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.routes[name]; !ok {
+		return false
+	}
+	delete(f.routes, name)
+	delete(f.stats, routeKey(name))
+	delete(f.labels, routeKey(name))
+	if f.state != nil {
+		_ = f.state.RemoveRoute(f.target, name)
+	}
+
+	log.Info().
+		Str("remote", f.remoteName).
+		Str("host", name).
+		Msg("Host route removed")
+	return true
+}
+
+// RouteAddr returns the address clients use to reach the route name, e.g.
+// "web.devbox.localhost:8443".
+func (f *Forwarder) RouteAddr(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.routeAddrLocked(strings.ToLower(name))
+}
+
+func (f *Forwarder) routeAddrLocked(name string) string {
+	host := name + "." + strings.ToLower(f.remoteName) + ".localhost"
+	if f.vhostLn == nil {
+		return host
+	}
+	if addr, ok := f.vhostLn.Addr().(*net.TCPAddr); ok {
+		return net.JoinHostPort(host, strconv.Itoa(addr.Port))
+	}
+	return host
+}
+
+// addAutoRoute gives an auto forwarded port a generated route named after the
+// port, but only when host routing is already in use.
+func (f *Forwarder) addAutoRoute(remoteHost string, remotePort uint16) {
+	f.mu.Lock()
+	running := f.vhostLn != nil
+	_, exists := f.routes[strconv.Itoa(int(remotePort))]
+	f.mu.Unlock()
+
+	if running && !exists {
+		_ = f.AddRoute(strconv.Itoa(int(remotePort)), remoteHost, remotePort, true)
+	}
+}
+
+// closeAutoRoute drops the generated route of an auto forwarded port.
+func (f *Forwarder) closeAutoRoute(remotePort uint16) bool {
+	f.mu.Lock()
+	e, ok := f.routes[strconv.Itoa(int(remotePort))]
+	f.mu.Unlock()
+
+	if !ok || !e.IsAuto {
+		return false
+	}
+	return f.CloseRoute(e.VHost)
+}
+
+func (f *Forwarder) lookupRoute(host string) (protocol.ForwardEntry, *connStats, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	name, _, _ := strings.Cut(strings.ToLower(host), ".")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.routes[name]
+	return e, f.stats[routeKey(name)], ok
+}
+
+func (f *Forwarder) handleVHostConnection(localConn net.Conn) {
+	_ = localConn.SetReadDeadline(time.Now().Add(constant.VHostSniffTimeout))
+	host, isTLS, conn, err := sniffHost(localConn)
+	_ = localConn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to read host from connection")
+		localConn.Close()
+		return
+	}
+
+	e, st, ok := f.lookupRoute(host)
+	if !ok {
+		log.Warn().Str("host", host).Msg("No route for host")
+		if !isTLS {
+			_, _ = fmt.Fprintf(localConn, "HTTP/1.1 404 Not Found\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\nno route for %s\n", host)
+		}
+		localConn.Close()
+		return
+	}
+
+	f.handleConnection(conn, protocol.StreamHeader{
+		Host: e.RemoteHost,
+		Port: e.RemotePort,
+	}, st)
+}
+
+// replayConn is a net.Conn that first returns the bytes consumed while
+// sniffing the host, then continues with the underlying connection.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// sniffHost reads the TLS SNI or HTTP Host of a new connection. The returned
+// conn replays everything that was read, so it can be proxied unchanged.
+func sniffHost(conn net.Conn) (string, bool, net.Conn, error) {
+	var buf bytes.Buffer
+	r := bufio.NewReader(io.TeeReader(conn, &buf))
+	replay := &replayConn{Conn: conn, r: io.MultiReader(&buf, conn)}
+
+	first, err := r.Peek(1)
+	if err != nil {
+		return "", false, replay, err
+	}
+
+	if first[0] == tlsRecordHandshake {
+		host, err := readSNI(r)
+		return host, true, replay, err
+	}
+
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return "", false, replay, err
+	}
+	if req.Host == "" {
+		return "", false, replay, fmt.Errorf("request has no Host header")
+	}
+	return req.Host, false, replay, nil
+}
+
+// readSNI runs the server side of a TLS handshake on r just far enough to see
+// the ClientHello.
+func readSNI(r io.Reader) (string, error) {
+	var sni string
+	err := tls.Server(sniffConn{r: r}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			return nil, errSNIFound
+		},
+	}).Handshake()
+	if !errors.Is(err, errSNIFound) {
+		return "", err
+	}
+	if sni == "" {
+		return "", fmt.Errorf("ClientHello has no server name")
+	}
+	return sni, nil
+}
+
+// sniffConn is a read-only net.Conn handed to crypto/tls while sniffing.
+type sniffConn struct {
+	r io.Reader
+}
+
+func (c sniffConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c sniffConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c sniffConn) Close() error                       { return nil }
+func (c sniffConn) LocalAddr() net.Addr                { return nil }
+func (c sniffConn) RemoteAddr() net.Addr               { return nil }
+func (c sniffConn) SetDeadline(t time.Time) error      { return nil }
+func (c sniffConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c sniffConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func isValidRouteName(name string) bool {
+	if name == "" || len(name) > 63 || name[0] == '-' || name[len(name)-1] == '-' {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,276 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ControlVersion is the version of the CLI <-> agent control protocol spoken
+// on the unix socket. Requests carrying another version are refused with
+// CodeUnsupportedVersion.
+const ControlVersion = 1
+
+// Control commands.
+const (
+	CommandList     = "list"
+	CommandSessions = "sessions"
+	CommandStatus   = "status"
+	CommandStop     = "stop"
+	CommandForward  = "forward"
+	CommandReverse  = "reverse"
+	CommandClose    = "close"
+	// CommandPin keeps an auto forward after its remote port closes.
+	CommandPin = "pin"
+	// CommandAutoForward and CommandLocalOnly take "on" or "off".
+	CommandAutoForward = "auto"
+	CommandLocalOnly   = "local-only"
+	// CommandApprove forwards a port held back by a require-approval rule.
+	CommandApprove = "approve"
+	// CommandWatch keeps the connection open after the response and streams
+	// one Event per line.
+	CommandWatch = "watch"
+)
+
+// Error codes of ControlError and ControlResult.
+const (
+	CodeBadRequest         = "bad_request"
+	CodeUnsupportedVersion = "unsupported_version"
+	CodeUnknownCommand     = "unknown_command"
+	CodeInvalidArgument    = "invalid_argument"
+	CodeNoSession          = "no_session"
+	CodeSendFailed         = "send_failed"
+	CodeTimeout            = "timeout"
+	CodeRejected           = "rejected"
+)
+
+// ControlRequest is sent by the CLI as a single JSON line. Args are the
+// command line arguments of the command, e.g. the forward specs of
+// CommandForward.
+type ControlRequest struct {
+	Version int      `json:"version"`
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// ControlResponse is the agent's single JSON line answer to a ControlRequest.
+// Error is set when the request as a whole failed. Commands acting on several
+// forwards report each in Results, in request order, and only succeed when
+// all of them did.
+type ControlResponse struct {
+	Version  int             `json:"version"`
+	Success  bool            `json:"success"`
+	Error    *ControlError   `json:"error,omitempty"`
+	Message  string          `json:"message,omitempty"`
+	Results  []ControlResult `json:"results,omitempty"`
+	List     *ListResponse   `json:"list,omitempty"`
+	Status   *AgentStatus    `json:"agent,omitempty"`
+	Sessions int             `json:"sessions,omitempty"`
+}
+
+// AgentStatus describes the agent, or the master process, answering
+// CommandStatus and CommandList.
+// Transport is the transport of the session requests go through, MasterIPs
+// and Forwards are only known while a session is up.
+type AgentStatus struct {
+	// Target is set when a master process answers instead of the agent.
+	Target    string   `json:"target,omitempty"`
+	Version   string   `json:"version"`
+	PID       int      `json:"pid"`
+	Sessions  int      `json:"sessions"`
+	Transport string   `json:"transport,omitempty"`
+	SlaveIPs  []string `json:"slave_ips"`
+	MasterIPs []string `json:"master_ips,omitempty"`
+	Forwards  int      `json:"forwards"`
+}
+
+type ControlError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ControlError) Error() string {
+	return e.Message
+}
+
+type ControlResult struct {
+	Success bool   `json:"success"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+// NewControlError builds a failed ControlResponse.
+func NewControlError(code, format string, args ...interface{}) ControlResponse {
+	return ControlResponse{
+		Version: ControlVersion,
+		Error:   &ControlError{Code: code, Message: fmt.Sprintf(format, args...)},
+	}
+}
+
+// NewForwardResponse reports the outcome of each ListenRequest of a
+// CommandForward; resps are in request order.
+func NewForwardResponse(reqs []ListenRequest, resps []ListenResponse) ControlResponse {
+	res := ControlResponse{Success: true}
+	for i, r := range resps {
+		if i >= len(reqs) {
+			break
+		}
+		slave, master := describeForward(reqs[i])
+		if r.LocalAddr != "" {
+			master = r.LocalAddr
+		} else if _, p, err := net.SplitHostPort(reqs[i].LocalAddr); err == nil && r.LocalPort != 0 && p != strconv.Itoa(int(r.LocalPort)) {
+			master = fmt.Sprintf("%d/%s (port %s was busy)", r.LocalPort, reqs[i].Protocol, p)
+		}
+		if reqs[i].Name != "" {
+			master += " (" + reqs[i].Name + ")"
+		}
+		if r.Success {
+			res.Results = append(res.Results, ControlResult{
+				Success: true,
+				Message: fmt.Sprintf("Forwarding started: slave %s -> master %s", slave, master),
+			})
+		} else {
+			res.Success = false
+			res.Results = append(res.Results, ControlResult{
+				Code:    CodeRejected,
+				Message: fmt.Sprintf("Failed to forward slave %s -> master %s: %s", slave, master, r.Reason),
+			})
+		}
+	}
+	return res
+}
+
+// NewCloseResponse is the CommandClose counterpart of NewForwardResponse.
+func NewCloseResponse(reqs []CloseRequest, resps []CloseResponse) ControlResponse {
+	res := ControlResponse{Success: true}
+	for i, r := range resps {
+		if i >= len(reqs) {
+			break
+		}
+		what := fmt.Sprintf("port %d", reqs[i].Port)
+		if reqs[i].Protocol == ProtocolUDP {
+			what = fmt.Sprintf("udp port %d", reqs[i].Port)
+		}
+		if reqs[i].LocalPath != "" {
+			what = "socket " + reqs[i].LocalPath
+		}
+		if reqs[i].VHost != "" {
+			what = "host " + reqs[i].VHost
+		}
+		if reqs[i].Name != "" {
+			what = "forward " + reqs[i].Name
+		}
+
+		if r.Success {
+			res.Results = append(res.Results, ControlResult{
+				Success: true,
+				Message: fmt.Sprintf("Closed %s", what),
+			})
+		} else {
+			res.Success = false
+			res.Results = append(res.Results, ControlResult{
+				Code:    CodeRejected,
+				Message: fmt.Sprintf("Failed to close %s: %s", what, r.Reason),
+			})
+		}
+	}
+	return res
+}
+
+// describeForward renders both ends of a ListenRequest for CLI output, e.g.
+// "8080/tcp" and "unix:/run/docker.sock".
+func describeForward(req ListenRequest) (slave, master string) {
+	switch {
+	case req.Protocol == ProtocolUnix:
+		slave = "unix:" + req.RemotePath
+	case req.RemoteHost != "" && req.RemoteHost != "localhost":
+		slave = fmt.Sprintf("%s/%s", net.JoinHostPort(req.RemoteHost, strconv.Itoa(int(req.RemotePort))), req.Protocol)
+	default:
+		slave = fmt.Sprintf("%d/%s", req.RemotePort, req.Protocol)
+	}
+
+	master = strings.TrimPrefix(req.LocalAddr, ":")
+	if !strings.HasPrefix(master, "unix:") {
+		proto := req.Protocol
+		if proto == ProtocolUnix {
+			proto = ProtocolTCP
+		}
+		master += "/" + proto
+	}
+	return slave, master
+}
+
+// NewPinResponse reports the outcome of a PinRequest.
+func NewPinResponse(r PinResponse) ControlResponse {
+	if !r.Success {
+		return NewControlError(CodeRejected, "Failed to pin port %d: %s", r.Port, r.Reason)
+	}
+	return ControlResponse{Success: true, Message: fmt.Sprintf("Pinned port %d", r.Port)}
+}
+
+// NewSwitchResponse reports that the setting what was switched on or off.
+func NewSwitchResponse(what string, enabled bool) ControlResponse {
+	state := "disabled"
+	if enabled {
+		state = "enabled"
+	}
+	return ControlResponse{Success: true, Message: fmt.Sprintf("%s %s", what, state)}
+}
+
+// ParseSwitchArg parses the "on" or "off" argument of CommandAutoForward and
+// CommandLocalOnly.
+func ParseSwitchArg(args []string) (bool, error) {
+	if len(args) == 1 {
+		switch args[0] {
+		case "on":
+			return true, nil
+		case "off":
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("expected on or off")
+}
+
+// ReadControlRequest decodes the request sent on conn.
+func ReadControlRequest(conn net.Conn) (ControlRequest, error) {
+	var req ControlRequest
+	err := json.NewDecoder(conn).Decode(&req)
+	return req, err
+}
+
+// WriteControlResponse encodes resp as one JSON line on conn.
+func WriteControlResponse(conn net.Conn, resp ControlResponse) error {
+	resp.Version = ControlVersion
+	return json.NewEncoder(conn).Encode(resp)
+}
+
+// SendControl sends command to the agent listening on sockPath and waits for
+// its response.
+func SendControl(sockPath, command string, args ...string) (ControlResponse, error) {
+	var resp ControlResponse
+
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		return resp, fmt.Errorf("could not connect to agent at %s: %v", sockPath, err)
+	}
+	defer conn.Close()
+
+	err = json.NewEncoder(conn).Encode(ControlRequest{
+		Version: ControlVersion,
+		Command: command,
+		Args:    args,
+	})
+	if err != nil {
+		return resp, err
+	}
+
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return resp, fmt.Errorf("failed to read agent response: %v", err)
+	}
+	if resp.Version != ControlVersion {
+		return resp, fmt.Errorf("agent speaks control protocol version %d, expected %d", resp.Version, ControlVersion)
+	}
+	return resp, nil
+}
@@ -0,0 +1,131 @@
+package protocol
+
+import (
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestSendControl(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "mpf.sock")
+	ln, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	// Play the agent: echo the request back in the response
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			req, err := ReadControlRequest(conn)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			resp := ControlResponse{Success: true, Message: req.Command}
+			for _, arg := range req.Args {
+				resp.Results = append(resp.Results, ControlResult{Success: true, Message: arg})
+			}
+			if req.Version != ControlVersion {
+				resp = NewControlError(CodeUnsupportedVersion, "bad version %d", req.Version)
+			}
+			_ = WriteControlResponse(conn, resp)
+			conn.Close()
+		}
+	}()
+
+	resp, err := SendControl(sockPath, CommandForward, "8080", "udp:53")
+	if err != nil {
+		t.Fatalf("SendControl failed: %v", err)
+	}
+	if !resp.Success || resp.Message != CommandForward || len(resp.Results) != 2 || resp.Results[1].Message != "udp:53" {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+	if resp.Version != ControlVersion {
+		t.Errorf("Expected version %d, got %d", ControlVersion, resp.Version)
+	}
+
+	if _, err := SendControl(filepath.Join(t.TempDir(), "missing.sock"), CommandList); err == nil {
+		t.Error("Expected an error without an agent")
+	}
+}
+
+func TestControlErrorResponse(t *testing.T) {
+	server, client := net.Pipe()
+	go func() {
+		_ = WriteControlResponse(server, NewControlError(CodeNoSession, "No active session"))
+		server.Close()
+	}()
+
+	var resp ControlResponse
+	if err := json.NewDecoder(client).Decode(&resp); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if resp.Success || resp.Error == nil || resp.Error.Code != CodeNoSession || resp.Error.Error() != "No active session" {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "mpf.sock")
+	ln, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	// Play the agent: accept the watch, send two events and hang up
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := ReadControlRequest(conn)
+		if err != nil || req.Command != CommandWatch {
+			_ = WriteControlResponse(conn, NewControlError(CodeBadRequest, "expected watch"))
+			return
+		}
+		_ = WriteControlResponse(conn, ControlResponse{Success: true})
+		_ = WriteEvent(conn, NewEvent(EventSessionConnected, "Session connected over QUIC"))
+		_ = WriteEvent(conn, NewEvent(EventSessionDropped, "Session over QUIC dropped"))
+	}()
+
+	var got []string
+	err = Watch(sockPath, func(ev Event) {
+		got = append(got, ev.Type)
+	})
+	if err == nil {
+		t.Error("Expected an error once the agent hangs up")
+	}
+	if len(got) != 2 || got[0] != EventSessionConnected || got[1] != EventSessionDropped {
+		t.Errorf("Unexpected events %v", got)
+	}
+}
+
+func TestNewForwardResponse(t *testing.T) {
+	reqs := []ListenRequest{
+		{LocalAddr: ":8080", RemoteHost: "localhost", RemotePort: 8080, Protocol: ProtocolTCP},
+		{LocalAddr: ":3000", RemoteHost: "localhost", RemotePort: 3000, Protocol: ProtocolTCP},
+	}
+	resps := []ListenResponse{
+		{RemotePort: 8080, LocalPort: 8081, Success: true},
+		{RemotePort: 3000, Reason: "address already in use"},
+	}
+
+	resp := NewForwardResponse(reqs, resps)
+	if resp.Success || len(resp.Results) != 2 {
+		t.Fatalf("Unexpected response %+v", resp)
+	}
+	if got := resp.Results[0].Message; got != "Forwarding started: slave 8080/tcp -> master 8081/tcp (port 8080 was busy)" {
+		t.Errorf("Unexpected message %q", got)
+	}
+	if r := resp.Results[1]; r.Success || r.Code != CodeRejected {
+		t.Errorf("Unexpected result %+v", r)
+	}
+}
@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Event types reported by `mpf watch`.
+const (
+	EventForwardStarted    = "forward_started"
+	EventForwardStopped    = "forward_stopped"
+	EventListenFailed      = "listen_failed"
+	EventTransportSwitched = "transport_switched"
+	EventSessionConnected  = "session_connected"
+	EventSessionDropped    = "session_dropped"
+	EventShutdownTimer     = "shutdown_timer_started"
+	EventPortDetected      = "port_detected"
+	EventApprovalRequired  = "approval_required"
+)
+
+// Event is a change worth telling `mpf watch` about. The master sends forward
+// and transport events to the agent over the control session; session,
+// shutdown timer and port events are raised by the agent itself. Forward is
+// set for forward events, Transport for transport and session events and
+// Detected for port events.
+type Event struct {
+	Time      time.Time     `json:"time"`
+	Type      string        `json:"type"`
+	Message   string        `json:"message"`
+	Forward   *ForwardEntry `json:"forward,omitempty"`
+	Transport string        `json:"transport,omitempty"`
+	Detected  *DetectedPort `json:"detected,omitempty"`
+}
+
+// NewEvent returns an event of type typ happening now.
+func NewEvent(typ, format string, args ...interface{}) Event {
+	return Event{
+		Time:    time.Now(),
+		Type:    typ,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// WriteEvent encodes ev as one JSON line on conn, see CommandWatch.
+func WriteEvent(conn net.Conn, ev Event) error {
+	return json.NewEncoder(conn).Encode(ev)
+}
+
+// Watch subscribes to the events of the agent listening on sockPath and calls
+// fn for each of them until the connection ends.
+func Watch(sockPath string, fn func(Event)) error {
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		return fmt.Errorf("could not connect to agent at %s: %v", sockPath, err)
+	}
+	defer conn.Close()
+
+	err = json.NewEncoder(conn).Encode(ControlRequest{
+		Version: ControlVersion,
+		Command: CommandWatch,
+	})
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(conn)
+	var resp ControlResponse
+	if err := dec.Decode(&resp); err != nil {
+		return fmt.Errorf("failed to read agent response: %v", err)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	for {
+		var ev Event
+		if err := dec.Decode(&ev); err != nil {
+			return fmt.Errorf("agent closed the event stream: %v", err)
+		}
+		fn(ev)
+	}
+}
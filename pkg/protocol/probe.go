@@ -0,0 +1,42 @@
+package protocol
+
+// Services the agent recognizes on a forwarded port.
+const (
+	ServiceHTTP     = "http"
+	ServiceHTTPS    = "https"
+	ServiceGRPC     = "grpc"
+	ServiceTLS      = "tls"
+	ServiceSSH      = "ssh"
+	ServiceMySQL    = "mysql"
+	ServicePostgres = "postgres"
+	ServiceRedis    = "redis"
+)
+
+// ProbeRequest asks the agent what listens on Host:Port, sent by the master
+// for each TCP forward it starts.
+type ProbeRequest struct {
+	Host string
+	Port uint16
+}
+
+// ProbeResult answers a ProbeRequest. Service is one of the Service
+// constants or empty when nothing was recognized, and Title is the page
+// title of an HTTP service.
+type ProbeResult struct {
+	Host    string
+	Port    uint16
+	Service string
+	Title   string
+}
+
+// ServiceURL returns the URL to open a service at addr in a browser, or ""
+// when it is not a web service.
+func ServiceURL(service, addr string) string {
+	switch service {
+	case ServiceHTTP:
+		return "http://" + addr
+	case ServiceHTTPS:
+		return "https://" + addr
+	}
+	return ""
+}
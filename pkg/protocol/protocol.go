@@ -5,13 +5,24 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Message interface{}
 
+const (
+	ProtocolTCP  = "tcp"
+	ProtocolUDP  = "udp"
+	ProtocolUnix = "unix"
+)
+
+// Hello opens a session. Rules are the master's AutoForwardRules for the
+// agent's auto forwarder.
 type Hello struct {
 	Version     string
 	AutoForward bool
+	Rules       []AutoForwardRule
 }
 
 type HelloAck struct {
@@ -23,16 +34,75 @@ type HelloAck struct {
 type StreamHeader struct {
 	Host string
 	Port uint16
+	// Network is ProtocolUDP for packet flows and ProtocolUnix for unix
+	// sockets (dialed at Path); empty means TCP.
+	Network string
+	Path    string
+	// FlowID and Datagrams describe a packet flow, see tunnel.PacketFlow.
+	FlowID    uint32
+	Datagrams bool
 }
 
+// ListenRequest asks the other side to listen on LocalAddr and forward to
+// RemoteHost:RemotePort, or to RemotePath for ProtocolUnix. LocalAddr may be
+// "unix:/path" to listen on a unix socket instead of a TCP port. When VHost
+// is set, no port is opened; the master routes <VHost>.<remote>.localhost on
+// its host routing listener instead. Name is an optional label for the
+// forward, see IsValidName. User is set on auto forwards of processes owned
+// by another user than the agent's, and RemoteBind lists the addresses the
+// remote service listens on. Silent auto forwards are not notified on the
+// master.
 type ListenRequest struct {
 	LocalAddr  string
 	RemoteHost string
 	RemotePort uint16
+	RemotePath string
+	Protocol   string
 	IsAuto     bool
+	VHost      string
+	Name       string
+	User       string
+	RemoteBind string
+	Silent     bool
 }
 
+// ListenResponse answers a ListenRequest. LocalPort is the port actually
+// listened on, which differs from the requested one after a remap. LocalAddr,
+// when set, is the address clients should use, e.g. for host routed forwards.
 type ListenResponse struct {
+	RemotePort uint16
+	LocalPort  uint16
+	LocalAddr  string
+	Success    bool
+	Reason     string
+}
+
+// ListenBatchRequest carries the ListenRequests of a single `mpf forward`
+// call so that the master answers all of them in one round trip. ID, like
+// that of the other requests a CLI command waits on, is chosen by the agent
+// and repeated in the response, so that answers to requests that timed out
+// or run at the same time are not mixed up.
+type ListenBatchRequest struct {
+	ID       uint64
+	Requests []ListenRequest
+}
+
+// ListenBatchResponse holds one ListenResponse per request, in request order.
+type ListenBatchResponse struct {
+	ID        uint64
+	Responses []ListenResponse
+}
+
+// ReverseRequest asks the master to set up a reverse forward: the agent
+// listens on RemotePort and connections are dialed to MasterPort on the master.
+type ReverseRequest struct {
+	ID         uint64
+	MasterPort uint16
+	RemotePort uint16
+}
+
+type ReverseResponse struct {
+	ID         uint64
 	RemotePort uint16
 	Success    bool
 	Reason     string
@@ -41,29 +111,118 @@ type ListenResponse struct {
 type ListRequest struct{}
 
 type ForwardEntry struct {
-	LocalAddr  string
-	RemoteHost string
-	RemotePort uint16
-	Transport  string
-	IsAuto     bool
-	Error      string
+	Name       string `json:"name,omitempty"`
+	LocalAddr  string `json:"local_addr"`
+	RemoteHost string `json:"remote_host,omitempty"`
+	RemotePort uint16 `json:"remote_port,omitempty"`
+	RemotePath string `json:"remote_path,omitempty"`
+	Protocol   string `json:"protocol,omitempty"`
+	Transport  string `json:"transport,omitempty"`
+	IsAuto     bool   `json:"auto"`
+	Reverse    bool   `json:"reverse"`
+	Dynamic    bool   `json:"dynamic"`
+	VHost      string `json:"vhost,omitempty"`
+	// RemappedFrom is the requested master port when it was busy and the
+	// forward listens on another port instead.
+	RemappedFrom uint16 `json:"remapped_from,omitempty"`
+	Error        string `json:"error,omitempty"`
+	// User owns the remote process when it is not the agent's user.
+	User string `json:"user,omitempty"`
+	// RemoteBind lists the addresses an auto forwarded service listens on.
+	RemoteBind string `json:"remote_bind,omitempty"`
+	// Service is what the agent found listening, see ProbeResult, with the
+	// page title and the URL to open for web services.
+	Service string       `json:"service,omitempty"`
+	Title   string       `json:"title,omitempty"`
+	URL     string       `json:"url,omitempty"`
+	Stats   ForwardStats `json:"stats"`
+}
+
+// ForwardStats are the connection counters the master keeps per forward.
+// BytesOut is traffic sent towards the target, BytesIn the replies, and
+// FailedDials counts connections whose target could not be dialed (NAK).
+type ForwardStats struct {
+	ActiveConns int64     `json:"active_conns"`
+	TotalConns  uint64    `json:"total_conns"`
+	BytesIn     uint64    `json:"bytes_in"`
+	BytesOut    uint64    `json:"bytes_out"`
+	FailedDials uint64    `json:"failed_dials"`
+	LastActive  time.Time `json:"last_active"`
 }
 
+// ListResponse lists the master's forwards. MasterIP is the master's primary
+// IPv4 address and MasterIPs holds all of its addresses, see GetLocalIPs.
+// LocalOnly and AutoForward are the master's current settings.
 type ListResponse struct {
-	Entries  []ForwardEntry
-	MasterIP string
+	Entries     []ForwardEntry `json:"entries"`
+	MasterIP    string         `json:"master_ip"`
+	MasterIPs   []string       `json:"master_ips,omitempty"`
+	LocalOnly   bool           `json:"local_only"`
+	AutoForward bool           `json:"auto_forward"`
+	// Detected lists the ports held back by notify-only and
+	// require-approval rules, filled in by the agent.
+	Detected []DetectedPort `json:"detected,omitempty"`
 }
 
+// CloseRequest closes a single forward, or every forward labelled Name when
+// it is set. IsAuto marks requests of the agent's auto forwarder, which leave
+// pinned forwards alone.
 type CloseRequest struct {
-	Port uint16
+	ID        uint64
+	Port      uint16
+	LocalPath string
+	Protocol  string
+	Reverse   bool
+	VHost     string
+	Name      string
+	IsAuto    bool
 }
 
 type CloseResponse struct {
+	ID      uint64
+	Port    uint16
+	Success bool
+	Reason  string
+}
+
+// CloseBatchRequest is the CloseRequest counterpart of ListenBatchRequest.
+type CloseBatchRequest struct {
+	ID       uint64
+	Requests []CloseRequest
+}
+
+// CloseBatchResponse holds one CloseResponse per request, in request order.
+type CloseBatchResponse struct {
+	ID        uint64
+	Responses []CloseResponse
+}
+
+// PinRequest asks the master to keep the auto forward of Port as a manual
+// forward, so that it stays when the remote port closes.
+type PinRequest struct {
+	ID   uint64
+	Port uint16
+}
+
+type PinResponse struct {
+	ID      uint64
 	Port    uint16
 	Success bool
 	Reason  string
 }
 
+// AutoForwardState is sent by the master to switch the agent's auto
+// forwarding on or off, and by the agent whenever it was switched.
+type AutoForwardState struct {
+	Enabled bool
+}
+
+// LocalOnlyRequest asks the master to bind forwards to 127.0.0.1 only, or to
+// all interfaces, like the --local flag.
+type LocalOnlyRequest struct {
+	Enabled bool
+}
+
 type Heartbeat struct{}
 
 type HeartbeatAck struct{}
@@ -78,20 +237,85 @@ func Register() {
 	gob.Register(StreamHeader{})
 	gob.Register(ListenRequest{})
 	gob.Register(ListenResponse{})
+	gob.Register(ListenBatchRequest{})
+	gob.Register(ListenBatchResponse{})
+	gob.Register(ReverseRequest{})
+	gob.Register(ReverseResponse{})
 	gob.Register(ListRequest{})
 	gob.Register(ListResponse{})
 	gob.Register(ForwardEntry{})
 	gob.Register(CloseRequest{})
 	gob.Register(CloseResponse{})
+	gob.Register(CloseBatchRequest{})
+	gob.Register(CloseBatchResponse{})
+	gob.Register(PinRequest{})
+	gob.Register(PinResponse{})
+	gob.Register(AutoForwardState{})
+	gob.Register(LocalOnlyRequest{})
 	gob.Register(Heartbeat{})
 	gob.Register(HeartbeatAck{})
 	gob.Register(Shutdown{})
+	gob.Register(Event{})
+	gob.Register(ProbeRequest{})
+	gob.Register(ProbeResult{})
+}
+
+// maxNameLen caps the length of a forward label.
+const maxNameLen = 64
+
+// IsValidName reports whether name can label a forward: a letter followed by
+// letters, digits, '_', '.' or '-'. Starting with a letter keeps labels apart
+// from the port specs of `mpf close`.
+func IsValidName(name string) bool {
+	if name == "" || len(name) > maxNameLen {
+		return false
+	}
+	for i, c := range name {
+		isLetter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if i == 0 && !isLetter {
+			return false
+		}
+		if !isLetter && (c < '0' || c > '9') && c != '_' && c != '.' && c != '-' {
+			return false
+		}
+	}
+	return true
 }
 
 func GetUnixSocketPath() string {
 	return "/tmp/mpf-" + strconv.Itoa(os.Getuid()) + ".sock"
 }
 
+// GetMasterSocketPath returns the control socket of the master process
+// connected to target ([user@]host).
+func GetMasterSocketPath(target string) string {
+	return "/tmp/mpf-" + strconv.Itoa(os.Getuid()) + "-master-" + strings.ReplaceAll(target, "/", "_") + ".sock"
+}
+
+// GetLocalIPs returns all non-loopback addresses of this host, IPv4 first,
+// skipping IPv6 link-local addresses. It falls back to the loopback addresses.
+func GetLocalIPs() []string {
+	var v4, v6 []string
+	addrs, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, address := range addrs {
+			ipnet, ok := address.(*net.IPNet)
+			if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if ipnet.IP.To4() != nil {
+				v4 = append(v4, ipnet.IP.String())
+			} else {
+				v6 = append(v6, ipnet.IP.String())
+			}
+		}
+	}
+	if len(v4)+len(v6) == 0 {
+		return []string{"127.0.0.1", "::1"}
+	}
+	return append(v4, v6...)
+}
+
 func GetLocalIP() string {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
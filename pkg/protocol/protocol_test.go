@@ -3,6 +3,7 @@ package protocol
 import (
 	"bytes"
 	"encoding/gob"
+	"net"
 	"os"
 	"strconv"
 	"testing"
@@ -25,6 +26,18 @@ func TestGetLocalIP(t *testing.T) {
 	// It should at least be 127.0.0.1 or some valid IP
 }
 
+func TestGetLocalIPs(t *testing.T) {
+	ips := GetLocalIPs()
+	if len(ips) == 0 {
+		t.Fatal("GetLocalIPs returned no addresses")
+	}
+	for _, ip := range ips {
+		if net.ParseIP(ip) == nil {
+			t.Errorf("GetLocalIPs returned invalid address %q", ip)
+		}
+	}
+}
+
 func TestRegister(t *testing.T) {
 	Register()
 
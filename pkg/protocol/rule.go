@@ -0,0 +1,185 @@
+package protocol
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Actions of an AutoForwardRule.
+const (
+	ActionForward         = "forward"
+	ActionIgnore          = "ignore"
+	ActionNotifyOnly      = "notify-only"
+	ActionRequireApproval = "require-approval"
+)
+
+// AutoForwardRule decides what the agent's auto forwarder does with a
+// listening port, like the portsAttributes of VS Code. The master sends its
+// rules in Hello; the first rule matching a port applies, and ports matched
+// by none are forwarded unless below 1024 or excluded by name.
+//
+// Empty match fields match anything. Ports is a comma separated list of
+// ports and ranges, Process a regexp on the process name or executable
+// path, Cmdline a regexp on the command line, Bind the address listened on,
+// User the owner of the process and Container a regexp on the name of the
+// container publishing the port.
+type AutoForwardRule struct {
+	Ports     string
+	Process   string
+	Cmdline   string
+	Bind      string
+	User      string
+	Container string
+
+	Action string
+	// Label names the forward instead of the process, see IsValidName.
+	Label string
+	// LocalPort is the master port to listen on instead of the same port.
+	LocalPort uint16
+	// Silent forwards without a notification on the master.
+	Silent bool
+}
+
+// PortListener describes a listening port for matching rules. Container is
+// set instead of the process fields for a port published by a container.
+type PortListener struct {
+	Port      uint16
+	Bind      string
+	Process   string
+	Exe       string
+	Cmdline   string
+	User      string
+	Container string
+}
+
+// DetectedPort is a listening port the agent did not forward because of a
+// notify-only or require-approval rule, reported in the list.
+type DetectedPort struct {
+	Port   uint16 `json:"port"`
+	Label  string `json:"label,omitempty"`
+	Action string `json:"action"`
+}
+
+type compiledRule struct {
+	AutoForwardRule
+	ports     [][2]uint16
+	process   *regexp.Regexp
+	cmdline   *regexp.Regexp
+	container *regexp.Regexp
+}
+
+// RuleMatcher matches listening ports against compiled rules.
+type RuleMatcher struct {
+	rules []compiledRule
+}
+
+// CompileRules checks rules and prepares them for matching.
+func CompileRules(rules []AutoForwardRule) (*RuleMatcher, error) {
+	m := &RuleMatcher{}
+	for _, r := range rules {
+		c, err := compileRule(r)
+		if err != nil {
+			return nil, err
+		}
+		m.rules = append(m.rules, c)
+	}
+	return m, nil
+}
+
+func compileRule(r AutoForwardRule) (compiledRule, error) {
+	c := compiledRule{AutoForwardRule: r}
+
+	switch r.Action {
+	case ActionForward, ActionIgnore, ActionNotifyOnly, ActionRequireApproval:
+	default:
+		return c, fmt.Errorf("invalid action %q, expected %s, %s, %s or %s",
+			r.Action, ActionForward, ActionIgnore, ActionNotifyOnly, ActionRequireApproval)
+	}
+	if r.Label != "" && !IsValidName(r.Label) {
+		return c, fmt.Errorf("invalid label %q", r.Label)
+	}
+
+	if r.Ports != "" {
+		for _, s := range strings.Split(r.Ports, ",") {
+			firstStr, lastStr, found := strings.Cut(strings.TrimSpace(s), "-")
+			first, err := parsePort(firstStr)
+			if err != nil {
+				return c, err
+			}
+			last := first
+			if found {
+				if last, err = parsePort(lastStr); err != nil {
+					return c, err
+				}
+			}
+			if last < first {
+				return c, fmt.Errorf("invalid port range: %s", s)
+			}
+			c.ports = append(c.ports, [2]uint16{first, last})
+		}
+	}
+
+	var err error
+	if r.Process != "" {
+		if c.process, err = regexp.Compile(r.Process); err != nil {
+			return c, fmt.Errorf("invalid process regexp: %v", err)
+		}
+	}
+	if r.Cmdline != "" {
+		if c.cmdline, err = regexp.Compile(r.Cmdline); err != nil {
+			return c, fmt.Errorf("invalid cmdline regexp: %v", err)
+		}
+	}
+	if r.Container != "" {
+		if c.container, err = regexp.Compile(r.Container); err != nil {
+			return c, fmt.Errorf("invalid container regexp: %v", err)
+		}
+	}
+	return c, nil
+}
+
+// Match returns the first rule matching l, or nil. A nil *RuleMatcher
+// matches nothing.
+func (m *RuleMatcher) Match(l PortListener) *AutoForwardRule {
+	if m == nil {
+		return nil
+	}
+	for i := range m.rules {
+		if m.rules[i].matches(l) {
+			return &m.rules[i].AutoForwardRule
+		}
+	}
+	return nil
+}
+
+func (c *compiledRule) matches(l PortListener) bool {
+	if len(c.ports) > 0 {
+		inRange := false
+		for _, r := range c.ports {
+			if l.Port >= r[0] && l.Port <= r[1] {
+				inRange = true
+				break
+			}
+		}
+		if !inRange {
+			return false
+		}
+	}
+	if c.process != nil && !c.process.MatchString(l.Process) && !c.process.MatchString(l.Exe) {
+		return false
+	}
+	if c.cmdline != nil && !c.cmdline.MatchString(l.Cmdline) {
+		return false
+	}
+	if c.container != nil && (l.Container == "" || !c.container.MatchString(l.Container)) {
+		return false
+	}
+	if c.Bind != "" && c.Bind != l.Bind {
+		return false
+	}
+	if c.User != "" && c.User != l.User {
+		return false
+	}
+	return true
+}
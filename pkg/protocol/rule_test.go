@@ -0,0 +1,65 @@
+package protocol
+
+import "testing"
+
+func TestCompileRules(t *testing.T) {
+	bad := []AutoForwardRule{
+		{Action: "drop"},
+		{Action: ActionForward, Ports: "0"},
+		{Action: ActionForward, Ports: "4000-3000"},
+		{Action: ActionForward, Process: "("},
+		{Action: ActionForward, Cmdline: "[a"},
+		{Action: ActionForward, Container: "(db"},
+		{Action: ActionForward, Label: "1web"},
+	}
+	for _, r := range bad {
+		if _, err := CompileRules([]AutoForwardRule{r}); err == nil {
+			t.Errorf("Expected %+v to be rejected", r)
+		}
+	}
+}
+
+func TestRuleMatcher(t *testing.T) {
+	m, err := CompileRules([]AutoForwardRule{
+		{Ports: "22,5432", Action: ActionIgnore},
+		{Ports: "3000-3999", Process: "^node$", Action: ActionForward, Label: "web", LocalPort: 13000},
+		{Cmdline: "jupyter", Action: ActionRequireApproval},
+		{Bind: "0.0.0.0", User: "root", Action: ActionNotifyOnly},
+		{Container: "^db$", Action: ActionIgnore},
+	})
+	if err != nil {
+		t.Fatalf("CompileRules failed: %v", err)
+	}
+
+	tests := []struct {
+		l    PortListener
+		want string
+	}{
+		{PortListener{Port: 5432, Process: "postgres"}, ActionIgnore},
+		{PortListener{Port: 3001, Process: "node"}, ActionForward},
+		{PortListener{Port: 3001, Exe: "/usr/bin/node", Process: "npm"}, ""},
+		{PortListener{Port: 8888, Cmdline: "python -m jupyter lab"}, ActionRequireApproval},
+		{PortListener{Port: 9000, Bind: "0.0.0.0", User: "root"}, ActionNotifyOnly},
+		{PortListener{Port: 9000, Bind: "127.0.0.1", User: "root"}, ""},
+		{PortListener{Port: 3306, Container: "db"}, ActionIgnore},
+		{PortListener{Port: 3306, Process: "db"}, ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if r := m.Match(tt.l); r != nil {
+			got = r.Action
+		}
+		if got != tt.want {
+			t.Errorf("Match(%+v) = %q, want %q", tt.l, got, tt.want)
+		}
+	}
+
+	if r := m.Match(PortListener{Port: 3500, Process: "node"}); r == nil || r.Label != "web" || r.LocalPort != 13000 {
+		t.Errorf("Expected the node rule with its attributes, got %+v", r)
+	}
+
+	var none *RuleMatcher
+	if none.Match(PortListener{Port: 80}) != nil {
+		t.Errorf("Expected a nil matcher to match nothing")
+	}
+}
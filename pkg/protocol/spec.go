@@ -0,0 +1,300 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxPortRange caps how many ports a single range may expand to.
+const maxPortRange = 1024
+
+// ParseForwardSpec parses the argument of `mpf forward` into the ListenRequests
+// sent to the master. Supported forms are:
+//
+//	8080                        slave 8080 -> master 8080
+//	20000:8080                  slave 20000 -> master 8080
+//	3000-3015                   slave 3000..3015 -> master 3000..3015
+//	13000-13015:3000-3015       slave 13000..13015 -> master 3000..3015
+//	db.internal:5432[:15432]    slave-reachable db.internal:5432 -> master 15432
+//	8080:[::1]:8080             slave 8080 -> master 8080 bound to ::1 only
+//	udp:5353[:15353]            same as above for UDP
+//	unix:/remote.sock:8080      slave unix socket -> master 8080
+//	unix:/remote.sock:unix:/local.sock
+//	                            slave unix socket -> master unix socket
+//
+// In general a spec is [udp:][host:]slavePort[:[bind:]masterPort]. A port
+// range yields one request per port.
+func ParseForwardSpec(arg string) ([]ListenRequest, error) {
+	req := ListenRequest{
+		RemoteHost: "localhost",
+		Protocol:   ProtocolTCP,
+	}
+
+	if rest, ok := strings.CutPrefix(arg, "unix:"); ok {
+		req.Protocol = ProtocolUnix
+		if i := strings.Index(rest, ":unix:"); i >= 0 {
+			req.RemotePath = rest[:i]
+			req.LocalAddr = "unix:" + rest[i+len(":unix:"):]
+			if req.RemotePath == "" || req.LocalAddr == "unix:" {
+				return nil, fmt.Errorf("invalid unix socket mapping: %s", arg)
+			}
+			return []ListenRequest{req}, nil
+		}
+
+		i := strings.LastIndex(rest, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("unix socket forward needs a local port or unix:/path: %s", arg)
+		}
+		masterPort, err := parsePort(rest[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		req.RemotePath = rest[:i]
+		req.LocalAddr = fmt.Sprintf(":%d", masterPort)
+		return []ListenRequest{req}, nil
+	}
+
+	if rest, ok := strings.CutPrefix(arg, "udp:"); ok {
+		req.Protocol = ProtocolUDP
+		arg = rest
+	}
+
+	parts, err := splitSpec(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	// A leading part that is not a port is the host to dial from the slave side
+	if len(parts) > 1 && !isPortSpec(parts[0]) {
+		req.RemoteHost = parts[0]
+		parts = parts[1:]
+	}
+
+	var slaveStr, bind, masterStr string
+	switch len(parts) {
+	case 1:
+		slaveStr, masterStr = parts[0], parts[0]
+	case 2:
+		slaveStr, masterStr = parts[0], parts[1]
+	case 3:
+		slaveStr, bind, masterStr = parts[0], parts[1], parts[2]
+		if bind == "" || isPortSpec(bind) {
+			return nil, fmt.Errorf("invalid bind address in %s", arg)
+		}
+	default:
+		return nil, fmt.Errorf("invalid port mapping: %s", arg)
+	}
+
+	slaveFirst, slaveLast, err := parsePortRange(slaveStr)
+	if err != nil {
+		return nil, err
+	}
+	masterFirst, masterLast, err := parsePortRange(masterStr)
+	if err != nil {
+		return nil, err
+	}
+	if slaveLast-slaveFirst != masterLast-masterFirst {
+		return nil, fmt.Errorf("port ranges differ in size: %s", arg)
+	}
+
+	reqs := make([]ListenRequest, 0, int(slaveLast-slaveFirst)+1)
+	for i := 0; i <= int(slaveLast-slaveFirst); i++ {
+		req.RemotePort = slaveFirst + uint16(i)
+		req.LocalAddr = net.JoinHostPort(bind, strconv.Itoa(int(masterFirst)+i))
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+// ParseForwardArgs parses the arguments of `mpf forward`: one or more specs,
+// or "--host <name> <port>" for a host routed forward. "--name <label>" may
+// appear anywhere to label a single forward.
+func ParseForwardArgs(args []string) ([]ListenRequest, error) {
+	var reqs []ListenRequest
+	var vhost, name string
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		if args[i] != "--name" {
+			rest = append(rest, args[i])
+			continue
+		}
+		if i+1 >= len(args) || !IsValidName(args[i+1]) {
+			return nil, fmt.Errorf("--name takes a label starting with a letter, followed by letters, digits, '_', '.' or '-'")
+		}
+		name = args[i+1]
+		i++
+	}
+	args = rest
+	if len(args) >= 1 && args[0] == "--host" {
+		if len(args) != 3 {
+			return nil, fmt.Errorf("--host takes a name and a single port")
+		}
+		vhost = args[1]
+		args = args[2:]
+	}
+	for _, arg := range args {
+		r, err := ParseForwardSpec(arg)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid port mapping %s: %v", arg, err)
+		}
+		reqs = append(reqs, r...)
+	}
+	if vhost != "" {
+		if len(reqs) != 1 || reqs[0].Protocol != ProtocolTCP {
+			return nil, fmt.Errorf("--host takes a name and a single TCP port")
+		}
+		reqs[0].VHost = vhost
+	}
+	if len(reqs) == 0 {
+		return nil, fmt.Errorf("Invalid port mapping")
+	}
+	if name != "" {
+		if len(reqs) != 1 {
+			return nil, fmt.Errorf("--name labels a single forward")
+		}
+		reqs[0].Name = name
+	}
+	return reqs, nil
+}
+
+// ParseCloseArgs parses the arguments of `mpf close` other than --reverse:
+// specs, forward labels and "--host <name>" pairs.
+func ParseCloseArgs(args []string) ([]CloseRequest, error) {
+	var reqs []CloseRequest
+	for len(args) >= 2 && args[0] == "--host" {
+		reqs = append(reqs, CloseRequest{VHost: args[1]})
+		args = args[2:]
+	}
+	for _, arg := range args {
+		r, err := ParseCloseSpec(arg)
+		if err != nil && IsValidName(arg) {
+			r, err = []CloseRequest{{Name: arg}}, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid port: %s", arg)
+		}
+		reqs = append(reqs, r...)
+	}
+	if len(reqs) == 0 {
+		return nil, fmt.Errorf("Invalid port")
+	}
+	return reqs, nil
+}
+
+// splitSpec splits a forward spec on ':' while keeping bracketed IPv6
+// literals together; the brackets are removed from the returned host.
+func splitSpec(arg string) ([]string, error) {
+	var parts []string
+	for {
+		if strings.HasPrefix(arg, "[") {
+			end := strings.Index(arg, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("missing ']' in %s", arg)
+			}
+			parts = append(parts, arg[1:end])
+			arg = arg[end+1:]
+			if arg == "" {
+				return parts, nil
+			}
+			if !strings.HasPrefix(arg, ":") {
+				return nil, fmt.Errorf("expected ':' after ']' in %s", arg)
+			}
+			arg = arg[1:]
+			continue
+		}
+
+		part, rest, found := strings.Cut(arg, ":")
+		parts = append(parts, part)
+		if !found {
+			return parts, nil
+		}
+		arg = rest
+	}
+}
+
+// isPortSpec reports whether s is a port or a port range.
+func isPortSpec(s string) bool {
+	first, last, found := strings.Cut(s, "-")
+	if !found {
+		return isNumeric(s)
+	}
+	return isNumeric(first) && isNumeric(last)
+}
+
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseCloseSpec parses the argument of `mpf close`: a master port or port
+// range, optionally prefixed with "udp:", or "unix:/local.sock" for a local
+// unix socket.
+func ParseCloseSpec(arg string) ([]CloseRequest, error) {
+	req := CloseRequest{Protocol: ProtocolTCP}
+
+	if path, ok := strings.CutPrefix(arg, "unix:"); ok {
+		if path == "" {
+			return nil, fmt.Errorf("invalid unix socket path: %s", arg)
+		}
+		req.Protocol = ProtocolUnix
+		req.LocalPath = path
+		return []CloseRequest{req}, nil
+	}
+
+	if rest, ok := strings.CutPrefix(arg, "udp:"); ok {
+		req.Protocol = ProtocolUDP
+		arg = rest
+	}
+
+	first, last, err := parsePortRange(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	reqs := make([]CloseRequest, 0, int(last-first)+1)
+	for p := int(first); p <= int(last); p++ {
+		req.Port = uint16(p)
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+// parsePortRange parses "3000" or "3000-3015" into its first and last port.
+func parsePortRange(s string) (uint16, uint16, error) {
+	firstStr, lastStr, found := strings.Cut(s, "-")
+	first, err := parsePort(firstStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !found {
+		return first, first, nil
+	}
+	last, err := parsePort(lastStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	if last < first {
+		return 0, 0, fmt.Errorf("invalid port range: %s", s)
+	}
+	if int(last-first) >= maxPortRange {
+		return 0, 0, fmt.Errorf("port range %s is larger than %d ports", s, maxPortRange)
+	}
+	return first, last, nil
+}
+
+func parsePort(s string) (uint16, error) {
+	p, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || p == 0 {
+		return 0, fmt.Errorf("invalid port: %s", s)
+	}
+	return uint16(p), nil
+}
@@ -0,0 +1,184 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseForwardSpec(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want ListenRequest
+	}{
+		{"8080", ListenRequest{LocalAddr: ":8080", RemoteHost: "localhost", RemotePort: 8080, Protocol: ProtocolTCP}},
+		{"20000:8080", ListenRequest{LocalAddr: ":8080", RemoteHost: "localhost", RemotePort: 20000, Protocol: ProtocolTCP}},
+		{"db.internal:5432", ListenRequest{LocalAddr: ":5432", RemoteHost: "db.internal", RemotePort: 5432, Protocol: ProtocolTCP}},
+		{"db.internal:5432:15432", ListenRequest{LocalAddr: ":15432", RemoteHost: "db.internal", RemotePort: 5432, Protocol: ProtocolTCP}},
+		{"10.0.0.5:6379:16379", ListenRequest{LocalAddr: ":16379", RemoteHost: "10.0.0.5", RemotePort: 6379, Protocol: ProtocolTCP}},
+		{"[fd00::5]:6379:16379", ListenRequest{LocalAddr: ":16379", RemoteHost: "fd00::5", RemotePort: 6379, Protocol: ProtocolTCP}},
+		{"udp:dns.internal:53:5353", ListenRequest{LocalAddr: ":5353", RemoteHost: "dns.internal", RemotePort: 53, Protocol: ProtocolUDP}},
+		{"8080:[::1]:8080", ListenRequest{LocalAddr: "[::1]:8080", RemoteHost: "localhost", RemotePort: 8080, Protocol: ProtocolTCP}},
+		{"8080:[::]:18080", ListenRequest{LocalAddr: "[::]:18080", RemoteHost: "localhost", RemotePort: 8080, Protocol: ProtocolTCP}},
+		{"db.internal:5432:192.168.1.5:15432", ListenRequest{LocalAddr: "192.168.1.5:15432", RemoteHost: "db.internal", RemotePort: 5432, Protocol: ProtocolTCP}},
+		{"udp:53:127.0.0.1:5353", ListenRequest{LocalAddr: "127.0.0.1:5353", RemoteHost: "localhost", RemotePort: 53, Protocol: ProtocolUDP}},
+		{"udp:5353", ListenRequest{LocalAddr: ":5353", RemoteHost: "localhost", RemotePort: 5353, Protocol: ProtocolUDP}},
+		{"udp:53:5353", ListenRequest{LocalAddr: ":5353", RemoteHost: "localhost", RemotePort: 53, Protocol: ProtocolUDP}},
+		{"unix:/var/run/docker.sock:2375", ListenRequest{LocalAddr: ":2375", RemoteHost: "localhost", RemotePath: "/var/run/docker.sock", Protocol: ProtocolUnix}},
+		{"unix:/run/postgresql/.s.PGSQL.5432:unix:/tmp/pg.sock", ListenRequest{LocalAddr: "unix:/tmp/pg.sock", RemoteHost: "localhost", RemotePath: "/run/postgresql/.s.PGSQL.5432", Protocol: ProtocolUnix}},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseForwardSpec(tt.arg)
+		if err != nil {
+			t.Errorf("ParseForwardSpec(%q) failed: %v", tt.arg, err)
+			continue
+		}
+		if len(got) != 1 || got[0] != tt.want {
+			t.Errorf("ParseForwardSpec(%q) = %+v, want %+v", tt.arg, got, tt.want)
+		}
+	}
+
+	for _, arg := range []string{"", "0", "abc", "8080:", "70000", "db.internal", "db.internal:5432:1:2", "8080::8080", "8080:[::1]:", "[fd00::5:6379", "unix:/var/run/docker.sock", "unix::8080", "unix:/a.sock:unix:", "3015-3000", "3000-3015:3000-3001", "3000-3001:8080", "1-2000"} {
+		if _, err := ParseForwardSpec(arg); err == nil {
+			t.Errorf("ParseForwardSpec(%q) expected error", arg)
+		}
+	}
+}
+
+func TestParseForwardSpecRange(t *testing.T) {
+	got, err := ParseForwardSpec("13000-13015:3000-3015")
+	if err != nil {
+		t.Fatalf("ParseForwardSpec failed: %v", err)
+	}
+	if len(got) != 16 {
+		t.Fatalf("Expected 16 requests, got %d", len(got))
+	}
+	for i, req := range got {
+		want := ListenRequest{
+			LocalAddr:  fmt.Sprintf(":%d", 3000+i),
+			RemoteHost: "localhost",
+			RemotePort: uint16(13000 + i),
+			Protocol:   ProtocolTCP,
+		}
+		if req != want {
+			t.Errorf("Request %d = %+v, want %+v", i, req, want)
+		}
+	}
+
+	got, err = ParseForwardSpec("udp:db.internal:3000-3001")
+	if err != nil {
+		t.Fatalf("ParseForwardSpec failed: %v", err)
+	}
+	if len(got) != 2 || got[1].RemoteHost != "db.internal" || got[1].RemotePort != 3001 || got[1].LocalAddr != ":3001" || got[1].Protocol != ProtocolUDP {
+		t.Errorf("Unexpected requests: %+v", got)
+	}
+}
+
+func TestParseCloseSpecRange(t *testing.T) {
+	got, err := ParseCloseSpec("udp:3000-3002")
+	if err != nil {
+		t.Fatalf("ParseCloseSpec failed: %v", err)
+	}
+	want := []CloseRequest{
+		{Port: 3000, Protocol: ProtocolUDP},
+		{Port: 3001, Protocol: ProtocolUDP},
+		{Port: 3002, Protocol: ProtocolUDP},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d requests, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Request %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestParseCloseSpec(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want CloseRequest
+	}{
+		{"8080", CloseRequest{Port: 8080, Protocol: ProtocolTCP}},
+		{"udp:5353", CloseRequest{Port: 5353, Protocol: ProtocolUDP}},
+		{"unix:/tmp/pg.sock", CloseRequest{LocalPath: "/tmp/pg.sock", Protocol: ProtocolUnix}},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseCloseSpec(tt.arg)
+		if err != nil {
+			t.Errorf("ParseCloseSpec(%q) failed: %v", tt.arg, err)
+			continue
+		}
+		if len(got) != 1 || got[0] != tt.want {
+			t.Errorf("ParseCloseSpec(%q) = %+v, want %+v", tt.arg, got, tt.want)
+		}
+	}
+
+	for _, arg := range []string{"", "abc", "unix:", "3001-3000", "3000-"} {
+		if _, err := ParseCloseSpec(arg); err == nil {
+			t.Errorf("ParseCloseSpec(%q) expected error", arg)
+		}
+	}
+}
+
+func TestParseForwardArgs(t *testing.T) {
+	reqs, err := ParseForwardArgs([]string{"8080", "udp:5353:15353"})
+	if err != nil || len(reqs) != 2 || reqs[1].Protocol != ProtocolUDP || reqs[1].LocalAddr != ":15353" {
+		t.Errorf("Unexpected requests %+v (err %v)", reqs, err)
+	}
+
+	reqs, err = ParseForwardArgs([]string{"--host", "web", "3000"})
+	if err != nil || len(reqs) != 1 || reqs[0].VHost != "web" || reqs[0].RemotePort != 3000 {
+		t.Errorf("Unexpected host request %+v (err %v)", reqs, err)
+	}
+
+	reqs, err = ParseForwardArgs([]string{"5432", "--name", "pg"})
+	if err != nil || len(reqs) != 1 || reqs[0].Name != "pg" || reqs[0].RemotePort != 5432 {
+		t.Errorf("Unexpected named request %+v (err %v)", reqs, err)
+	}
+
+	for _, args := range [][]string{nil, {"--host", "web"}, {"--host", "web", "udp:53"}, {"abc"},
+		{"5432", "--name"}, {"5432", "--name", "1pg"}, {"3000-3001", "--name", "web"}} {
+		if _, err := ParseForwardArgs(args); err == nil {
+			t.Errorf("Expected error for %v", args)
+		}
+	}
+}
+
+func TestParseCloseArgs(t *testing.T) {
+	reqs, err := ParseCloseArgs([]string{"--host", "web", "3000-3001"})
+	if err != nil || len(reqs) != 3 || reqs[0].VHost != "web" || reqs[2].Port != 3001 {
+		t.Errorf("Unexpected requests %+v (err %v)", reqs, err)
+	}
+	if _, err := ParseCloseArgs(nil); err == nil {
+		t.Error("Expected error without arguments")
+	}
+
+	reqs, err = ParseCloseArgs([]string{"pg", "udp:53"})
+	if err != nil || len(reqs) != 2 || reqs[0].Name != "pg" || reqs[1].Port != 53 {
+		t.Errorf("Unexpected named requests %+v (err %v)", reqs, err)
+	}
+	for _, arg := range []string{"-pg", "8080x"} {
+		if _, err := ParseCloseArgs([]string{arg}); err == nil {
+			t.Errorf("Expected error for %s", arg)
+		}
+	}
+}
+
+func TestIsValidName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"pg":                    true,
+		"web-api.v2_x":          true,
+		"":                      false,
+		"8080":                  false,
+		"udp:53":                false,
+		"has space":             false,
+		strings.Repeat("a", 65): false,
+	} {
+		if got := IsValidName(name); got != want {
+			t.Errorf("IsValidName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Session is a running `mpf mosh` process as recorded in the registry under
+// ~/.mpf/sessions. Its transport and forwards are asked for live on Socket,
+// which is empty when another master for the same target holds it.
+type Session struct {
+	PID     int       `json:"pid"`
+	Target  string    `json:"target"`
+	Socket  string    `json:"socket"`
+	Started time.Time `json:"started"`
+}
+
+func registryDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(home, ".mpf", "sessions")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// Register records this process as the master of target, listening for
+// control requests on socket. The returned func removes the record.
+func Register(target, socket string) (func(), error) {
+	dir, err := registryDir()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(Session{
+		PID:     os.Getpid(),
+		Target:  target,
+		Socket:  socket,
+		Started: time.Now(),
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, strconv.Itoa(os.Getpid())+".json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+	return func() { _ = os.Remove(path) }, nil
+}
+
+// Sessions lists the registered master processes by target. Records of
+// processes that died are removed, and so are their control sockets unless a
+// live master lists or still answers on the same path.
+func Sessions() ([]Session, error) {
+	dir, err := registryDir()
+	if err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []Session
+	var stale []string
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var s Session
+		if err := json.Unmarshal(data, &s); err != nil || !processAlive(s.PID) {
+			_ = os.Remove(path)
+			if s.Socket != "" {
+				stale = append(stale, s.Socket)
+			}
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+
+	// Every master of a target uses the same socket path, which a new
+	// master may hold by now
+	for _, sock := range stale {
+		if !socketInUse(sock, sessions) {
+			_ = os.Remove(sock)
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Target != sessions[j].Target {
+			return sessions[i].Target < sessions[j].Target
+		}
+		return sessions[i].PID < sessions[j].PID
+	})
+	return sessions, nil
+}
+
+// socketInUse reports whether a live session lists sock or something still
+// answers on it.
+func socketInUse(sock string, sessions []Session) bool {
+	for _, s := range sessions {
+		if s.Socket == sock {
+			return true
+		}
+	}
+	conn, err := net.DialTimeout("unix", sock, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -2,8 +2,12 @@ package state
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -12,8 +16,25 @@ type Config struct {
 }
 
 type RemoteConfig struct {
-	// Map of masterPort -> slavePort
+	// Map of [bind:]masterPort -> [slaveHost:]slavePort, see FormatLocal
+	// and FormatTarget
 	Forwards map[string]string `json:"forwards"`
+	// Map of slavePort -> masterPort for reverse forwards
+	Reverse map[string]string `json:"reverse,omitempty"`
+	// Map of [bind:]masterPort -> [slaveHost:]slavePort for UDP forwards
+	UDP map[string]string `json:"udp,omitempty"`
+	// Map of [bind:]masterPort (or "unix:/local/path") -> slave socket path
+	Unix map[string]string `json:"unix,omitempty"`
+	// List of [bind:]masterPorts running a SOCKS5/HTTP CONNECT proxy
+	Dynamic []string `json:"dynamic,omitempty"`
+	// Map of host route name -> [slaveHost:]slavePort
+	Routes map[string]string `json:"routes,omitempty"`
+	// Map of requested masterPort -> masterPort used instead as it was busy
+	Remaps map[string]string `json:"remaps,omitempty"`
+	// Map of forward key -> label given with `mpf forward --name`. Keys are
+	// "tcp:<masterPort>", "udp:<masterPort>", "unix:/local/path" and
+	// "host:<route name>", using the requested port of remapped forwards.
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 type Manager struct {
@@ -58,9 +79,9 @@ func (m *Manager) AddForward(remote, slavePort, masterPort string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	rc, ok := m.cfg.Remotes[remote]
-	if !ok || rc.Forwards == nil {
-		rc = RemoteConfig{Forwards: make(map[string]string)}
+	rc := m.cfg.Remotes[remote]
+	if rc.Forwards == nil {
+		rc.Forwards = make(map[string]string)
 	}
 
 	rc.Forwards[masterPort] = slavePort
@@ -77,7 +98,8 @@ func (m *Manager) RemoveForward(remote, masterPort string) error {
 		return nil
 	}
 
-	delete(rc.Forwards, masterPort)
+	deleteLocal(rc.Forwards, masterPort)
+	delete(rc.Labels, "tcp:"+masterPort)
 	m.cfg.Remotes[remote] = rc
 	return m.save()
 }
@@ -92,6 +114,338 @@ func (m *Manager) GetForwards(remote string) map[string]string {
 	return res
 }
 
+func (m *Manager) AddUDPForward(remote, slavePort, masterPort string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rc := m.cfg.Remotes[remote]
+	if rc.UDP == nil {
+		rc.UDP = make(map[string]string)
+	}
+
+	rc.UDP[masterPort] = slavePort
+	m.cfg.Remotes[remote] = rc
+	return m.save()
+}
+
+func (m *Manager) RemoveUDPForward(remote, masterPort string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rc, ok := m.cfg.Remotes[remote]
+	if !ok || rc.UDP == nil {
+		return nil
+	}
+
+	deleteLocal(rc.UDP, masterPort)
+	delete(rc.Labels, "udp:"+masterPort)
+	m.cfg.Remotes[remote] = rc
+	return m.save()
+}
+
+func (m *Manager) GetUDPForwards(remote string) map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make(map[string]string)
+	for k, v := range m.cfg.Remotes[remote].UDP {
+		res[k] = v
+	}
+	return res
+}
+
+func (m *Manager) AddRoute(remote, name, slave string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rc := m.cfg.Remotes[remote]
+	if rc.Routes == nil {
+		rc.Routes = make(map[string]string)
+	}
+
+	rc.Routes[name] = slave
+	m.cfg.Remotes[remote] = rc
+	return m.save()
+}
+
+func (m *Manager) RemoveRoute(remote, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rc, ok := m.cfg.Remotes[remote]
+	if !ok || rc.Routes == nil {
+		return nil
+	}
+
+	delete(rc.Routes, name)
+	delete(rc.Labels, "host:"+name)
+	m.cfg.Remotes[remote] = rc
+	return m.save()
+}
+
+func (m *Manager) GetRoutes(remote string) map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make(map[string]string)
+	for k, v := range m.cfg.Remotes[remote].Routes {
+		res[k] = v
+	}
+	return res
+}
+
+func (m *Manager) AddRemap(remote, requested, actual string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rc := m.cfg.Remotes[remote]
+	if rc.Remaps == nil {
+		rc.Remaps = make(map[string]string)
+	}
+
+	rc.Remaps[requested] = actual
+	m.cfg.Remotes[remote] = rc
+	return m.save()
+}
+
+func (m *Manager) RemoveRemap(remote, requested string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rc, ok := m.cfg.Remotes[remote]
+	if !ok || rc.Remaps == nil {
+		return nil
+	}
+
+	delete(rc.Remaps, requested)
+	m.cfg.Remotes[remote] = rc
+	return m.save()
+}
+
+func (m *Manager) GetRemaps(remote string) map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make(map[string]string)
+	for k, v := range m.cfg.Remotes[remote].Remaps {
+		res[k] = v
+	}
+	return res
+}
+
+func (m *Manager) AddUnixForward(remote, slavePath, local string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rc := m.cfg.Remotes[remote]
+	if rc.Unix == nil {
+		rc.Unix = make(map[string]string)
+	}
+
+	rc.Unix[local] = slavePath
+	m.cfg.Remotes[remote] = rc
+	return m.save()
+}
+
+func (m *Manager) RemoveUnixForward(remote, local string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rc, ok := m.cfg.Remotes[remote]
+	if !ok || rc.Unix == nil {
+		return nil
+	}
+
+	if strings.HasPrefix(local, "unix:") {
+		delete(rc.Unix, local)
+		delete(rc.Labels, local)
+	} else {
+		deleteLocal(rc.Unix, local)
+		delete(rc.Labels, "tcp:"+local)
+	}
+	m.cfg.Remotes[remote] = rc
+	return m.save()
+}
+
+func (m *Manager) GetUnixForwards(remote string) map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make(map[string]string)
+	for k, v := range m.cfg.Remotes[remote].Unix {
+		res[k] = v
+	}
+	return res
+}
+
+func (m *Manager) AddReverse(remote, slavePort, masterPort string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rc := m.cfg.Remotes[remote]
+	if rc.Reverse == nil {
+		rc.Reverse = make(map[string]string)
+	}
+
+	rc.Reverse[slavePort] = masterPort
+	m.cfg.Remotes[remote] = rc
+	return m.save()
+}
+
+func (m *Manager) RemoveReverse(remote, slavePort string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rc, ok := m.cfg.Remotes[remote]
+	if !ok || rc.Reverse == nil {
+		return nil
+	}
+
+	delete(rc.Reverse, slavePort)
+	m.cfg.Remotes[remote] = rc
+	return m.save()
+}
+
+func (m *Manager) GetReverses(remote string) map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make(map[string]string)
+	for k, v := range m.cfg.Remotes[remote].Reverse {
+		res[k] = v
+	}
+	return res
+}
+
+func (m *Manager) AddDynamic(remote, masterPort string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rc := m.cfg.Remotes[remote]
+	for _, p := range rc.Dynamic {
+		if p == masterPort {
+			return nil
+		}
+	}
+
+	rc.Dynamic = append(rc.Dynamic, masterPort)
+	m.cfg.Remotes[remote] = rc
+	return m.save()
+}
+
+func (m *Manager) RemoveDynamic(remote, masterPort string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rc, ok := m.cfg.Remotes[remote]
+	if !ok {
+		return nil
+	}
+
+	var kept []string
+	for _, p := range rc.Dynamic {
+		if localPort(p) != masterPort {
+			kept = append(kept, p)
+		}
+	}
+	rc.Dynamic = kept
+	delete(rc.Labels, "tcp:"+masterPort)
+	m.cfg.Remotes[remote] = rc
+	return m.save()
+}
+
+func (m *Manager) GetDynamics(remote string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.cfg.Remotes[remote].Dynamic...)
+}
+
+// SetLabel names the forward stored under key, see RemoteConfig.Labels. An
+// empty label removes the name.
+func (m *Manager) SetLabel(remote, key, label string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rc := m.cfg.Remotes[remote]
+	if label == "" {
+		if _, ok := rc.Labels[key]; !ok {
+			return nil
+		}
+		delete(rc.Labels, key)
+	} else {
+		if rc.Labels == nil {
+			rc.Labels = make(map[string]string)
+		}
+		rc.Labels[key] = label
+	}
+	m.cfg.Remotes[remote] = rc
+	return m.save()
+}
+
+func (m *Manager) GetLabels(remote string) map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make(map[string]string)
+	for k, v := range m.cfg.Remotes[remote].Labels {
+		res[k] = v
+	}
+	return res
+}
+
+// FormatTarget renders the slave side of a forward for the state file. The
+// host is omitted for localhost, so older entries holding just a port keep
+// their meaning.
+func FormatTarget(host string, port uint16) string {
+	if host == "" || host == "localhost" {
+		return strconv.Itoa(int(port))
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+// FormatLocal renders the master side of a forward for the state file: just
+// the port, or bind:port when localAddr names a bind address.
+func FormatLocal(localAddr string, port uint16) string {
+	host, _, err := net.SplitHostPort(localAddr)
+	if err != nil || host == "" {
+		return strconv.Itoa(int(port))
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+// ParseLocal turns a FormatLocal value back into a listen address.
+func ParseLocal(v string) string {
+	if _, _, err := net.SplitHostPort(v); err == nil {
+		return v
+	}
+	return ":" + v
+}
+
+// localPort returns the port of a FormatLocal value.
+func localPort(v string) string {
+	if _, port, err := net.SplitHostPort(v); err == nil {
+		return port
+	}
+	return v
+}
+
+// deleteLocal removes every entry of m listening on masterPort, whatever its
+// bind address, as the master keeps a single forward per port.
+func deleteLocal(m map[string]string, masterPort string) {
+	for k := range m {
+		if localPort(k) == masterPort {
+			delete(m, k)
+		}
+	}
+}
+
+// ParseTarget is the inverse of FormatTarget.
+func ParseTarget(v string) (string, uint16, error) {
+	host, portStr := "localhost", v
+	if h, p, err := net.SplitHostPort(v); err == nil {
+		host, portStr = h, p
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return "", 0, fmt.Errorf("invalid forward target: %s", v)
+	}
+	return host, uint16(port), nil
+}
+
 func (m *Manager) save() error {
 	data, err := json.MarshalIndent(m.cfg, "", "  ")
 	if err != nil {
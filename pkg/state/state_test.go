@@ -2,8 +2,11 @@ package state
 
 import (
 	"encoding/json"
+	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"testing"
 )
 
@@ -66,3 +69,284 @@ func TestStateManager(t *testing.T) {
 		t.Errorf("Expected masterPort to be removed")
 	}
 }
+
+func TestStateManagerReverse(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "moshpf-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	m := &Manager{
+		path: filepath.Join(tmpDir, "forwards.json"),
+		cfg: Config{
+			Remotes: make(map[string]RemoteConfig),
+		},
+	}
+
+	remote := "user@host"
+	if err := m.AddReverse(remote, "6000", "5000"); err != nil {
+		t.Fatalf("AddReverse failed: %v", err)
+	}
+	// Adding a normal forward must not drop the reverse one
+	if err := m.AddForward(remote, "1234", "5678"); err != nil {
+		t.Fatalf("AddForward failed: %v", err)
+	}
+
+	if got := m.GetReverses(remote)["6000"]; got != "5000" {
+		t.Errorf("Expected 5000, got %s", got)
+	}
+
+	if err := m.RemoveReverse(remote, "6000"); err != nil {
+		t.Errorf("RemoveReverse failed: %v", err)
+	}
+	if len(m.GetReverses(remote)) != 0 {
+		t.Errorf("Expected reverse forward to be removed")
+	}
+	if len(m.GetForwards(remote)) != 1 {
+		t.Errorf("Expected forward to be kept")
+	}
+}
+
+func TestStateManagerTarget(t *testing.T) {
+	tmpDir := t.TempDir()
+	m := &Manager{
+		path: filepath.Join(tmpDir, "forwards.json"),
+		cfg: Config{
+			Remotes: make(map[string]RemoteConfig),
+		},
+	}
+
+	remote := "user@host"
+	if err := m.AddForward(remote, FormatTarget("db.internal", 5432), "15432"); err != nil {
+		t.Fatalf("AddForward failed: %v", err)
+	}
+	if err := m.AddForward(remote, FormatTarget("fd00::5", 6379), "16379"); err != nil {
+		t.Fatalf("AddForward failed: %v", err)
+	}
+	if err := m.AddForward(remote, FormatTarget("localhost", 8080), "8080"); err != nil {
+		t.Fatalf("AddForward failed: %v", err)
+	}
+
+	tests := []struct {
+		masterPort string
+		stored     string
+		host       string
+		port       uint16
+	}{
+		{"15432", "db.internal:5432", "db.internal", 5432},
+		{"16379", "[fd00::5]:6379", "fd00::5", 6379},
+		{"8080", "8080", "localhost", 8080},
+	}
+
+	forwards := m.GetForwards(remote)
+	for _, tt := range tests {
+		if got := forwards[tt.masterPort]; got != tt.stored {
+			t.Errorf("Expected %s to be stored as %s, got %s", tt.masterPort, tt.stored, got)
+		}
+		host, port, err := ParseTarget(forwards[tt.masterPort])
+		if err != nil {
+			t.Errorf("ParseTarget(%s) failed: %v", tt.stored, err)
+			continue
+		}
+		if host != tt.host || port != tt.port {
+			t.Errorf("ParseTarget(%s) = %s, %d; want %s, %d", tt.stored, host, port, tt.host, tt.port)
+		}
+	}
+
+	if _, _, err := ParseTarget("db.internal"); err == nil {
+		t.Errorf("Expected error for target without port")
+	}
+}
+
+func TestStateManagerBind(t *testing.T) {
+	tmpDir := t.TempDir()
+	m := &Manager{
+		path: filepath.Join(tmpDir, "forwards.json"),
+		cfg: Config{
+			Remotes: make(map[string]RemoteConfig),
+		},
+	}
+
+	remote := "user@host"
+	tests := []struct {
+		localAddr string
+		port      uint16
+		stored    string
+		restored  string
+	}{
+		{":8080", 8080, "8080", ":8080"},
+		{"[::1]:8081", 8081, "[::1]:8081", "[::1]:8081"},
+		{"192.168.1.5:0", 8082, "192.168.1.5:8082", "192.168.1.5:8082"},
+	}
+
+	for _, tt := range tests {
+		key := FormatLocal(tt.localAddr, tt.port)
+		if key != tt.stored {
+			t.Errorf("FormatLocal(%s, %d) = %s, want %s", tt.localAddr, tt.port, key, tt.stored)
+		}
+		if got := ParseLocal(key); got != tt.restored {
+			t.Errorf("ParseLocal(%s) = %s, want %s", key, got, tt.restored)
+		}
+		if err := m.AddForward(remote, "80", key); err != nil {
+			t.Fatalf("AddForward failed: %v", err)
+		}
+	}
+
+	// Removal is by port, whatever the bind address
+	if err := m.RemoveForward(remote, "8081"); err != nil {
+		t.Fatalf("RemoveForward failed: %v", err)
+	}
+	forwards := m.GetForwards(remote)
+	if _, ok := forwards["[::1]:8081"]; ok || len(forwards) != 2 {
+		t.Errorf("Unexpected forwards after removal: %v", forwards)
+	}
+
+	// Unix socket forwards listening on TCP keep their bind address too
+	_ = m.AddUnixForward(remote, "/run/docker.sock", FormatLocal("127.0.0.1:0", 2375))
+	_ = m.AddUnixForward(remote, "/run/pg.sock", "unix:/tmp/pg.sock")
+	if path := m.GetUnixForwards(remote)["127.0.0.1:2375"]; path != "/run/docker.sock" {
+		t.Errorf("Expected bind address in unix forward key, got %v", m.GetUnixForwards(remote))
+	}
+	_ = m.RemoveUnixForward(remote, "2375")
+	if unix := m.GetUnixForwards(remote); len(unix) != 1 || unix["unix:/tmp/pg.sock"] != "/run/pg.sock" {
+		t.Errorf("Unexpected unix forwards after removal: %v", unix)
+	}
+}
+
+func TestStateManagerLabels(t *testing.T) {
+	tmpDir := t.TempDir()
+	m := &Manager{
+		path: filepath.Join(tmpDir, "forwards.json"),
+		cfg: Config{
+			Remotes: make(map[string]RemoteConfig),
+		},
+	}
+
+	remote := "user@host"
+	_ = m.AddForward(remote, "5432", "5432")
+	_ = m.AddUDPForward(remote, "5353", "5353")
+	_ = m.AddUnixForward(remote, "/run/pg.sock", "unix:/tmp/pg.sock")
+	_ = m.SetLabel(remote, "tcp:5432", "pg")
+	_ = m.SetLabel(remote, "udp:5353", "mdns")
+	_ = m.SetLabel(remote, "unix:/tmp/pg.sock", "pgsock")
+
+	labels := m.GetLabels(remote)
+	if len(labels) != 3 || labels["tcp:5432"] != "pg" {
+		t.Fatalf("Unexpected labels: %v", labels)
+	}
+
+	// Removing a forward drops its label
+	_ = m.RemoveForward(remote, "5432")
+	_ = m.RemoveUnixForward(remote, "unix:/tmp/pg.sock")
+	labels = m.GetLabels(remote)
+	if len(labels) != 1 || labels["udp:5353"] != "mdns" {
+		t.Errorf("Unexpected labels after removal: %v", labels)
+	}
+
+	// An empty label clears it
+	_ = m.SetLabel(remote, "udp:5353", "")
+	if labels := m.GetLabels(remote); len(labels) != 0 {
+		t.Errorf("Expected no labels, got %v", labels)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	unregister, err := Register("user@box", "/tmp/mpf-test-master-user@box.sock")
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	// A record left behind by a process that is gone
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Failed to run true: %v", err)
+	}
+	deadPID := cmd.Process.Pid
+	stalePath := filepath.Join(home, ".mpf", "sessions", strconv.Itoa(deadPID)+".json")
+	data, _ := json.Marshal(Session{PID: deadPID, Target: "user@gone"})
+	if err := os.WriteFile(stalePath, data, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	sessions, err := Sessions()
+	if err != nil {
+		t.Fatalf("Sessions failed: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].Target != "user@box" || sessions[0].PID != os.Getpid() {
+		t.Errorf("Unexpected sessions %+v", sessions)
+	}
+	if _, err := os.Stat(stalePath); !os.IsNotExist(err) {
+		t.Errorf("Expected stale record to be removed, got %v", err)
+	}
+
+	unregister()
+	if sessions, _ := Sessions(); len(sessions) != 0 {
+		t.Errorf("Expected no sessions after unregister, got %+v", sessions)
+	}
+}
+
+func TestRegistryStaleSockets(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dir := t.TempDir()
+
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Failed to run true: %v", err)
+	}
+	deadPID := cmd.Process.Pid
+	writeRecord := func(name string, s Session) {
+		t.Helper()
+		data, _ := json.Marshal(s)
+		if err := os.MkdirAll(filepath.Join(home, ".mpf", "sessions"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(home, ".mpf", "sessions", name), data, 0600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	// A new master for the same target answers on the path of a dead one
+	live := filepath.Join(dir, "live.sock")
+	ln, err := net.Listen("unix", live)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	writeRecord("1.json", Session{PID: deadPID, Target: "user@box", Socket: live})
+
+	// A live registered master lists the path, whether or not it answers
+	listed := filepath.Join(dir, "listed.sock")
+	if err := os.WriteFile(listed, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeRecord("2.json", Session{PID: deadPID, Target: "user@db", Socket: listed})
+	writeRecord("3.json", Session{PID: os.Getpid(), Target: "user@db", Socket: listed})
+
+	// Nothing uses this one any more
+	gone := filepath.Join(dir, "gone.sock")
+	if err := os.WriteFile(gone, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeRecord("4.json", Session{PID: deadPID, Target: "user@gone", Socket: gone})
+
+	sessions, err := Sessions()
+	if err != nil {
+		t.Fatalf("Sessions failed: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].Target != "user@db" {
+		t.Errorf("Unexpected sessions %+v", sessions)
+	}
+	for _, sock := range []string{live, listed} {
+		if _, err := os.Stat(sock); err != nil {
+			t.Errorf("Expected %s to be kept, got %v", sock, err)
+		}
+	}
+	if _, err := os.Stat(gone); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be removed, got %v", gone, err)
+	}
+}
@@ -0,0 +1,177 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DatagramMultiplexer is implemented by multiplexers that can carry
+// unreliable datagrams next to their streams (QUIC).
+type DatagramMultiplexer interface {
+	SupportsDatagrams() bool
+	SendDatagram(p []byte) error
+	ReceiveDatagram(ctx context.Context) ([]byte, error)
+}
+
+// SupportsDatagrams reports whether the session can carry packet flows as
+// datagrams instead of framing them on the flow's stream.
+func (s *Session) SupportsDatagrams() bool {
+	dm, ok := s.Mux.(DatagramMultiplexer)
+	return ok && dm.SupportsDatagrams()
+}
+
+// sendDatagram sends payload for flow id as a single datagram.
+func (s *Session) sendDatagram(id uint32, payload []byte) error {
+	dm, ok := s.Mux.(DatagramMultiplexer)
+	if !ok {
+		return fmt.Errorf("session does not support datagrams")
+	}
+	buf := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(buf, id)
+	copy(buf[4:], payload)
+	return dm.SendDatagram(buf)
+}
+
+func (s *Session) registerFlow(id uint32, ch chan []byte) {
+	s.flowMu.Lock()
+	if s.flows == nil {
+		s.flows = make(map[uint32]chan []byte)
+	}
+	s.flows[id] = ch
+	s.flowMu.Unlock()
+
+	s.flowsOnce.Do(func() {
+		if dm, ok := s.Mux.(DatagramMultiplexer); ok {
+			go s.dispatchDatagrams(dm)
+		}
+	})
+}
+
+func (s *Session) unregisterFlow(id uint32) {
+	s.flowMu.Lock()
+	delete(s.flows, id)
+	s.flowMu.Unlock()
+}
+
+func (s *Session) dispatchDatagrams(dm DatagramMultiplexer) {
+	for {
+		data, err := dm.ReceiveDatagram(context.Background())
+		if err != nil {
+			return
+		}
+		if len(data) < 4 {
+			continue
+		}
+		id := binary.BigEndian.Uint32(data)
+
+		s.flowMu.Lock()
+		ch, ok := s.flows[id]
+		s.flowMu.Unlock()
+		if !ok {
+			continue
+		}
+
+		select {
+		case ch <- data[4:]:
+		default:
+			// Receiver is behind; drop like the network would
+		}
+	}
+}
+
+// PacketFlow carries the packets of one UDP flow. The flow is bound to a
+// stream for its lifetime; packets travel as datagrams when both sides agreed
+// to use them, and as length-framed messages on the stream otherwise (or when
+// a packet is too large for a datagram).
+type PacketFlow struct {
+	session   *Session
+	stream    io.ReadWriteCloser
+	id        uint32
+	datagrams bool
+
+	packets chan []byte
+	done    chan struct{}
+	wmu     sync.Mutex
+	once    sync.Once
+}
+
+func NewPacketFlow(s *Session, stream io.ReadWriteCloser, id uint32, datagrams bool) *PacketFlow {
+	f := &PacketFlow{
+		session:   s,
+		stream:    stream,
+		id:        id,
+		datagrams: datagrams && s != nil && s.SupportsDatagrams(),
+		packets:   make(chan []byte, 64),
+		done:      make(chan struct{}),
+	}
+	if f.datagrams {
+		s.registerFlow(id, f.packets)
+	}
+	go f.readFrames()
+	return f
+}
+
+func (f *PacketFlow) readFrames() {
+	defer f.Close()
+
+	hdr := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(f.stream, hdr); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(hdr))
+		if _, err := io.ReadFull(f.stream, buf); err != nil {
+			return
+		}
+		select {
+		case f.packets <- buf:
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// WritePacket sends one packet to the other side of the flow.
+func (f *PacketFlow) WritePacket(p []byte) error {
+	if len(p) > 0xffff {
+		return fmt.Errorf("packet too large: %d bytes", len(p))
+	}
+	if f.datagrams {
+		if err := f.session.sendDatagram(f.id, p); err == nil {
+			return nil
+		}
+	}
+
+	buf := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(buf, uint16(len(p)))
+	copy(buf[2:], p)
+
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+	_, err := f.stream.Write(buf)
+	return err
+}
+
+// ReadPacket blocks until a packet arrives or the flow is closed.
+func (f *PacketFlow) ReadPacket() ([]byte, error) {
+	select {
+	case p := <-f.packets:
+		return p, nil
+	case <-f.done:
+		return nil, io.EOF
+	}
+}
+
+func (f *PacketFlow) Close() error {
+	f.once.Do(func() {
+		close(f.done)
+		if f.datagrams {
+			f.session.unregisterFlow(f.id)
+		}
+		f.stream.Close()
+	})
+	return nil
+}
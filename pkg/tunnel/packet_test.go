@@ -0,0 +1,90 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// datagramMux is a Multiplexer whose datagrams go to a peer datagramMux.
+type datagramMux struct {
+	MockMultiplexer
+	in   chan []byte
+	peer *datagramMux
+	max  int
+}
+
+func (d *datagramMux) SupportsDatagrams() bool { return true }
+
+func (d *datagramMux) SendDatagram(p []byte) error {
+	if len(p) > d.max {
+		return fmt.Errorf("datagram too large")
+	}
+	d.peer.in <- append([]byte(nil), p...)
+	return nil
+}
+
+func (d *datagramMux) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	select {
+	case p := <-d.in:
+		return p, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestPacketFlowFramed(t *testing.T) {
+	a, b := net.Pipe()
+	fa := NewPacketFlow(nil, a, 1, true)
+	fb := NewPacketFlow(nil, b, 1, true)
+	defer fa.Close()
+	defer fb.Close()
+
+	for _, msg := range []string{"one", "", "three"} {
+		go fa.WritePacket([]byte(msg))
+		p, err := fb.ReadPacket()
+		if err != nil {
+			t.Fatalf("ReadPacket failed: %v", err)
+		}
+		if string(p) != msg {
+			t.Errorf("Expected %q, got %q", msg, p)
+		}
+	}
+
+	fa.Close()
+	if _, err := fb.ReadPacket(); err == nil {
+		t.Error("Expected error after peer closed the flow")
+	}
+}
+
+func TestPacketFlowDatagrams(t *testing.T) {
+	ma := &datagramMux{in: make(chan []byte, 8), max: 16}
+	mb := &datagramMux{in: make(chan []byte, 8), max: 16}
+	ma.peer, mb.peer = mb, ma
+	sa := &Session{Mux: ma}
+	sb := &Session{Mux: mb}
+
+	a, b := net.Pipe()
+	fa := NewPacketFlow(sa, a, 7, true)
+	fb := NewPacketFlow(sb, b, 7, true)
+	defer fa.Close()
+	defer fb.Close()
+
+	// Small packets go as datagrams and never touch the stream
+	if err := fa.WritePacket([]byte("small")); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+	p, err := fb.ReadPacket()
+	if err != nil || string(p) != "small" {
+		t.Fatalf("Expected %q, got %q (err %v)", "small", p, err)
+	}
+
+	// Oversized packets fall back to the stream
+	big := "this packet does not fit in a datagram"
+	go fa.WritePacket([]byte(big))
+	p, err = fb.ReadPacket()
+	if err != nil || string(p) != big {
+		t.Fatalf("Expected %q, got %q (err %v)", big, p, err)
+	}
+}
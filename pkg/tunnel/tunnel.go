@@ -59,12 +59,29 @@ func (q *QuicMultiplexer) Close() error {
 	return q.Conn.CloseWithError(0, "")
 }
 
+func (q *QuicMultiplexer) SupportsDatagrams() bool {
+	state := q.Conn.ConnectionState()
+	return state.SupportsDatagrams.Local && state.SupportsDatagrams.Remote
+}
+
+func (q *QuicMultiplexer) SendDatagram(p []byte) error {
+	return q.Conn.SendDatagram(p)
+}
+
+func (q *QuicMultiplexer) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	return q.Conn.ReceiveDatagram(ctx)
+}
+
 type Session struct {
 	Mux          Multiplexer
 	Control      *gob.Encoder
 	Decoder      *gob.Decoder
 	mu           sync.Mutex
 	lastReceived time.Time
+
+	flowMu    sync.Mutex
+	flows     map[uint32]chan []byte
+	flowsOnce sync.Once
 }
 
 func NewSession(conn io.ReadWriteCloser, server bool) (*Session, error) {
@@ -0,0 +1,56 @@
+package util
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// loopbackAddrs are tried in order when dialing "localhost", as /etc/hosts
+// often maps it to only one of them.
+var loopbackAddrs = []string{"127.0.0.1", "::1"}
+
+// DialTCP dials host:port over TCP. "localhost" is dialed as both 127.0.0.1
+// and ::1, so services bound to only one loopback address are reachable.
+func DialTCP(host string, port uint16) (net.Conn, error) {
+	hosts := []string{host}
+	if host == "localhost" {
+		hosts = loopbackAddrs
+	}
+
+	var err error
+	for _, h := range hosts {
+		var conn net.Conn
+		conn, err = net.Dial("tcp", net.JoinHostPort(h, strconv.Itoa(int(port))))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// DialUDP is the UDP counterpart of DialTCP. A UDP dial succeeds whether or
+// not anything listens, so for "localhost" it picks the first loopback
+// address the port is bound on, found by failing to bind it, and else
+// 127.0.0.1.
+func DialUDP(host string, port uint16) (net.Conn, error) {
+	addr := func(h string) string {
+		return net.JoinHostPort(h, strconv.Itoa(int(port)))
+	}
+	if host == "localhost" {
+		host = loopbackAddrs[0]
+		for _, h := range loopbackAddrs {
+			pc, err := net.ListenPacket("udp", addr(h))
+			if err == nil {
+				pc.Close()
+				continue
+			}
+			if errors.Is(err, syscall.EADDRINUSE) {
+				host = h
+				break
+			}
+		}
+	}
+	return net.Dial("udp", addr(host))
+}
@@ -0,0 +1,72 @@
+package util
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDialTCPLocalhost(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Logf("Skipping %s: %v", addr, err)
+			continue
+		}
+
+		port := uint16(ln.Addr().(*net.TCPAddr).Port)
+		conn, err := DialTCP("localhost", port)
+		if err != nil {
+			t.Errorf("DialTCP(localhost, %d) for listener on %s failed: %v", port, ln.Addr(), err)
+		} else {
+			conn.Close()
+		}
+		ln.Close()
+	}
+}
+
+func TestDialTCPRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+	ln.Close()
+
+	if conn, err := DialTCP("127.0.0.1", port); err == nil {
+		conn.Close()
+		t.Errorf("Expected DialTCP to a closed port to fail")
+	}
+}
+
+func TestDialUDPLocalhost(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			t.Logf("Skipping %s: %v", addr, err)
+			continue
+		}
+		go func() {
+			buf := make([]byte, 64)
+			n, from, err := pc.ReadFrom(buf)
+			if err == nil {
+				_, _ = pc.WriteTo(buf[:n], from)
+			}
+		}()
+
+		port := uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+		conn, err := DialUDP("localhost", port)
+		if err != nil {
+			t.Fatalf("DialUDP(localhost, %d) failed: %v", port, err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 64)
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Errorf("Write failed: %v", err)
+		} else if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "ping" {
+			t.Errorf("Expected echo from %s, got %q (err %v)", pc.LocalAddr(), buf[:n], err)
+		}
+		conn.Close()
+		pc.Close()
+	}
+}